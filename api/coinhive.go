@@ -0,0 +1,153 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/trey-jones/xmrwasp/config"
+	"github.com/trey-jones/xmrwasp/logger"
+	"github.com/trey-jones/xmrwasp/proxy"
+)
+
+// Coinhive's error names, which their clients look for
+const (
+	errMissingInput  = "missing_input"
+	errInvalidSecret = "invalid_secret"
+	errInvalidToken  = "invalid_token"
+	errInternal      = "internal_error"
+)
+
+type errorReply struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error"`
+}
+
+type verifyReply struct {
+	Success bool   `json:"success"`
+	Hashes  uint64 `json:"hashes"`
+	Created int64  `json:"created"`
+}
+
+type balanceReply struct {
+	Success   bool   `json:"success"`
+	Name      string `json:"name"`
+	Total     uint64 `json:"total"`
+	Withdrawn uint64 `json:"withdrawn"`
+	Balance   uint64 `json:"balance"`
+}
+
+type withdrawReply struct {
+	Success bool   `json:"success"`
+	Name    string `json:"name"`
+	Amount  uint64 `json:"amount"`
+}
+
+func writeError(w http.ResponseWriter, reason string) {
+	writeJSON(w, &errorReply{Error: reason})
+}
+
+// siteFor checks the secret sent with a Coinhive style request.  It writes the error if the
+// request can't go on.
+func siteFor(w http.ResponseWriter, r *http.Request, method string) (string, bool) {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return "", false
+	}
+	siteKey, ok := config.Get().SiteForSecret(r.FormValue("secret"))
+	if !ok {
+		writeError(w, errInvalidSecret)
+		return "", false
+	}
+	return siteKey, true
+}
+
+// verifyToken tells a site owner whether a miner session has done enough hashes
+func verifyToken(w http.ResponseWriter, r *http.Request) {
+	siteKey, ok := siteFor(w, r, http.MethodPost)
+	if !ok {
+		return
+	}
+	token := r.FormValue("token")
+	hashes, err := strconv.ParseUint(r.FormValue("hashes"), 10, 64)
+	if token == "" || err != nil {
+		writeError(w, errMissingInput)
+		return
+	}
+
+	// like Coinhive, a token can only be verified once
+	tb, err := proxy.GetHashStore().RedeemToken(siteKey, token, hashes)
+	if err != nil {
+		logger.Get().Println("Unable to read token from the hash store: ", err)
+		writeError(w, errInternal)
+		return
+	}
+	if tb == nil {
+		writeError(w, errInvalidToken)
+		return
+	}
+
+	writeJSON(w, &verifyReply{
+		Success: tb.Hashes >= hashes,
+		Hashes:  tb.Hashes,
+		Created: tb.Created.Unix(),
+	})
+}
+
+// userBalance is the hashes done for a user of the site.  Users that haven't mined have nothing.
+func userBalance(w http.ResponseWriter, r *http.Request) {
+	siteKey, ok := siteFor(w, r, http.MethodGet)
+	if !ok {
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" {
+		writeError(w, errMissingInput)
+		return
+	}
+
+	ub, err := proxy.GetHashStore().User(siteKey, name)
+	if err != nil {
+		logger.Get().Println("Unable to read user from the hash store: ", err)
+		writeError(w, errInternal)
+		return
+	}
+	if ub == nil {
+		ub = &proxy.UserBalance{SiteKey: siteKey, Name: name}
+	}
+
+	writeJSON(w, &balanceReply{
+		Success:   true,
+		Name:      ub.Name,
+		Total:     ub.Total,
+		Withdrawn: ub.Withdrawn,
+		Balance:   ub.Balance(),
+	})
+}
+
+// withdraw spends hashes from a user's balance, eg. when the site gives them something for it
+func withdraw(w http.ResponseWriter, r *http.Request) {
+	siteKey, ok := siteFor(w, r, http.MethodPost)
+	if !ok {
+		return
+	}
+	name := r.FormValue("name")
+	amount, err := strconv.ParseUint(r.FormValue("amount"), 10, 64)
+	if name == "" || err != nil {
+		writeError(w, errMissingInput)
+		return
+	}
+
+	_, err = proxy.GetHashStore().Withdraw(siteKey, name, amount)
+	if err == proxy.ErrInsufficientFunds {
+		writeError(w, err.Error())
+		return
+	}
+	if err != nil {
+		logger.Get().Println("Unable to withdraw from the hash store: ", err)
+		writeError(w, errInternal)
+		return
+	}
+
+	writeJSON(w, &withdrawReply{Success: true, Name: name, Amount: amount})
+}
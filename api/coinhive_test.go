@@ -0,0 +1,80 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/trey-jones/xmrwasp/proxy"
+)
+
+func coinhive(t *testing.T, method, path string, form url.Values) map[string]interface{} {
+	var r *http.Request
+	if method == "GET" {
+		r = httptest.NewRequest(method, path+"?"+form.Encode(), nil)
+	} else {
+		r = httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	w := httptest.NewRecorder()
+	NewHandler().ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	reply := make(map[string]interface{})
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &reply))
+	return reply
+}
+
+func TestVerifyToken(t *testing.T) {
+	store := proxy.GetHashStore()
+	created := time.Unix(1502266342, 0)
+	require.NoError(t, store.NewToken("partner", "partnertoken", created))
+	require.NoError(t, store.Credit("partner", "partnertoken", "", 1024))
+
+	form := url.Values{"secret": {"partnersecret"}, "token": {"partnertoken"}, "hashes": {"2048"}}
+	require.Equal(t, false, coinhive(t, "POST", "/token/verify", form)["success"])
+
+	// tokens only belong to their own site
+	form.Set("hashes", "1024")
+	form.Set("secret", "othersecret")
+	require.Equal(t, "invalid_token", coinhive(t, "POST", "/token/verify", form)["error"])
+
+	form.Set("secret", "partnersecret")
+	reply := coinhive(t, "POST", "/token/verify", form)
+	require.Equal(t, map[string]interface{}{"success": true, "hashes": 1024.0, "created": 1502266342.0}, reply)
+	// and can't be verified again
+	require.Equal(t, "invalid_token", coinhive(t, "POST", "/token/verify", form)["error"])
+	form.Set("secret", "wrong")
+	require.Equal(t, "invalid_secret", coinhive(t, "POST", "/token/verify", form)["error"])
+	form = url.Values{"secret": {"partnersecret"}, "token": {"partnertoken"}}
+	require.Equal(t, "missing_input", coinhive(t, "POST", "/token/verify", form)["error"])
+
+	// the bearer token isn't needed, and doesn't replace the secret
+	w := request(t, "GET", "/token/verify", "")
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestUserBalance(t *testing.T) {
+	require.NoError(t, proxy.GetHashStore().Credit("partner", "", "alice", 5000))
+
+	form := url.Values{"secret": {"partnersecret"}, "name": {"alice"}}
+	reply := coinhive(t, "GET", "/user/balance", form)
+	require.Equal(t, map[string]interface{}{
+		"success": true, "name": "alice", "total": 5000.0, "withdrawn": 0.0, "balance": 5000.0,
+	}, reply)
+
+	form.Set("amount", "3000")
+	reply = coinhive(t, "POST", "/user/withdraw", form)
+	require.Equal(t, map[string]interface{}{"success": true, "name": "alice", "amount": 3000.0}, reply)
+	require.Equal(t, "insufficent_funds", coinhive(t, "POST", "/user/withdraw", form)["error"])
+	require.Equal(t, 2000.0, coinhive(t, "GET", "/user/balance", form)["balance"])
+
+	// users are kept apart by site
+	form.Set("secret", "othersecret")
+	require.Equal(t, 0.0, coinhive(t, "GET", "/user/balance", form)["total"])
+}
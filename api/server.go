@@ -0,0 +1,231 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/trey-jones/xmrwasp/config"
+	"github.com/trey-jones/xmrwasp/logger"
+	"github.com/trey-jones/xmrwasp/metrics"
+	"github.com/trey-jones/xmrwasp/proxy"
+)
+
+// Version is reported by the summary endpoint
+var Version string
+
+// StartServer serves the status of the proxy as JSON.  The summary and workers endpoints
+// are shaped like the xmrig-proxy API, so that existing dashboards can read them.
+func StartServer() {
+	bind := config.Get().APIBind
+	logger.Get().Debug("Starting API server on: ", bind)
+	err := http.ListenAndServe(bind, NewHandler())
+	if err != nil {
+		logger.Get().Fatal("Failed to start API server: ", err)
+	}
+}
+
+// NewHandler returns the API routes, behind the bearer token if one is configured.  The Coinhive
+// style routes are for site owners, who use their site's secret instead.
+func NewHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/1/summary", summary)
+	mux.HandleFunc("/1/workers", workers)
+	mux.HandleFunc("/1/proxies", proxies)
+	mux.HandleFunc("/1/sites", sites)
+	mux.HandleFunc("/1/reload", reload)
+	mux.Handle("/metrics", metrics.Handler())
+
+	root := http.NewServeMux()
+	root.Handle("/", authorize(mux, config.Get().APIToken))
+	root.HandleFunc("/token/verify", verifyToken)
+	root.HandleFunc("/user/balance", userBalance)
+	root.HandleFunc("/user/withdraw", withdraw)
+
+	return root
+}
+
+func authorize(h http.Handler, token string) http.Handler {
+	if token == "" {
+		return h
+	}
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		logger.Get().Println("Failed to write API response: ", err)
+	}
+}
+
+type summaryReply struct {
+	Version     string `json:"version"`
+	Kind        string `json:"kind"`
+	Mode        string `json:"mode"`
+	Uptime      int64  `json:"uptime"`
+	DonateLevel int    `json:"donate_level"`
+
+	Miners struct {
+		Now int `json:"now"`
+	} `json:"miners"`
+	Workers int `json:"workers"`
+
+	Upstreams struct {
+		Active int     `json:"active"`
+		Error  int     `json:"error"`
+		Total  int     `json:"total"`
+		Ratio  float64 `json:"ratio"`
+	} `json:"upstreams"`
+
+	Results struct {
+		Accepted uint64 `json:"accepted"`
+		Rejected uint64 `json:"rejected"`
+	} `json:"results"`
+}
+
+func summary(w http.ResponseWriter, r *http.Request) {
+	stats := proxy.GetDirector().GetStats()
+	reply := &summaryReply{
+		Version:     Version,
+		Kind:        "proxy",
+		Mode:        "simple",
+		Uptime:      int64(stats.Alive.Seconds()),
+		DonateLevel: config.Get().DonateLevel,
+		Workers:     stats.Workers,
+	}
+	reply.Miners.Now = stats.Workers
+	for _, ps := range proxy.GetDirector().GetProxyStats() {
+		reply.Upstreams.Total++
+		if ps.AuthID != "" {
+			reply.Upstreams.Active++
+		} else {
+			reply.Upstreams.Error++
+		}
+	}
+	if reply.Upstreams.Active > 0 {
+		reply.Upstreams.Ratio = float64(stats.Workers) / float64(reply.Upstreams.Active)
+	}
+	reply.Results.Accepted = stats.Shares
+	reply.Results.Rejected = stats.Rejected
+
+	writeJSON(w, reply)
+}
+
+type workersReply struct {
+	Mode    string          `json:"mode"`
+	Workers [][]interface{} `json:"workers"`
+}
+
+// workers lists one row per worker, in xmrig-proxy column order:
+// name, ip, connections, accepted, rejected, invalid, hashes, last hash (ms), then hashrates.
+func workers(w http.ResponseWriter, r *http.Request) {
+	reply := &workersReply{
+		Mode:    "id",
+		Workers: make([][]interface{}, 0),
+	}
+	for _, ws := range proxy.GetDirector().GetWorkerStats() {
+		name := strconv.FormatUint(ws.ProxyID, 10) + "." + strconv.FormatUint(ws.ID, 10)
+		var lastHash int64
+		if !ws.LastShare.IsZero() {
+			lastHash = ws.LastShare.UnixNano() / int64(time.Millisecond)
+		}
+		ip, _, err := net.SplitHostPort(ws.RemoteAddr)
+		if err != nil {
+			ip = ws.RemoteAddr
+		}
+		reply.Workers = append(reply.Workers, []interface{}{
+			name, ip, 1, ws.Accepted, ws.Rejected, 0, ws.Hashes, lastHash,
+			ws.Hashrate1m, ws.Hashrate, 0.0, 0.0, 0.0,
+		})
+	}
+
+	writeJSON(w, reply)
+}
+
+type proxyReply struct {
+	ID       uint64 `json:"id"`
+	Pool     string `json:"pool"`
+	Profile  string `json:"profile"`
+	Algo     string `json:"algo,omitempty"`
+	AuthID   string `json:"auth_id"`
+	Uptime   int64  `json:"uptime"`
+	Workers  int    `json:"workers"`
+	Shares   uint64 `json:"shares"`
+	Rejected uint64 `json:"rejected"`
+	Donating bool   `json:"donating"`
+}
+
+type siteReply struct {
+	SiteKey string `json:"site_key"`
+	Workers int    `json:"workers"`
+	Hashes  uint64 `json:"hashes"`
+}
+
+func sites(w http.ResponseWriter, r *http.Request) {
+	reply := make([]*siteReply, 0)
+	for _, ss := range proxy.GetDirector().GetSiteStats() {
+		reply = append(reply, &siteReply{
+			SiteKey: ss.SiteKey,
+			Workers: ss.Workers,
+			Hashes:  ss.Hashes,
+		})
+	}
+
+	writeJSON(w, map[string]interface{}{"sites": reply})
+}
+
+// reload reads the config file again, like SIGHUP.  It changes things, so it needs a POST,
+// and it is only available when the API is protected by a token.
+func reload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if config.Get().APIToken == "" {
+		http.Error(w, "set apitoken to enable config reloads", http.StatusForbidden)
+		return
+	}
+
+	result, err := proxy.GetDirector().Reload()
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		writeJSON(w, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, result)
+}
+
+func proxies(w http.ResponseWriter, r *http.Request) {
+	reply := make([]*proxyReply, 0)
+	for _, ps := range proxy.GetDirector().GetProxyStats() {
+		reply = append(reply, &proxyReply{
+			ID:       ps.ID,
+			Pool:     ps.Pool,
+			Profile:  ps.Profile,
+			Algo:     ps.Algo,
+			AuthID:   ps.AuthID,
+			Uptime:   int64(ps.Alive.Seconds()),
+			Workers:  ps.Workers,
+			Shares:   ps.Shares,
+			Rejected: ps.Rejected,
+			Donating: ps.Donating,
+		})
+	}
+
+	writeJSON(w, map[string]interface{}{"proxies": reply})
+}
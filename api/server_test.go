@@ -0,0 +1,83 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	os.Setenv("XMRWASP_URL", "localhost:0")
+	os.Setenv("XMRWASP_LOGIN", "testwallet")
+	os.Setenv("XMRWASP_PASSWORD", "x")
+	os.Setenv("XMRWASP_APITOKEN", "secret")
+	os.Setenv("XMRWASP_SITEKEYS", `{"partner": {"secret": "partnersecret"}, "other": {"secret": "othersecret"}}`)
+	defer os.Clearenv()
+
+	os.Exit(m.Run())
+}
+
+func get(t *testing.T, path, token string) *httptest.ResponseRecorder {
+	return request(t, "GET", path, token)
+}
+
+func request(t *testing.T, method, path, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	NewHandler().ServeHTTP(w, r)
+
+	return w
+}
+
+func TestAuthorization(t *testing.T) {
+	require.Equal(t, http.StatusUnauthorized, get(t, "/1/summary", "").Code)
+	require.Equal(t, http.StatusUnauthorized, get(t, "/1/summary", "wrong").Code)
+	require.Equal(t, http.StatusOK, get(t, "/1/summary", "secret").Code)
+}
+
+func TestSummary(t *testing.T) {
+	Version = "test"
+	w := get(t, "/1/summary", "secret")
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	reply := make(map[string]interface{})
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &reply))
+	require.Equal(t, "test", reply["version"])
+	require.Equal(t, "proxy", reply["kind"])
+	for _, key := range []string{"uptime", "donate_level", "miners", "workers", "upstreams", "results"} {
+		require.Contains(t, reply, key)
+	}
+}
+
+func TestWorkersAndProxies(t *testing.T) {
+	reply := make(map[string]interface{})
+	require.NoError(t, json.Unmarshal(get(t, "/1/workers", "secret").Body.Bytes(), &reply))
+	require.Equal(t, []interface{}{}, reply["workers"])
+
+	reply = make(map[string]interface{})
+	require.NoError(t, json.Unmarshal(get(t, "/1/proxies", "secret").Body.Bytes(), &reply))
+	require.Equal(t, []interface{}{}, reply["proxies"])
+
+	reply = make(map[string]interface{})
+	require.NoError(t, json.Unmarshal(get(t, "/1/sites", "secret").Body.Bytes(), &reply))
+	require.Equal(t, []interface{}{}, reply["sites"])
+}
+
+func TestReload(t *testing.T) {
+	require.Equal(t, http.StatusUnauthorized, request(t, "POST", "/1/reload", "").Code)
+	require.Equal(t, http.StatusMethodNotAllowed, get(t, "/1/reload", "secret").Code)
+
+	// the config came from the environment, so there is no file to reload
+	w := request(t, "POST", "/1/reload", "secret")
+	require.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	reply := make(map[string]interface{})
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &reply))
+	require.Contains(t, reply["error"], "can't be reloaded")
+}
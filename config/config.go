@@ -1,6 +1,7 @@
 package config
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -23,8 +24,25 @@ var (
 
 	instance      *Config
 	instantiation = sync.Once{}
+	// instance is replaced when the config is reloaded
+	instanceMu sync.RWMutex
+	// reloadMu makes reloads take turns, so each one reports the config it really replaced
+	reloadMu sync.Mutex
 )
 
+// the ways work can be split between workers
+const (
+	JobModeNonce    = "nonce"
+	JobModeNiceHash = "nicehash"
+)
+
+// restartKeys are the options that are only read at startup, so changing them needs a restart
+var restartKeys = []string{
+	"noweb", "notcp", "wsport", "strport", "strtls", "strtlsport", "wss", "tlscert", "tlskey",
+	"wsbind", "strbind", "strtlsbind", "listeners", "jobmode",
+	"api", "apitoken", "log", "nolog", "background",
+}
+
 // Config holds the global application configuration.
 type Config struct {
 	Debug bool `envconfig:"debug" json:"debug"`
@@ -34,19 +52,78 @@ type Config struct {
 	WebsocketPort    int  `envconfig:"wsport" default:"8080" json:"wsport"`
 	StratumPort      int  `envconfig:"strport" default:"1111" json:"strport"`
 
+	// StratumTLS turns on a stratum+ssl listener, independent of the plain TCP listener
+	StratumTLS     bool `envconfig:"strtls" json:"strtls"`
+	StratumTLSPort int  `envconfig:"strtlsport" default:"1112" json:"strtlsport"`
+
+	// The bind addresses limit each listener to one interface.  Empty means all interfaces,
+	// and "unix:/path" listens on a Unix socket instead of the port.
+	WebsocketBind  string `envconfig:"wsbind" json:"wsbind"`
+	StratumBind    string `envconfig:"strbind" json:"strbind"`
+	StratumTLSBind string `envconfig:"strtlsbind" json:"strtlsbind"`
+
+	// Listeners replace all of the single listener options above when given
+	Listeners Listeners `envconfig:"listeners" json:"listeners"`
+
+	// CertFile and KeyFile are used by both wss and stratum+ssl.
+	// A self-signed certificate is generated for stratum+ssl if they are missing.
 	SecureWebsocket bool   `envconfig:"wss" json:"wss"`
 	CertFile        string `envconfig:"tlscert" json:"tlscert"`
 	KeyFile         string `envconfig:"tlskey" json:"tlskey"`
-	// TODO also support TLS for stratum connections
 
-	// TODO multiple pools for fallback
-	PoolAddr     string `envconfig:"url" required:"true" json:"url"`
-	PoolLogin    string `envconfig:"login" required:"true" json:"login"`
-	PoolPassword string `envconfig:"password" required:"true" json:"password"`
+	// Origins are the websites allowed to open websocket connections, eg. "*.example.com".
+	// Empty allows any website.
+	Origins []string `envconfig:"origins" json:"origins"`
+
+	// SiteKeys are checked when Coinhive style miners send auth.  Empty accepts any site key.
+	SiteKeys SiteKeys `envconfig:"sitekeys" json:"sitekeys"`
+
+	// Pools are tried in order, the first being the most preferred.
+	// If no pools are listed, the single pool url, login, and password are used.
+	Pools        Pools  `envconfig:"pools" json:"pools"`
+	PoolAddr     string `envconfig:"url" json:"url"`
+	PoolLogin    string `envconfig:"login" json:"login"`
+	PoolPassword string `envconfig:"password" json:"password"`
+	// Profiles are extra pool lists, for listeners that mine somewhere else
+	Profiles Profiles `envconfig:"profiles" json:"profiles"`
+
+	// PoolCA is a PEM bundle used to verify TLS pools instead of the system roots
+	PoolCA string `envconfig:"poolca" json:"poolca"`
+
+	// FailbackInterval is how often (seconds) a proxy on a fallback pool checks for a better one
+	FailbackInterval int `envconfig:"failback" default:"60" json:"failback"`
 
 	StatInterval int `envconfig:"stats" default:"60" json:"stats"`
 
+	// APIBind is the address for the HTTP status API, eg. "127.0.0.1:8081".  Empty disables the API.
+	APIBind  string `envconfig:"api" json:"api"`
+	APIToken string `envconfig:"apitoken" json:"apitoken"`
+
+	// JobMode is how work is split between workers.  "nonce" gives each worker a different
+	// starting nonce, and "nicehash" reserves the top nonce byte for each worker.
+	JobMode string `envconfig:"jobmode" json:"jobmode" default:"nonce"`
+
 	ShareValidation int `envconfig:"validateshares" json:"validateshares" default:"2"`
+	// VerifySample is the percentage of shares that get their hash recalculated at validation level 4
+	VerifySample int `envconfig:"verifysample" json:"verifysample" default:"10"`
+
+	// Vardiff gives each worker its own target, aiming for a share every ShareTime seconds.
+	// Only shares that meet the pool target are sent to the pool.  MaxDiff 0 means no limit.
+	Vardiff   bool `envconfig:"vardiff" json:"vardiff"`
+	MinDiff   int  `envconfig:"mindiff" json:"mindiff" default:"1000"`
+	MaxDiff   int  `envconfig:"maxdiff" json:"maxdiff"`
+	ShareTime int  `envconfig:"sharetime" json:"sharetime" default:"30"`
+
+	// IdleTimeout disconnects workers that send nothing for this many seconds, and MaxLifetime
+	// recycles connections older than this many seconds.  0 means no limit.
+	IdleTimeout int `envconfig:"idletimeout" json:"idletimeout"`
+	MaxLifetime int `envconfig:"maxlifetime" json:"maxlifetime"`
+
+	// SpinDown is how long (seconds) a pool connection is kept without any workers.  0 keeps them forever.
+	SpinDown int `envconfig:"spindown" json:"spindown" default:"300"`
+
+	// ShutdownTimeout is how long (seconds) to wait for shares in flight when stopping
+	ShutdownTimeout int `envconfig:"shutdowntimeout" json:"shutdowntimeout" default:"10"`
 
 	DonateLevel int `envconfig:"donate" default:"2" json:"donate"`
 
@@ -58,6 +135,63 @@ type Config struct {
 	Background bool `envconfig:"background" json:"background"`
 }
 
+// Pool holds the connection details for a single upstream mining pool.
+type Pool struct {
+	URL      string `json:"url"`
+	Login    string `json:"login"`
+	Password string `json:"password"`
+	TLS      bool   `json:"tls"`
+
+	// TLSFingerprint pins the SHA-256 fingerprint of the pool certificate
+	TLSFingerprint string `json:"tls-fingerprint"`
+
+	// Daemon means URL is a monerod JSON-RPC address to solo mine on, and Login is the wallet
+	Daemon bool `json:"daemon"`
+	// Algo is the algorithm to ask the pool for, eg. rx/0.  Empty takes whatever the pool mines.
+	Algo string `json:"algo"`
+	// ExtraNonce is the share field that the pool wants the extra nonce in, for jobs with a
+	// reserved_offset.  Without it, the pool's reserved space is left alone.
+	ExtraNonce string `json:"extranonce"`
+}
+
+// SiteKey is a site that browser miners can mine for.  If Login is set, the site's miners mine
+// with that login, and Password if it is set, instead of the pool's.  Secret lets the site owner
+// check tokens and user balances through the HTTP API.
+type SiteKey struct {
+	Login    string `json:"login"`
+	Password string `json:"password"`
+	Secret   string `json:"secret"`
+}
+
+// SiteForSecret finds the site key that goes with a secret
+func (c *Config) SiteForSecret(secret string) (string, bool) {
+	if secret == "" {
+		return "", false
+	}
+	for siteKey, site := range c.SiteKeys {
+		if subtle.ConstantTimeCompare([]byte(site.Secret), []byte(secret)) == 1 {
+			return siteKey, true
+		}
+	}
+	return "", false
+}
+
+// SiteKeys are the known sites, by site key.  In the environment they are given as a JSON object.
+type SiteKeys map[string]SiteKey
+
+// Decode implements envconfig.Decoder
+func (s *SiteKeys) Decode(value string) error {
+	return json.Unmarshal([]byte(value), s)
+}
+
+// Pools is an ordered list of pools.  In the environment it is given as a JSON array.
+type Pools []Pool
+
+// Decode implements envconfig.Decoder
+func (p *Pools) Decode(value string) error {
+	return json.Unmarshal([]byte(value), p)
+}
+
 // IsMissingConfig returns true if the the error has to do with missing required configs
 func IsMissingConfig(err error) bool {
 	return strings.Contains(err.Error(), "required key")
@@ -117,41 +251,295 @@ func validate(c *Config) error {
 		}
 	}
 
+	if err := setPools(c); err != nil {
+		return err
+	}
+
+	if err := setProfiles(c); err != nil {
+		return err
+	}
+	if err := setListeners(c); err != nil {
+		return err
+	}
+	if err := checkOrigins(c); err != nil {
+		return err
+	}
+	if err := checkSiteKeys(c); err != nil {
+		return err
+	}
+
+	if err := checkJobMode(c); err != nil {
+		return err
+	}
+	if err := checkDaemons(c); err != nil {
+		return err
+	}
+
+	return checkVardiff(c)
+}
+
+// checkOrigins makes sure wildcards are only used for whole subdomains
+func checkOrigins(c *Config) error {
+	for _, origin := range c.Origins {
+		host := origin
+		if parts := strings.SplitN(origin, "://", 2); len(parts) == 2 {
+			host = parts[1]
+		}
+		if host == "" || host != "*" && strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+			return fmt.Errorf("origin %q should be a host like example.com or *.example.com", origin)
+		}
+	}
+	return nil
+}
+
+// checkSiteKeys makes sure each secret belongs to one site
+func checkSiteKeys(c *Config) error {
+	secrets := make(map[string]bool)
+	for siteKey, site := range c.SiteKeys {
+		if siteKey == "" {
+			return errors.New("site keys can't be empty")
+		}
+		if site.Secret == "" {
+			continue
+		}
+		if secrets[site.Secret] {
+			return errors.New("each site key needs its own secret")
+		}
+		secrets[site.Secret] = true
+	}
 	return nil
 }
 
+// checkJobMode makes sure the job mode is known
+func checkJobMode(c *Config) error {
+	switch c.JobMode {
+	case JobModeNonce, JobModeNiceHash:
+		return nil
+	}
+	return fmt.Errorf("jobmode must be %v or %v", JobModeNonce, JobModeNiceHash)
+}
+
+// checkDaemons makes sure workers can find shares when solo mining.  Jobs from a daemon are at
+// the network difficulty, so workers need vardiff or a fixed difficulty to get easier ones.
+func checkDaemons(c *Config) error {
+	if c.Vardiff {
+		return nil
+	}
+	for i, l := range c.Listeners {
+		for _, p := range c.ProfilePools(l.Profile) {
+			if p.Daemon && l.Difficulty == 0 {
+				return fmt.Errorf("listeners[%v] needs a difficulty to solo mine on a daemon, or turn on vardiff", i)
+			}
+		}
+	}
+	return nil
+}
+
+// checkExtraNonce makes sure the extra nonce has a share field of its own, on a pool that takes it
+func checkExtraNonce(p Pool) error {
+	switch {
+	case p.ExtraNonce == "":
+		return nil
+	case p.Daemon:
+		return errors.New("extranonce is for pools, daemons get the extra nonce in the block")
+	}
+	for _, field := range []string{"id", "job_id", "nonce", "result"} {
+		if p.ExtraNonce == field {
+			return fmt.Errorf("extranonce can't be %q, shares already have that field", field)
+		}
+	}
+	return nil
+}
+
+// checkVardiff makes sure the vardiff limits make sense
+func checkVardiff(c *Config) error {
+	switch {
+	case c.MinDiff < 1:
+		return errors.New("mindiff must be at least 1")
+	case c.MaxDiff != 0 && c.MaxDiff < c.MinDiff:
+		return errors.New("maxdiff must be 0 or at least mindiff")
+	case c.ShareTime < 1:
+		return errors.New("sharetime must be at least 1")
+	}
+	return nil
+}
+
+// setPools makes sure there is at least one pool to connect to.
+// The single pool options are used if no pool list is present.
+func setPools(c *Config) error {
+	if len(c.Pools) == 0 {
+		switch {
+		case c.PoolAddr == "":
+			return errors.New("required key url missing value")
+		case c.PoolLogin == "":
+			return errors.New("required key login missing value")
+		case c.PoolPassword == "":
+			return errors.New("required key password missing value")
+		}
+		c.Pools = Pools{{URL: c.PoolAddr, Login: c.PoolLogin, Password: c.PoolPassword}}
+	}
+
+	for i, p := range c.Pools {
+		p = parsePoolURL(p)
+		c.Pools[i] = p
+		if p.URL == "" {
+			return fmt.Errorf("required key pools[%v].url missing value", i)
+		}
+		if p.Login == "" {
+			return fmt.Errorf("required key pools[%v].login missing value", i)
+		}
+		if err := checkExtraNonce(p); err != nil {
+			return fmt.Errorf("pools[%v]: %v", i, err)
+		}
+	}
+
+	return nil
+}
+
+// parsePoolURL strips the protocol from the pool address.  A stratum+ssl:// or stratum+tls:// address
+// turns on TLS for the pool.  A daemon:// or daemon+https:// address is a monerod node.
+func parsePoolURL(p Pool) Pool {
+	parts := strings.SplitN(p.URL, "://", 2)
+	if len(parts) != 2 {
+		return p
+	}
+	switch strings.ToLower(parts[0]) {
+	case "stratum+ssl", "stratum+tls", "ssl", "tls":
+		p.TLS = true
+	case "daemon":
+		p.Daemon = true
+	case "daemon+https":
+		p.Daemon, p.TLS = true, true
+	}
+	p.URL = parts[1]
+
+	return p
+}
+
 func configFromEnv() error {
 	cfg := Config{}
 	err := envconfig.Process("xmrwasp", &cfg)
 	if err != nil {
 		return err
 	}
+	err = setPools(&cfg)
+	if err != nil {
+		return err
+	}
+	err = setProfiles(&cfg)
+	if err != nil {
+		return err
+	}
+	err = setListeners(&cfg)
+	if err != nil {
+		return err
+	}
+	err = checkOrigins(&cfg)
+	if err != nil {
+		return err
+	}
+	err = checkSiteKeys(&cfg)
+	if err != nil {
+		return err
+	}
+	err = checkJobMode(&cfg)
+	if err != nil {
+		return err
+	}
+	err = checkDaemons(&cfg)
+	if err != nil {
+		return err
+	}
+	err = checkVardiff(&cfg)
+	if err != nil {
+		return err
+	}
 	instance = &cfg
 	return nil
 }
 
 func configFromFile(r io.Reader) error {
+	cfg, err := readFile(r)
+	if err != nil {
+		return err
+	}
+
+	instance = cfg
+	return nil
+}
+
+func readFile(r io.Reader) (*Config, error) {
 	data, err := ioutil.ReadAll(r)
 	if err != nil {
-		return errors.Wrap(err, "Failed to read config file.")
+		return nil, errors.Wrap(err, "Failed to read config file.")
 	}
 
 	cfg := Config{}
 	err = setDefaults(&cfg)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	err = json.Unmarshal(data, &cfg)
 	if err != nil {
-		return errors.Wrap(err, "Failed to parse JSON.")
+		return nil, errors.Wrap(err, "Failed to parse JSON.")
 	}
 	err = validate(&cfg)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	instance = &cfg
-	return nil
+	return &cfg, nil
+}
+
+// Reload reads the config file again.  The new config only replaces the old one if it is valid.
+// Both are returned, so that the caller can apply the changes.
+func Reload() (old, cfg *Config, err error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	old = Get()
+	if File == "" {
+		return nil, nil, errors.New("config was not read from a file, so it can't be reloaded")
+	}
+	f, err := os.Open(File)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Failed to open config file.")
+	}
+	defer f.Close()
+	cfg, err = readFile(f)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	instanceMu.Lock()
+	instance = cfg
+	instanceMu.Unlock()
+	return old, cfg, nil
+}
+
+// Changed lists the JSON names of the options that differ between the configs
+func Changed(old, cfg *Config) []string {
+	changed := make([]string, 0)
+	oldVal := reflect.ValueOf(old).Elem()
+	val := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < val.NumField(); i++ {
+		if !reflect.DeepEqual(oldVal.Field(i).Interface(), val.Field(i).Interface()) {
+			changed = append(changed, val.Type().Field(i).Tag.Get("json"))
+		}
+	}
+	return changed
+}
+
+// RestartRequired picks out the changed options that don't take effect until a restart
+func RestartRequired(changed []string) []string {
+	restart := make([]string, 0)
+	for _, key := range changed {
+		for _, restartKey := range restartKeys {
+			if key == restartKey {
+				restart = append(restart, key)
+			}
+		}
+	}
+	return restart
 }
 
 // Get returns the global configuration singleton.
@@ -175,5 +563,7 @@ func Get() *Config {
 	if err != nil {
 		log.Fatal("Unable to load config: ", err)
 	}
+	instanceMu.RLock()
+	defer instanceMu.RUnlock()
 	return instance
 }
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"io/ioutil"
+	"net"
 	"os"
 	"strings"
 	"sync"
@@ -32,6 +34,8 @@ func testGetConfigDefaults() (defaultStrings map[string]string, defaultInts map[
 		instance.WebsocketPort:   8080,
 		instance.StratumPort:     1111,
 		instance.ShareValidation: 2,
+		instance.MinDiff:         1000,
+		instance.ShareTime:       30,
 	}
 	defaultBools = map[bool]bool{
 		instance.DisableWebsocket: false,
@@ -160,7 +164,7 @@ func TestFileConfigAccuracyAgain(t *testing.T) {
         "login": "fakeLogin",
         "password": "fakePassword",
         "log": "proxy.log",
-        "valdateshares": 1
+        "validateshares": 1
         }`)
 	err := configFromFile(cfg)
 	if err != nil {
@@ -181,3 +185,386 @@ func TestFileConfigAccuracyAgain(t *testing.T) {
 	require.Equal(t, "proxy.log", instance.LogFile)
 	require.Equal(t, 1, instance.ShareValidation)
 }
+
+func TestSinglePoolIsListed(t *testing.T) {
+	defer reset()
+	testSetRequiredEnvConfigs()
+	err := configFromEnv()
+	if err != nil {
+		t.Error("Got unexpected config error: ", err)
+	}
+
+	require.Equal(t, Pools{{URL: "fakeurl", Login: "fakelogin", Password: "fakepassword"}}, instance.Pools)
+	require.Equal(t, 60, instance.FailbackInterval) // default
+}
+
+func TestEnvPools(t *testing.T) {
+	defer reset()
+	os.Setenv("XMRWASP_POOLS", `[{"url": "primary:3333", "login": "wallet", "password": "x"},
+		{"url": "fallback:443", "login": "wallet", "tls": true}]`)
+	os.Setenv("XMRWASP_FAILBACK", "30")
+	err := configFromEnv()
+	if err != nil {
+		t.Error("Got unexpected config error: ", err)
+	}
+
+	require.Len(t, instance.Pools, 2)
+	require.Equal(t, "primary:3333", instance.Pools[0].URL)
+	require.Equal(t, false, instance.Pools[0].TLS)
+	require.Equal(t, "fallback:443", instance.Pools[1].URL)
+	require.Equal(t, true, instance.Pools[1].TLS)
+	require.Equal(t, 30, instance.FailbackInterval)
+}
+
+func TestFilePools(t *testing.T) {
+	defer reset()
+	cfg := strings.NewReader(`{
+        "pools": [
+            {"url": "primary:3333", "login": "wallet", "password": "x"},
+            {"url": "fallback:3333", "login": "otherwallet", "password": "y"}
+        ]
+        }`)
+	err := configFromFile(cfg)
+	if err != nil {
+		t.Error("Got unexpected config error: ", err)
+	}
+
+	require.Len(t, instance.Pools, 2)
+	require.Equal(t, Pool{URL: "primary:3333", Login: "wallet", Password: "x"}, instance.Pools[0])
+	require.Equal(t, Pool{URL: "fallback:3333", Login: "otherwallet", Password: "y"}, instance.Pools[1])
+	require.Equal(t, "", instance.PoolAddr)
+}
+
+func TestFilePoolsRequiredConfigs(t *testing.T) {
+	defer reset()
+	cfg := strings.NewReader(`{"pools": [{"url": "primary:3333"}]}`)
+	err := configFromFile(cfg)
+	if err == nil || !IsMissingConfig(err) {
+		t.Error("Expected config error and got: ", err)
+	}
+}
+
+func TestPoolURLProtocol(t *testing.T) {
+	defer reset()
+	cfg := strings.NewReader(`{
+        "pools": [
+            {"url": "stratum+ssl://secure:443", "login": "wallet", "tls-fingerprint": "AB:CD"},
+            {"url": "stratum+tcp://plain:3333", "login": "wallet"},
+            {"url": "bare:3333", "login": "wallet", "tls": true}
+        ],
+        "poolca": "/etc/ssl/pool.pem"
+        }`)
+	err := configFromFile(cfg)
+	if err != nil {
+		t.Error("Got unexpected config error: ", err)
+	}
+
+	require.Equal(t, Pool{URL: "secure:443", Login: "wallet", TLS: true, TLSFingerprint: "AB:CD"}, instance.Pools[0])
+	require.Equal(t, Pool{URL: "plain:3333", Login: "wallet"}, instance.Pools[1])
+	require.Equal(t, Pool{URL: "bare:3333", Login: "wallet", TLS: true}, instance.Pools[2])
+	require.Equal(t, "/etc/ssl/pool.pem", instance.PoolCA)
+
+	// a protocol on its own is no address
+	for _, url := range []string{"stratum+ssl://", "daemon://"} {
+		cfg := strings.NewReader(`{"pools": [{"url": "` + url + `", "login": "wallet"}]}`)
+		err := configFromFile(cfg)
+		require.True(t, IsMissingConfig(err), url)
+	}
+}
+
+func TestVardiffLimits(t *testing.T) {
+	defer reset()
+	testSetRequiredEnvConfigs()
+	os.Setenv("XMRWASP_VARDIFF", "true")
+	os.Setenv("XMRWASP_MINDIFF", "5000")
+	os.Setenv("XMRWASP_MAXDIFF", "100000")
+	require.NoError(t, configFromEnv())
+	require.Equal(t, true, instance.Vardiff)
+	require.Equal(t, 5000, instance.MinDiff)
+	require.Equal(t, 100000, instance.MaxDiff)
+
+	os.Setenv("XMRWASP_MAXDIFF", "100")
+	require.Error(t, configFromEnv())
+
+	cfg := strings.NewReader(`{"url": "fakeURL", "login": "fakeLogin", "password": "x", "sharetime": -1}`)
+	require.Error(t, configFromFile(cfg))
+}
+
+func TestReload(t *testing.T) {
+	defer reset()
+	f, err := ioutil.TempFile("", "xmrwasp-config")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	File = f.Name()
+	defer func() { File = "" }()
+
+	write := func(data string) {
+		require.NoError(t, ioutil.WriteFile(f.Name(), []byte(data), 0600))
+	}
+	write(`{"url": "fakeURL", "login": "fakeLogin", "password": "x"}`)
+	require.Equal(t, 2, Get().DonateLevel)
+
+	write(`{"url": "fakeURL", "login": "fakeLogin", "password": "x", "donate": 5, "strport": 3333}`)
+	old, cfg, err := Reload()
+	require.NoError(t, err)
+	require.Equal(t, 2, old.DonateLevel)
+	require.Equal(t, 5, cfg.DonateLevel)
+	require.Equal(t, cfg, Get())
+	changed := Changed(old, cfg)
+	require.Equal(t, []string{"strport", "donate"}, changed)
+	require.Equal(t, []string{"strport"}, RestartRequired(changed))
+
+	// an invalid config leaves the old one in place
+	write(`{"url": "fakeURL", "login": "fakeLogin", "password": "x", "sharetime": -1}`)
+	_, _, err = Reload()
+	require.Error(t, err)
+	require.Equal(t, cfg, Get())
+
+	write(`{"url": `)
+	_, _, err = Reload()
+	require.Error(t, err)
+	require.Equal(t, 5, Get().DonateLevel)
+}
+
+func TestConcurrentReloads(t *testing.T) {
+	defer reset()
+	f, err := ioutil.TempFile("", "xmrwasp-config")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	File = f.Name()
+	defer func() { File = "" }()
+	data := []byte(`{"url": "fakeURL", "login": "fakeLogin", "password": "x"}`)
+	require.NoError(t, ioutil.WriteFile(f.Name(), data, 0600))
+	first := Get()
+
+	// each config is replaced exactly once, so the reloads form a single chain
+	const reloads = 50
+	replaced := make(chan [2]*Config, reloads)
+	wg := sync.WaitGroup{}
+	for i := 0; i < reloads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			old, cfg, err := Reload()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			replaced <- [2]*Config{old, cfg}
+		}()
+	}
+	wg.Wait()
+	close(replaced)
+
+	next := make(map[*Config]*Config)
+	for pair := range replaced {
+		_, seen := next[pair[0]]
+		require.False(t, seen, "two reloads reported replacing the same config")
+		next[pair[0]] = pair[1]
+	}
+	cfg := first
+	for i := 0; i < reloads; i++ {
+		require.Contains(t, next, cfg)
+		cfg = next[cfg]
+	}
+	require.Equal(t, cfg, Get())
+}
+
+func TestListenAddress(t *testing.T) {
+	tests := []struct {
+		bind, network, address string
+	}{
+		{"", "tcp", ":1111"},
+		{"10.8.0.1", "tcp", "10.8.0.1:1111"},
+		{"localhost", "tcp", "localhost:1111"},
+		{"::", "tcp6", "[::]:1111"},
+		{"[::1]", "tcp6", "[::1]:1111"},
+		{"unix:/run/xmrwasp.sock", "unix", "/run/xmrwasp.sock"},
+	}
+	for _, test := range tests {
+		network, address := ListenAddress(BindAddress(test.bind, 1111))
+		require.Equal(t, test.network, network, test.bind)
+		require.Equal(t, test.address, address, test.bind)
+	}
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xmrwasp")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	bind := "unix:" + dir + "/ws.sock"
+
+	l, err := Listen(bind)
+	require.NoError(t, err)
+	// a socket left behind by a crash doesn't stop the next run
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	l, err = Listen(bind)
+	require.NoError(t, err)
+	l.Close()
+}
+
+func TestBindValidation(t *testing.T) {
+	defer reset()
+	testSetRequiredEnvConfigs()
+	os.Setenv("XMRWASP_STRBIND", "::1")
+	os.Setenv("XMRWASP_WSBIND", "unix:/run/xmrwasp.sock")
+	require.NoError(t, configFromEnv())
+	require.Equal(t, "::1", instance.StratumBind)
+
+	os.Setenv("XMRWASP_STRBIND", "0.0.0.0:3333")
+	require.Error(t, configFromEnv())
+
+	cfg := strings.NewReader(`{"url": "fakeURL", "login": "fakeLogin", "password": "x", "wsbind": "unix:"}`)
+	require.Error(t, configFromFile(cfg))
+}
+
+func TestDefaultListeners(t *testing.T) {
+	defer reset()
+	testSetRequiredEnvConfigs()
+	os.Setenv("XMRWASP_NOTCP", "false")
+	os.Setenv("XMRWASP_STRTLS", "true")
+	os.Setenv("XMRWASP_STRBIND", "::1")
+	os.Setenv("XMRWASP_WSBIND", "unix:/run/xmrwasp.sock")
+	require.NoError(t, configFromEnv())
+	require.Equal(t, Listeners{
+		{Transport: "ws", Address: "unix:/run/xmrwasp.sock"},
+		{Transport: "tcp", Address: "[::1]:1111"},
+		{Transport: "tls", Address: ":1112"},
+	}, instance.Listeners)
+}
+
+func TestListeners(t *testing.T) {
+	defer reset()
+	cfg := strings.NewReader(`{
+        "url": "fakeURL", "login": "fakeLogin", "password": "x",
+        "profiles": {"browsers": [{"url": "stratum+ssl://other:443", "login": "other wallet"}]},
+        "listeners": [
+            {"transport": "tls", "address": "10.8.0.1:3333", "difficulty": 500000},
+            {"transport": "ws", "address": "unix:/run/xmrwasp.sock", "pool": "browsers", "donate": 5}
+        ]
+        }`)
+	require.NoError(t, configFromFile(cfg))
+	require.Len(t, instance.Listeners, 2)
+	require.Equal(t, 500000, instance.Listeners[0].Difficulty)
+	require.Equal(t, 5, *instance.Listeners[1].Donate)
+	require.Equal(t, instance.Pools, instance.ProfilePools(instance.Listeners[0].Profile))
+	require.Equal(t, Pools{{URL: "other:443", Login: "other wallet", TLS: true}},
+		instance.ProfilePools(instance.Listeners[1].Profile))
+
+	bad := []string{
+		`[{"transport": "udp", "address": ":3333"}]`,
+		`[{"transport": "tcp", "address": "3333"}]`,
+		`[{"transport": "tcp", "address": ":3333", "pool": "missing"}]`,
+		`[{"transport": "tcp", "address": ":3333", "difficulty": -1}]`,
+		`[{"transport": "tcp", "address": ":3333", "donate": 101}]`,
+	}
+	for _, listeners := range bad {
+		cfg := strings.NewReader(`{"url": "fakeURL", "login": "fakeLogin", "password": "x", "listeners": ` + listeners + `}`)
+		require.Error(t, configFromFile(cfg), listeners)
+	}
+
+	cfg = strings.NewReader(`{"url": "fakeURL", "login": "fakeLogin", "password": "x",
+        "profiles": {"browsers": [{"url": "stratum+ssl://", "login": "other wallet"}]}}`)
+	require.True(t, IsMissingConfig(configFromFile(cfg)))
+}
+
+func TestOrigins(t *testing.T) {
+	defer reset()
+	testSetRequiredEnvConfigs()
+	os.Setenv("XMRWASP_ORIGINS", "example.com,*.example.org")
+	require.NoError(t, configFromEnv())
+	require.Equal(t, []string{"example.com", "*.example.org"}, instance.Origins)
+
+	for _, origins := range []string{"www.*.example.com", "*example.com", "https://"} {
+		os.Setenv("XMRWASP_ORIGINS", origins)
+		require.Error(t, configFromEnv(), origins)
+	}
+}
+
+func TestSiteKeys(t *testing.T) {
+	defer reset()
+	testSetRequiredEnvConfigs()
+	os.Setenv("XMRWASP_SITEKEYS", `{"partner": {"login": "partner wallet"}, "ours": {}}`)
+	require.NoError(t, configFromEnv())
+	require.Equal(t, SiteKeys{"partner": {Login: "partner wallet"}, "ours": {}}, instance.SiteKeys)
+
+	os.Setenv("XMRWASP_SITEKEYS", `{"": {}}`)
+	require.Error(t, configFromEnv())
+}
+
+func TestJobMode(t *testing.T) {
+	defer reset()
+	testSetRequiredEnvConfigs()
+	require.NoError(t, configFromEnv())
+	require.Equal(t, JobModeNonce, instance.JobMode)
+
+	os.Setenv("XMRWASP_JOBMODE", "nicehash")
+	require.NoError(t, configFromEnv())
+	require.Equal(t, JobModeNiceHash, instance.JobMode)
+
+	os.Setenv("XMRWASP_JOBMODE", "extranonce")
+	require.Error(t, configFromEnv())
+}
+
+func TestDaemonPools(t *testing.T) {
+	defer reset()
+	testSetRequiredEnvConfigs()
+	os.Setenv("XMRWASP_URL", "daemon://127.0.0.1:18081")
+	os.Setenv("XMRWASP_LISTENERS", `[{"transport": "tcp", "address": ":3333", "difficulty": 5000}]`)
+	require.NoError(t, configFromEnv())
+	require.Equal(t, Pool{URL: "127.0.0.1:18081", Login: "fakelogin", Password: "fakepassword", Daemon: true}, instance.Pools[0])
+
+	// network difficulty is too much for any worker
+	os.Setenv("XMRWASP_LISTENERS", `[{"transport": "tcp", "address": ":3333"}]`)
+	require.Error(t, configFromEnv())
+	os.Setenv("XMRWASP_VARDIFF", "true")
+	require.NoError(t, configFromEnv())
+
+	os.Setenv("XMRWASP_URL", "daemon+https://node.example.com:18089")
+	require.NoError(t, configFromEnv())
+	require.True(t, instance.Pools[0].Daemon)
+	require.True(t, instance.Pools[0].TLS)
+}
+
+func TestPoolExtraNonce(t *testing.T) {
+	defer reset()
+	testSetRequiredEnvConfigs()
+	os.Setenv("XMRWASP_POOLS", `[{"url": "pool.example.com:3333", "login": "x", "extranonce": "workerNonce"}]`)
+	require.NoError(t, configFromEnv())
+	require.Equal(t, "workerNonce", instance.Pools[0].ExtraNonce)
+
+	// a daemon gets the extra nonce in the block, and shares already have a nonce
+	os.Setenv("XMRWASP_POOLS", `[{"url": "daemon://127.0.0.1:18081", "login": "x", "extranonce": "workerNonce"}]`)
+	os.Setenv("XMRWASP_VARDIFF", "true")
+	require.Error(t, configFromEnv())
+	os.Setenv("XMRWASP_POOLS", `[{"url": "pool.example.com:3333", "login": "x", "extranonce": "nonce"}]`)
+	require.Error(t, configFromEnv())
+	os.Setenv("XMRWASP_POOLS", `[{"url": "pool.example.com:3333", "login": "x"}]`)
+	os.Setenv("XMRWASP_PROFILES", `{"other": [{"url": "pool.example.com:3333", "login": "x", "extranonce": "job_id"}]}`)
+	require.Error(t, configFromEnv())
+}
+
+func TestAlgoProfile(t *testing.T) {
+	c := &Config{
+		Pools: Pools{{URL: "monero:3333", Algo: "rx/0"}},
+		Profiles: Profiles{
+			"wownero": {{URL: "wownero:3333"}, {URL: "backup:3333", Algo: "rx/wow"}},
+			"other":   {{URL: "other:3333", Algo: "rx/wow"}},
+			"unknown": {{URL: "unknown:3333"}},
+		},
+	}
+	require.Equal(t, "rx/wow", c.ProfileAlgo("wownero"))
+	require.Equal(t, "", c.ProfileAlgo("unknown"))
+
+	profile, ok := c.AlgoProfile([]string{"cn/r", "RX/WOW", "rx/0"})
+	require.True(t, ok)
+	require.Equal(t, "other", profile)
+	profile, ok = c.AlgoProfile([]string{"rx/0", "rx/wow"})
+	require.True(t, ok)
+	require.Equal(t, "", profile)
+	_, ok = c.AlgoProfile([]string{"cn/r"})
+	require.False(t, ok)
+	_, ok = c.AlgoProfile(nil)
+	require.False(t, ok)
+}
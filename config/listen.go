@@ -0,0 +1,228 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// unixPrefix marks an address as the path of a Unix domain socket
+const unixPrefix = "unix:"
+
+// Listener accepts workers on one address.  Its workers mine on the pools of its profile, or
+// the top level pools if the profile is empty.
+type Listener struct {
+	// Transport is one of tcp, tls, ws or wss
+	Transport string `json:"transport"`
+	// Address is "host:port", or "unix:/path" for a Unix socket
+	Address string `json:"address"`
+	Profile string `json:"pool"`
+
+	// Difficulty fixes the difficulty of the listener's workers.  0 uses vardiff or the pool difficulty.
+	Difficulty int `json:"difficulty"`
+	// Donate overrides the donation level for the listener's workers, if set
+	Donate *int `json:"donate"`
+}
+
+// Listeners is the list of addresses to accept workers on.  In the environment it is given as a JSON array.
+type Listeners []Listener
+
+// Decode implements envconfig.Decoder
+func (l *Listeners) Decode(value string) error {
+	return json.Unmarshal([]byte(value), l)
+}
+
+// Profiles are named pool lists that listeners can send their workers to.  In the environment
+// they are given as a JSON object.
+type Profiles map[string]Pools
+
+// Decode implements envconfig.Decoder
+func (p *Profiles) Decode(value string) error {
+	return json.Unmarshal([]byte(value), p)
+}
+
+// ProfilePools is the pool list for a profile.  The empty profile is the top level pool list.
+func (c *Config) ProfilePools(profile string) Pools {
+	if profile == "" {
+		return c.Pools
+	}
+	return c.Profiles[profile]
+}
+
+// ProfileAlgo is the algorithm that a profile's pools mine, if any of them says
+func (c *Config) ProfileAlgo(profile string) string {
+	for _, p := range c.ProfilePools(profile) {
+		if p.Algo != "" {
+			return p.Algo
+		}
+	}
+	return ""
+}
+
+// AlgoProfile finds a profile for a miner that can mine algos, which are in the miner's order
+// of preference.  The top level pools are preferred over profiles for the same algorithm, and
+// profiles are tried in order of name.
+func (c *Config) AlgoProfile(algos []string) (string, bool) {
+	profiles := []string{""}
+	for name := range c.Profiles {
+		profiles = append(profiles, name)
+	}
+	sort.Strings(profiles)
+	for _, algo := range algos {
+		for _, profile := range profiles {
+			if strings.EqualFold(c.ProfileAlgo(profile), algo) {
+				return profile, true
+			}
+		}
+	}
+	return "", false
+}
+
+// BindAddress joins a bind address and port into a listener address.  An empty bind address
+// listens on all interfaces.  IPv6 addresses are given with or without brackets, and a bind
+// address like "unix:/run/xmrwasp.sock" is a Unix socket, so the port is ignored.
+func BindAddress(bind string, port int) string {
+	if strings.HasPrefix(bind, unixPrefix) {
+		return bind
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(bind, "["), "]")
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// ListenAddress turns a listener address into arguments for net.Listen.  An IPv6 address
+// listens on IPv6 only.
+func ListenAddress(address string) (network, addr string) {
+	if strings.HasPrefix(address, unixPrefix) {
+		return "unix", strings.TrimPrefix(address, unixPrefix)
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err == nil {
+		if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			return "tcp6", address
+		}
+	}
+	return "tcp", address
+}
+
+// Listen listens on a listener address.  A Unix socket left behind by a previous run is removed first.
+func Listen(address string) (net.Listener, error) {
+	network, addr := ListenAddress(address)
+	if network == "unix" {
+		if fi, err := os.Stat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr)
+		}
+	}
+	return net.Listen(network, addr)
+}
+
+// checkBinds makes sure the bind addresses can be listened on
+func checkBinds(c *Config) error {
+	binds := []struct{ name, bind string }{
+		{"wsbind", c.WebsocketBind},
+		{"strbind", c.StratumBind},
+		{"strtlsbind", c.StratumTLSBind},
+	}
+	for _, b := range binds {
+		if b.bind == unixPrefix {
+			return errors.New(b.name + " needs a path after unix:")
+		}
+		if strings.HasPrefix(b.bind, unixPrefix) {
+			continue
+		}
+		host := strings.TrimSuffix(strings.TrimPrefix(b.bind, "["), "]")
+		if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+			return errors.New(b.name + " should be an address without a port, which is set separately")
+		}
+	}
+	return nil
+}
+
+// setProfiles checks the pools in each profile, the same way as the top level pools
+func setProfiles(c *Config) error {
+	for name, pools := range c.Profiles {
+		if name == "" {
+			return errors.New("pool profiles need a name")
+		}
+		if len(pools) == 0 {
+			return fmt.Errorf("pool profile %v has no pools", name)
+		}
+		for i, p := range pools {
+			p = parsePoolURL(p)
+			pools[i] = p
+			if p.URL == "" {
+				return fmt.Errorf("required key profiles.%v[%v].url missing value", name, i)
+			}
+			if p.Login == "" {
+				return fmt.Errorf("required key profiles.%v[%v].login missing value", name, i)
+			}
+			if err := checkExtraNonce(p); err != nil {
+				return fmt.Errorf("profiles.%v[%v]: %v", name, i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// setListeners makes sure there is somewhere to accept workers.  Without a listener list, the
+// listeners are made from the single listener options.
+func setListeners(c *Config) error {
+	if err := checkBinds(c); err != nil {
+		return err
+	}
+	if len(c.Listeners) == 0 {
+		if !c.DisableWebsocket {
+			transport := "ws"
+			if c.SecureWebsocket {
+				transport = "wss"
+			}
+			c.Listeners = append(c.Listeners, Listener{
+				Transport: transport,
+				Address:   BindAddress(c.WebsocketBind, c.WebsocketPort),
+			})
+		}
+		if !c.DisableTCP {
+			c.Listeners = append(c.Listeners, Listener{
+				Transport: "tcp",
+				Address:   BindAddress(c.StratumBind, c.StratumPort),
+			})
+		}
+		if c.StratumTLS {
+			c.Listeners = append(c.Listeners, Listener{
+				Transport: "tls",
+				Address:   BindAddress(c.StratumTLSBind, c.StratumTLSPort),
+			})
+		}
+	}
+
+	for i, l := range c.Listeners {
+		switch l.Transport {
+		case "tcp", "tls", "ws", "wss":
+		default:
+			return fmt.Errorf("listeners[%v].transport must be tcp, tls, ws or wss", i)
+		}
+		if strings.HasPrefix(l.Address, unixPrefix) {
+			if l.Address == unixPrefix {
+				return fmt.Errorf("listeners[%v].address needs a path after unix:", i)
+			}
+		} else if _, _, err := net.SplitHostPort(l.Address); err != nil {
+			return fmt.Errorf("listeners[%v].address must be host:port or unix:/path", i)
+		}
+		if _, ok := c.Profiles[l.Profile]; l.Profile != "" && !ok {
+			return fmt.Errorf("listeners[%v].pool is not one of the pool profiles: %v", i, l.Profile)
+		}
+		if l.Difficulty < 0 {
+			return fmt.Errorf("listeners[%v].difficulty can't be negative", i)
+		}
+		if l.Donate != nil && (*l.Donate < 0 || *l.Donate > 100) {
+			return fmt.Errorf("listeners[%v].donate must be a percentage", i)
+		}
+	}
+
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -39,7 +40,7 @@ type Config struct {
 // Logger wraps the standard logger and adds a debug level
 type Logger struct {
 	*log.Logger
-	Level int
+	level int32 // can be changed while logging, see SetLevel
 }
 
 type discardWriter struct{}
@@ -70,10 +71,20 @@ func Configure(c *Config) {
 func New(c *Config) *Logger {
 	return &Logger{
 		log.New(c.W, "[XMRWASP] ", c.Flag),
-		c.Level,
+		int32(c.Level),
 	}
 }
 
+// SetLevel changes the level of a logger that is already in use
+func (l *Logger) SetLevel(level int) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+// Level is the current logging level
+func (l *Logger) Level() int {
+	return int(atomic.LoadInt32(&l.level))
+}
+
 // Get returns the global singleton logger
 func Get() *Logger {
 	instantiation.Do(func() {
@@ -84,21 +95,21 @@ func Get() *Logger {
 }
 
 func (l *Logger) Debug(v ...interface{}) {
-	if l.Level < Debug {
+	if l.Level() < Debug {
 		return
 	}
 	l.Logger.Print(v...)
 }
 
 func (l *Logger) Debugf(format string, v ...interface{}) {
-	if l.Level < Debug {
+	if l.Level() < Debug {
 		return
 	}
 	l.Logger.Printf(format, v...)
 }
 
 func (l *Logger) Debugln(v ...interface{}) {
-	if l.Level < Debug {
+	if l.Level() < Debug {
 		return
 	}
 
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	ews "github.com/eyesore/ws"
+	"github.com/trey-jones/xmrwasp/api"
 	"github.com/trey-jones/xmrwasp/config"
 	"github.com/trey-jones/xmrwasp/logger"
+	"github.com/trey-jones/xmrwasp/proxy"
 	"github.com/trey-jones/xmrwasp/tcp"
 	"github.com/trey-jones/xmrwasp/ws"
 )
@@ -23,19 +29,32 @@ var (
 func printWelcomeMessage() {
 	logger.Get().Println("************************************************************************")
 	logger.Get().Printf("*    XMR Web and Stratum Proxy \t\t\t\t v%s \n", version)
-	if !config.Get().DisableWebsocket {
-		port := config.Get().WebsocketPort
-		logger.Get().Printf("*    Accepting Websocket Connections on port: \t\t %v\n", port)
+	for _, l := range config.Get().Listeners {
+		logger.Get().Printf("*    Accepting %v Connections on: \t\t\t %v%v\n", l.Transport, l.Address, listenerNotes(l))
 	}
-	if !config.Get().DisableTCP {
-		port := config.Get().StratumPort
-		logger.Get().Printf("*    Accepting TCP Connections on port: \t\t\t\t %v\n", port)
+	if config.Get().APIBind != "" {
+		logger.Get().Printf("*    Serving status API on: \t\t\t\t %v\n", config.Get().APIBind)
 	}
 	statInterval := config.Get().StatInterval
 	logger.Get().Printf("*    Printing stats every: \t\t\t\t %v seconds\n", statInterval)
 	logger.Get().Println("************************************************************************")
 }
 
+// listenerNotes describes the settings that make a listener different from the others
+func listenerNotes(l config.Listener) string {
+	notes := ""
+	if l.Profile != "" {
+		notes += " pool:" + l.Profile
+	}
+	if l.Difficulty > 0 {
+		notes += fmt.Sprintf(" difficulty:%v", l.Difficulty)
+	}
+	if l.Donate != nil {
+		notes += fmt.Sprintf(" donate:%v", *l.Donate)
+	}
+	return notes
+}
+
 func usage() {
 	fmt.Printf("Usage: %s [-c CONFIG_PATH] \n", os.Args[0])
 	flag.PrintDefaults()
@@ -82,19 +101,50 @@ func main() {
 	config.File = *configFile
 
 	ews.SetDebug(false)
-	holdOpen := make(chan bool, 1)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
-	if config.Get().DisableWebsocket && config.Get().DisableTCP {
+	if len(config.Get().Listeners) == 0 {
 		logger.Get().Fatal("No servers configured for listening.  Bye!")
 	}
-	if !config.Get().DisableWebsocket {
-		go ws.StartServer()
+	for _, l := range config.Get().Listeners {
+		switch l.Transport {
+		case "ws", "wss":
+			go ws.StartServer(l)
+		case "tcp", "tls":
+			go tcp.StartServer(l)
+		}
 	}
-	if !config.Get().DisableTCP {
-		go tcp.StartServer()
+	if config.Get().APIBind != "" {
+		api.Version = version
+		go api.StartServer()
 	}
 
 	printWelcomeMessage()
 
-	<-holdOpen
+	sig := <-signals
+	for sig == syscall.SIGHUP {
+		// errors are logged, and the old config stays in place
+		proxy.GetDirector().Reload()
+		sig = <-signals
+	}
+	// a second signal kills the process without waiting
+	signal.Stop(signals)
+	logger.Get().Printf("Received %v, shutting down\n", sig)
+	shutdown()
+}
+
+// shutdown stops taking new workers, then lets shares in flight finish before closing the
+// pool connections, all within the configured timeout.
+func shutdown() {
+	timeout := time.Duration(config.Get().ShutdownTimeout) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	tcp.Shutdown()
+	if err := ws.Shutdown(ctx); err != nil {
+		logger.Get().Println("Error stopping websocket server: ", err)
+	}
+	proxy.GetDirector().Shutdown(ctx)
+	logger.Get().Println("Shutdown complete")
 }
@@ -0,0 +1,284 @@
+// Package metrics is a small, dependency free implementation of Prometheus counters, gauges, and
+// histograms, along with a handler that serves them in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var defaultRegistry = &Registry{}
+
+// Registry holds metrics in the order they were registered.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+type collector interface {
+	write(w io.Writer)
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	r.collectors = append(r.collectors, c)
+	r.mu.Unlock()
+}
+
+// Write writes all registered metrics in the Prometheus text exposition format.
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	collectors := make([]collector, len(r.collectors))
+	copy(collectors, r.collectors)
+	r.mu.Unlock()
+
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+// Handler serves the metrics in the default registry.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		defaultRegistry.Write(w)
+	})
+}
+
+type desc struct {
+	name, help, kind string
+}
+
+// helpEscaper escapes HELP text, which unlike label values can hold a double quote as it is
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func (d *desc) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, helpEscaper.Replace(d.help), d.name, d.kind)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// labelEscaper escapes label values the way the text format does: only backslash, double quote
+// and newline.  Everything else, including non-ASCII, is written as it is.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabel(name, value string) string {
+	return fmt.Sprintf(`{%s="%s"}`, name, labelEscaper.Replace(value))
+}
+
+// Counter only goes up.  Safe for concurrent use.
+type Counter struct {
+	desc
+	v uint64
+}
+
+// NewCounter creates and registers a counter.
+func NewCounter(name, help string) *Counter {
+	c := &Counter{desc: desc{name, help, "counter"}}
+	defaultRegistry.register(c)
+	return c
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.writeHeader(w)
+	fmt.Fprintf(w, "%s %d\n", c.name, c.Value())
+}
+
+// Gauge goes up and down.  Safe for concurrent use.
+type Gauge struct {
+	desc
+	v int64
+}
+
+// NewGauge creates and registers a gauge.
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{desc: desc{name, help, "gauge"}}
+	defaultRegistry.register(g)
+	return g
+}
+
+func (g *Gauge) Inc() {
+	atomic.AddInt64(&g.v, 1)
+}
+
+func (g *Gauge) Dec() {
+	atomic.AddInt64(&g.v, -1)
+}
+
+func (g *Gauge) Set(v int64) {
+	atomic.StoreInt64(&g.v, v)
+}
+
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.v)
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.writeHeader(w)
+	fmt.Fprintf(w, "%s %d\n", g.name, g.Value())
+}
+
+// CounterVec is a set of counters partitioned by the value of a single label.
+type CounterVec struct {
+	desc
+	label    string
+	mu       sync.Mutex
+	counters map[string]*Counter
+}
+
+// NewCounterVec creates and registers a counter with one label.
+func NewCounterVec(name, help, label string) *CounterVec {
+	c := &CounterVec{
+		desc:     desc{name, help, "counter"},
+		label:    label,
+		counters: make(map[string]*Counter),
+	}
+	defaultRegistry.register(c)
+	return c
+}
+
+// With returns the counter for the label value, creating it if necessary.
+func (c *CounterVec) With(value string) *Counter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counter, ok := c.counters[value]
+	if !ok {
+		counter = &Counter{desc: c.desc}
+		c.counters[value] = counter
+	}
+	return counter
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.writeHeader(w)
+	c.mu.Lock()
+	values := make([]string, 0, len(c.counters))
+	for value := range c.counters {
+		values = append(values, value)
+	}
+	c.mu.Unlock()
+	sort.Strings(values)
+	for _, value := range values {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, formatLabel(c.label, value), c.With(value).Value())
+	}
+}
+
+// GaugeVec is a set of gauges partitioned by the value of a single label.
+type GaugeVec struct {
+	desc
+	label  string
+	mu     sync.Mutex
+	gauges map[string]*Gauge
+}
+
+// NewGaugeVec creates and registers a gauge with one label.
+func NewGaugeVec(name, help, label string) *GaugeVec {
+	g := &GaugeVec{
+		desc:   desc{name, help, "gauge"},
+		label:  label,
+		gauges: make(map[string]*Gauge),
+	}
+	defaultRegistry.register(g)
+	return g
+}
+
+// With returns the gauge for the label value, creating it if necessary.
+func (g *GaugeVec) With(value string) *Gauge {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	gauge, ok := g.gauges[value]
+	if !ok {
+		gauge = &Gauge{desc: g.desc}
+		g.gauges[value] = gauge
+	}
+	return gauge
+}
+
+func (g *GaugeVec) write(w io.Writer) {
+	g.writeHeader(w)
+	g.mu.Lock()
+	values := make([]string, 0, len(g.gauges))
+	for value := range g.gauges {
+		values = append(values, value)
+	}
+	g.mu.Unlock()
+	sort.Strings(values)
+	for _, value := range values {
+		fmt.Fprintf(w, "%s%s %d\n", g.name, formatLabel(g.label, value), g.With(value).Value())
+	}
+}
+
+// Histogram counts observations into cumulative buckets.  Safe for concurrent use.
+type Histogram struct {
+	desc
+	mu      sync.Mutex
+	buckets []float64 // upper bounds, ascending
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// NewHistogram creates and registers a histogram with the given bucket upper bounds.
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	sorted := make([]float64, len(buckets))
+	copy(sorted, buckets)
+	sort.Float64s(sorted)
+	h := &Histogram{
+		desc:    desc{name, help, "histogram"},
+		buckets: sorted,
+		counts:  make([]uint64, len(sorted)),
+	}
+	defaultRegistry.register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.writeHeader(w)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabel("le", formatFloat(bound)), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabel("le", "+Inf"), h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
@@ -0,0 +1,183 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"math"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExposition(t *testing.T) {
+	r := &Registry{}
+	c := &Counter{desc: desc{"test_counter", "A counter.", "counter"}}
+	r.register(c)
+	c.Add(3)
+	c.Inc()
+
+	g := &GaugeVec{desc: desc{"test_gauge", "A gauge.", "gauge"}, label: "kind", gauges: make(map[string]*Gauge)}
+	r.register(g)
+	g.With("b").Inc()
+	g.With("a").Set(5)
+	g.With("a").Dec()
+
+	h := &Histogram{desc: desc{"test_seconds", "A histogram.", "histogram"},
+		buckets: []float64{0.5, 1}, counts: make([]uint64, 2)}
+	r.register(h)
+	h.Observe(0.25)
+	h.Observe(0.75)
+	h.Observe(3)
+
+	buf := &bytes.Buffer{}
+	r.Write(buf)
+	expected := `# HELP test_counter A counter.
+# TYPE test_counter counter
+test_counter 4
+# HELP test_gauge A gauge.
+# TYPE test_gauge gauge
+test_gauge{kind="a"} 4
+test_gauge{kind="b"} 1
+# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.5"} 1
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 4
+test_seconds_count 3
+`
+	require.Equal(t, expected, buf.String())
+}
+
+func TestLabelEscaping(t *testing.T) {
+	require.Equal(t, `{worker="a\\b \"c\"\nd"}`, formatLabel("worker", "a\\b \"c\"\nd"))
+	require.Equal(t, "{worker=\"wörker\t☃\"}", formatLabel("worker", "wörker\t☃"))
+}
+
+func TestHelpEscaping(t *testing.T) {
+	buf := &bytes.Buffer{}
+	d := desc{"test_help", "A \\ in \"quotes\"\nover two lines.", "gauge"}
+	d.writeHeader(buf)
+	require.Equal(t, "# HELP test_help A \\\\ in \"quotes\"\\nover two lines.\n# TYPE test_help gauge\n", buf.String())
+}
+
+func TestFormatFloat(t *testing.T) {
+	require.Equal(t, "+Inf", formatFloat(math.Inf(1)))
+	require.Equal(t, "-Inf", formatFloat(math.Inf(-1)))
+	require.Equal(t, "NaN", formatFloat(math.NaN()))
+	require.Equal(t, "0.025", formatFloat(0.025))
+	require.Equal(t, "1e+06", formatFloat(1000000))
+}
+
+var (
+	metricName = `[a-zA-Z_:][a-zA-Z0-9_:]*`
+	labelPair  = `[a-zA-Z_][a-zA-Z0-9_]*="(?:\\.|[^"\\])*"`
+	// a sample line of the text format, without the optional timestamp, which we never write
+	sampleLine = regexp.MustCompile(`^(` + metricName + `)(?:\{(` + labelPair + `(?:,` + labelPair + `)*)\})? (\S+)$`)
+	typeLine   = regexp.MustCompile(`^# TYPE (` + metricName + `) (counter|gauge|histogram|summary|untyped)$`)
+	helpLine   = regexp.MustCompile(`^# HELP (` + metricName + `) (?:[^\\]|\\[\\n])*$`)
+)
+
+// checkExposition checks text against the rules of the Prometheus text format, version 0.0.4.
+// Each family has one HELP and one TYPE line before its samples, sample names match the family's
+// type, and histogram buckets are cumulative, ascending and end with le="+Inf" equal to _count.
+func checkExposition(t *testing.T, text string) {
+	require.True(t, strings.HasSuffix(text, "\n"), "the last line must end with a newline")
+	seen := make(map[string]bool)
+	var family, kind string
+	var lastLe float64
+	var lastBucket, infBucket uint64
+	sawInf := false
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := helpLine.FindStringSubmatch(line); m != nil {
+			require.False(t, seen[m[1]], "%s is described twice", m[1])
+			seen[m[1]] = true
+			family, kind = m[1], ""
+			lastLe, lastBucket, sawInf = math.Inf(-1), 0, false
+			continue
+		}
+		if m := typeLine.FindStringSubmatch(line); m != nil {
+			require.Equal(t, family, m[1], "TYPE must follow the HELP of its own family")
+			require.Empty(t, kind, "%s has two TYPE lines", family)
+			kind = m[2]
+			continue
+		}
+		m := sampleLine.FindStringSubmatch(line)
+		require.NotNil(t, m, "not a valid sample line: %q", line)
+		require.NotEmpty(t, kind, "sample before TYPE: %q", line)
+		name, labels, value := m[1], m[2], m[3]
+		_, err := strconv.ParseFloat(value, 64)
+		require.NoError(t, err, "bad value in %q", line)
+
+		if kind != "histogram" {
+			require.Equal(t, family, name)
+			continue
+		}
+		switch name {
+		case family + "_bucket":
+			require.False(t, sawInf, "bucket after +Inf: %q", line)
+			require.True(t, strings.HasPrefix(labels, `le="`), "bucket without le: %q", line)
+			le, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimPrefix(labels, `le="`), `"`), 64)
+			require.NoError(t, err)
+			require.True(t, le > lastLe, "buckets must ascend: %q", line)
+			count, err := strconv.ParseUint(value, 10, 64)
+			require.NoError(t, err)
+			require.True(t, count >= lastBucket, "buckets must be cumulative: %q", line)
+			lastLe, lastBucket = le, count
+			if math.IsInf(le, 1) {
+				sawInf, infBucket = true, count
+			}
+		case family + "_sum":
+			require.True(t, sawInf, "%s has no +Inf bucket", family)
+		case family + "_count":
+			require.True(t, sawInf, "%s has no +Inf bucket", family)
+			require.Equal(t, strconv.FormatUint(infBucket, 10), value, "+Inf bucket must equal _count")
+		default:
+			t.Errorf("%s is not a sample of histogram %s", name, family)
+		}
+	}
+	require.NoError(t, scanner.Err())
+}
+
+func TestExpositionFormat(t *testing.T) {
+	r := &Registry{}
+	h := &Histogram{desc: desc{"test_seconds", "With a \\ and a\nnewline.", "histogram"},
+		buckets: []float64{.01, .5, 1000000}, counts: make([]uint64, 3)}
+	r.register(h)
+	for _, v := range []float64{.001, .2, .2, 7, 2000000} {
+		h.Observe(v)
+	}
+	c := &CounterVec{desc: desc{"test_total", "A counter.", "counter"}, label: "reason",
+		counters: make(map[string]*Counter)}
+	r.register(c)
+	c.With(`"quoted" \ and` + "\n").Inc()
+	c.With("").Inc()
+	r.register(&GaugeVec{desc: desc{"test_empty", "No samples yet.", "gauge"}, label: "kind",
+		gauges: make(map[string]*Gauge)})
+	buf := &bytes.Buffer{}
+	r.Write(buf)
+	checkExposition(t, buf.String())
+
+	// and everything xmrwasp reports
+	SubmitLatency.Observe(.3)
+	buf.Reset()
+	defaultRegistry.Write(buf)
+	checkExposition(t, buf.String())
+}
+
+func TestHandler(t *testing.T) {
+	SharesRejected.With("duplicate").Inc()
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	require.True(t, strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain"))
+	require.Contains(t, w.Body.String(), "# TYPE xmrwasp_workers gauge")
+	require.Contains(t, w.Body.String(), `xmrwasp_shares_rejected_total{reason="duplicate"} 1`)
+}
@@ -0,0 +1,30 @@
+package metrics
+
+// Everything that xmrwasp reports to Prometheus.
+var (
+	Workers = NewGaugeVec("xmrwasp_workers",
+		"Connected workers by transport.", "transport")
+	WorkerConnections = NewCounterVec("xmrwasp_worker_connections_total",
+		"Worker connections accepted by transport.", "transport")
+	OriginsRejected = NewCounter("xmrwasp_ws_origins_rejected_total",
+		"Websocket handshakes rejected because the origin is not allowed.")
+	Proxies = NewGauge("xmrwasp_proxies",
+		"Upstream proxies, each with its own pool connection.")
+	Donating = NewGauge("xmrwasp_donating_proxies",
+		"Proxies currently working for the donation server.")
+
+	SharesAccepted = NewCounter("xmrwasp_shares_accepted_total",
+		"Shares accepted by the pool.")
+	SharesRejected = NewCounterVec("xmrwasp_shares_rejected_total",
+		"Shares rejected by the proxy or the pool, by reason.", "reason")
+	JobsReceived = NewCounterVec("xmrwasp_jobs_received_total",
+		"Jobs received from upstream, by source.", "source")
+	PoolReconnects = NewCounter("xmrwasp_pool_reconnects_total",
+		"Times a proxy lost its pool connection and had to reconnect.")
+	BlocksFound = NewCounter("xmrwasp_blocks_found_total",
+		"Blocks found and accepted by the daemon when solo mining.")
+
+	SubmitLatency = NewHistogram("xmrwasp_submit_latency_seconds",
+		"Time for the pool to answer a share submission.",
+		[]float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30})
+)
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/trey-jones/xmrwasp/config"
+	"github.com/trey-jones/xmrwasp/logger"
+)
+
+var (
+	ErrUnsupportedAlgo = errors.New("unsupported algorithm")
+)
+
+// workerExtensions are the xmrig protocol extensions that workers can use with the proxy.
+// nicehash is added in nicehash mode.
+var workerExtensions = []string{"algo", "connect", "keepalive"}
+
+// algoList reads the algorithms a miner sent with its login.  Anything that isn't a list of
+// strings is ignored.
+func algoList(v interface{}) []string {
+	list, _ := v.([]interface{})
+	algos := make([]string, 0, len(list))
+	for _, a := range list {
+		if algo, ok := a.(string); ok && algo != "" {
+			algos = append(algos, algo)
+		}
+	}
+	return algos
+}
+
+// supportsAlgo is true if algo is in algos.  A miner that doesn't list its algorithms, or a
+// job that doesn't name one, is assumed to be fine.
+func supportsAlgo(algos []string, algo string) bool {
+	if len(algos) == 0 || algo == "" {
+		return true
+	}
+	for _, a := range algos {
+		if strings.EqualFold(a, algo) {
+			return true
+		}
+	}
+	return false
+}
+
+// unsupportedAlgo explains why a miner or pool was turned away
+func unsupportedAlgo(want string, have []string) error {
+	return fmt.Errorf("%v: the pool mines %v, not %v", ErrUnsupportedAlgo, want, strings.Join(have, ", "))
+}
+
+// extensions are the protocol extensions the proxy offers its workers
+func (p *Proxy) extensions() []string {
+	extensions := append([]string(nil), workerExtensions...)
+	if p.niceHash {
+		extensions = append(extensions, "nicehash")
+	}
+	return extensions
+}
+
+// jobAlgo is the algorithm of the jobs the proxy is handing out.  Safe for concurrent use.
+func (p *Proxy) jobAlgo() string {
+	p.jobMu.Lock()
+	defer p.jobMu.Unlock()
+	if p.donating {
+		return p.donateJob.Algo
+	}
+	return p.currentJob.Algo
+}
+
+// checkAlgo makes sure the worker can mine the proxy's jobs.  Safe for concurrent use.
+func (p *Proxy) checkAlgo(w Worker) error {
+	algo := p.jobAlgo()
+	if algos := p.workerState(w).algoList(); !supportsAlgo(algos, algo) {
+		return unsupportedAlgo(algo, algos)
+	}
+	return nil
+}
+
+// jobRecipients splits the workers into those that can mine algo, and those that can't
+func (p *Proxy) jobRecipients(algo string) (send, reroute []Worker) {
+	for _, w := range p.workers {
+		if supportsAlgo(p.workerState(w).algoList(), algo) {
+			send = append(send, w)
+		} else {
+			reroute = append(reroute, w)
+		}
+	}
+	return send, reroute
+}
+
+// routeAlgo moves the worker to a proxy for a pool profile it can mine, if the proxy's pool mines
+// an algorithm that the worker can't.  It fails if c has no such profile.  A worker that is moved
+// hasn't been sent a job.
+func (p *Proxy) routeAlgo(w Worker, c *config.Config) (moved bool, err error) {
+	p.jobWaiter.Wait() // the pool's algorithm is known from its first job
+	if err = p.checkAlgo(w); err == nil {
+		return false, nil
+	}
+	profile, ok := c.AlgoProfile(p.workerState(w).algoList())
+	if !ok || profile == p.group.profile {
+		return false, err
+	}
+	g := p.group
+	g.profile = profile
+	p.transfer(w, p.director.nextProxy(g))
+	return true, nil
+}
+
+// reroute moves a worker that can't mine the pool's new algorithm to a proxy that it can, or
+// disconnects it if there is none.  It will be told why when it logs in again.
+func (p *Proxy) reroute(w Worker, algo string) {
+	moved, err := p.routeAlgo(w, config.Get())
+	if err != nil {
+		logger.Get().Printf("Disconnecting worker %v.%v: %v\n", p.ID, w.ID(), err)
+		w.Disconnect()
+		return
+	}
+	if moved {
+		logger.Get().Printf("Moved worker %v off proxy %v, it can't mine %v\n", w.ID(), p.ID, algo)
+		go w.NewJob(w.Proxy().NextJob(w))
+	}
+}
+
+// loginAlgos are the algorithms the proxy asks the pool for, if the pool config names one
+func loginAlgos(pool config.Pool) []string {
+	if pool.Algo == "" {
+		return nil
+	}
+	return []string{pool.Algo}
+}
+
+// checkPoolAlgo makes sure the pool gave us a job with the algorithm it was configured with
+func checkPoolAlgo(pool config.Pool, j *Job) error {
+	if j == nil || supportsAlgo(loginAlgos(pool), j.Algo) {
+		return nil
+	}
+	return unsupportedAlgo(j.Algo, loginAlgos(pool))
+}
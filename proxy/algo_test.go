@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/trey-jones/xmrwasp/config"
+)
+
+func TestAlgoList(t *testing.T) {
+	require.Equal(t, []string{"rx/0", "cn/r"}, algoList([]interface{}{"rx/0", 7, "", "cn/r"}))
+	require.Empty(t, algoList("rx/0"))
+	require.Empty(t, algoList(nil))
+
+	require.True(t, supportsAlgo(nil, "rx/0"))
+	require.True(t, supportsAlgo([]string{"cn/r"}, ""))
+	require.True(t, supportsAlgo([]string{"cn/r", "RX/0"}, "rx/0"))
+	require.False(t, supportsAlgo([]string{"cn/r"}, "rx/0"))
+}
+
+func TestCheckAlgo(t *testing.T) {
+	w := &testWorker{id: 1}
+	p := &Proxy{currentJob: &Job{Algo: "rx/0"}, states: map[uint64]*workerState{1: {}}}
+	require.NoError(t, p.checkAlgo(w))
+
+	p.states[1].setAlgos([]string{"cn/r", "cn/half"})
+	err := p.checkAlgo(w)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), ErrUnsupportedAlgo.Error())
+	require.Contains(t, err.Error(), "rx/0")
+
+	p.states[1].setAlgos([]string{"cn/r", "rx/0"})
+	require.NoError(t, p.checkAlgo(w))
+
+	require.Equal(t, []string{"algo", "connect", "keepalive"}, p.extensions())
+	p.niceHash = true
+	require.Contains(t, p.extensions(), "nicehash")
+}
+
+func TestCheckPoolAlgo(t *testing.T) {
+	pool := config.Pool{URL: "pool:3333"}
+	require.Nil(t, loginAlgos(pool))
+	require.NoError(t, checkPoolAlgo(pool, &Job{Algo: "cn/r"}))
+
+	pool.Algo = "rx/0"
+	require.Equal(t, []string{"rx/0"}, loginAlgos(pool))
+	require.NoError(t, checkPoolAlgo(pool, &Job{Algo: "rx/0"}))
+	require.NoError(t, checkPoolAlgo(pool, &Job{}))
+	require.Error(t, checkPoolAlgo(pool, &Job{Algo: "cn/r"}))
+}
+
+func TestJobRecipients(t *testing.T) {
+	any, wow, rx := &testWorker{id: 1}, &testWorker{id: 2}, &testWorker{id: 3}
+	p := &Proxy{
+		workers: map[uint64]Worker{1: any, 2: wow, 3: rx},
+		states:  map[uint64]*workerState{1: {}, 2: {}, 3: {}},
+	}
+	p.states[2].setAlgos([]string{"rx/wow"})
+	p.states[3].setAlgos([]string{"rx/0", "rx/wow"})
+
+	send, reroute := p.jobRecipients("rx/0")
+	require.Len(t, send, 2)
+	require.Contains(t, send, any)
+	require.Contains(t, send, rx)
+	require.Equal(t, []Worker{wow}, reroute)
+
+	send, reroute = p.jobRecipients("rx/wow")
+	require.Len(t, send, 3)
+	require.Empty(t, reroute)
+}
+
+func TestRouteAlgo(t *testing.T) {
+	c := &config.Config{
+		Pools:    config.Pools{{URL: "monero:3333", Algo: "rx/0"}},
+		Profiles: config.Profiles{"wownero": {{URL: "wownero:3333", Algo: "rx/wow"}}},
+	}
+	w := &testWorker{id: 1}
+	p := &Proxy{
+		currentJob: &Job{Algo: "rx/0"},
+		jobWaiter:  &sync.WaitGroup{},
+		states:     map[uint64]*workerState{1: {}},
+	}
+
+	// workers that can mine the pool's algorithm stay
+	moved, err := p.routeAlgo(w, c)
+	require.NoError(t, err)
+	require.False(t, moved)
+	p.states[1].setAlgos([]string{"rx/0"})
+	moved, err = p.routeAlgo(w, c)
+	require.NoError(t, err)
+	require.False(t, moved)
+
+	// there is nowhere else to go
+	p.states[1].setAlgos([]string{"cn/r"})
+	_, err = p.routeAlgo(w, c)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), ErrUnsupportedAlgo.Error())
+
+	// the proxy already has the profile for the worker's algorithm
+	p.currentJob.Algo = "rx/wow"
+	p.group.profile = "wownero"
+	p.states[1].setAlgos([]string{"rx/0", "rx/wow", "cn/r"})
+	moved, err = p.routeAlgo(w, c)
+	require.NoError(t, err)
+	require.False(t, moved)
+}
@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// miner transaction input and output tags
+	txInGen          = 0xff
+	txOutToKey       = 0x02
+	txOutToTaggedKey = 0x03
+)
+
+var (
+	ErrMalformedTemplate = errors.New("bad block template from daemon")
+)
+
+// blockTemplate is a block from the daemon, waiting for a nonce.  The daemon leaves reserved space
+// in the miner transaction, and each worker's extra nonce goes there.  Since that changes the
+// transaction hash, each worker's hashing blob has its own merkle root.
+type blockTemplate struct {
+	blob           []byte
+	reservedOffset int
+	difficulty     uint64
+	height         uint64
+	seedHash       string
+
+	// where the miner transaction is in the blob, and where its prefix ends
+	minerTxOffset int
+	minerTxPrefix int
+	minerTxEnd    int
+	// the hashes of the other transactions in the block
+	txHashes [][32]byte
+}
+
+// newBlockTemplate finds the miner transaction and transaction hashes in a block template blob
+func newBlockTemplate(blob []byte, reservedOffset int, difficulty, height uint64, seedHash string) (*blockTemplate, error) {
+	t := &blockTemplate{
+		blob:           blob,
+		reservedOffset: reservedOffset,
+		difficulty:     difficulty,
+		height:         height,
+		seedHash:       seedHash,
+	}
+	r := &blobReader{b: blob}
+
+	// major and minor version, timestamp, previous block hash
+	r.varint()
+	r.varint()
+	r.varint()
+	r.skip(32)
+	if r.err != nil || r.pos != nonceOffset {
+		// the nonce has to be where it is in every other job
+		return nil, ErrMalformedTemplate
+	}
+	r.skip(nonceLength)
+
+	t.minerTxOffset = r.pos
+	version := r.varint()
+	r.varint() // unlock time
+	for inputs := r.varint(); inputs > 0 && r.err == nil; inputs-- {
+		if r.byte() != txInGen {
+			return nil, ErrMalformedTemplate
+		}
+		r.varint() // height
+	}
+	for outputs := r.varint(); outputs > 0 && r.err == nil; outputs-- {
+		r.varint() // amount
+		switch r.byte() {
+		case txOutToKey:
+			r.skip(32)
+		case txOutToTaggedKey:
+			r.skip(33)
+		default:
+			return nil, ErrMalformedTemplate
+		}
+	}
+	r.skip(int(r.varint())) // extra, which has the reserved space
+	t.minerTxPrefix = r.pos
+	if version >= 2 {
+		// a miner transaction has no ring signatures, just the type
+		r.byte()
+	}
+	t.minerTxEnd = r.pos
+
+	for count := r.varint(); count > 0 && r.err == nil; count-- {
+		var h [32]byte
+		copy(h[:], r.take(32))
+		t.txHashes = append(t.txHashes, h)
+	}
+	if r.err != nil || version < 1 {
+		return nil, ErrMalformedTemplate
+	}
+	if reservedOffset > 0 && (reservedOffset < t.minerTxOffset || reservedOffset+extraNonceLength > t.minerTxPrefix) {
+		return nil, ErrMalformedTemplate
+	}
+
+	return t, nil
+}
+
+// block is the template with the worker's extra nonce.  It doesn't change the template.
+func (t *blockTemplate) block(extraNonce []byte) []byte {
+	b := make([]byte, len(t.blob))
+	copy(b, t.blob)
+	if t.reservedOffset > 0 {
+		copy(b[t.reservedOffset:t.reservedOffset+extraNonceLength], extraNonce)
+	}
+	return b
+}
+
+// hashingBlob is what the worker hashes: the block header, the merkle root of the transactions
+// and the number of transactions
+func (t *blockTemplate) hashingBlob(extraNonce []byte) []byte {
+	b := t.block(extraNonce)
+	hashes := make([][32]byte, 0, len(t.txHashes)+1)
+	hashes = append(hashes, minerTxHash(b[t.minerTxOffset:t.minerTxPrefix], b[t.minerTxPrefix:t.minerTxEnd]))
+	hashes = append(hashes, t.txHashes...)
+	root := treeHash(hashes)
+
+	blob := make([]byte, 0, t.minerTxOffset+len(root)+binary.MaxVarintLen64)
+	blob = append(blob, b[:t.minerTxOffset]...)
+	blob = append(blob, root[:]...)
+	return appendVarint(blob, uint64(len(hashes)))
+}
+
+// blockWithNonce is the block as the worker found it, ready for the daemon
+func (t *blockTemplate) blockWithNonce(extraNonce, nonce []byte) []byte {
+	b := t.block(extraNonce)
+	copy(b[nonceOffset:nonceOffset+nonceLength], nonce)
+	return b
+}
+
+// minerTxHash hashes the miner transaction.  Since version 2, that is the hash of the hashes of
+// its prefix, its signatures and its (empty) prunable part.
+func minerTxHash(prefix, signatures []byte) [32]byte {
+	if len(signatures) == 0 {
+		return keccak256(prefix)
+	}
+	prefixHash := keccak256(prefix)
+	signaturesHash := keccak256(signatures)
+	var prunableHash [32]byte
+	return keccak256(prefixHash[:], signaturesHash[:], prunableHash[:])
+}
+
+// treeHash is the merkle root of the transaction hashes, the way Monero builds it
+func treeHash(hashes [][32]byte) [32]byte {
+	switch len(hashes) {
+	case 0:
+		return [32]byte{}
+	case 1:
+		return hashes[0]
+	case 2:
+		return keccak256(hashes[0][:], hashes[1][:])
+	}
+
+	// the largest power of two below the number of hashes
+	count := 1
+	for count*2 < len(hashes) {
+		count *= 2
+	}
+	ints := make([][32]byte, count)
+	copy(ints, hashes[:2*count-len(hashes)])
+	for i, j := 2*count-len(hashes), 2*count-len(hashes); j < count; i, j = i+2, j+1 {
+		ints[j] = keccak256(hashes[i][:], hashes[i+1][:])
+	}
+	for count > 2 {
+		count /= 2
+		for i, j := 0, 0; j < count; i, j = i+2, j+1 {
+			ints[j] = keccak256(ints[i][:], ints[i+1][:])
+		}
+	}
+	return keccak256(ints[0][:], ints[1][:])
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return append(b, buf[:binary.PutUvarint(buf, v)]...)
+}
+
+// blobReader reads the parts of a blob, remembering the first error
+type blobReader struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func (r *blobReader) take(n int) []byte {
+	if r.err != nil || n < 0 || r.pos+n > len(r.b) {
+		r.err = ErrMalformedTemplate
+		return nil
+	}
+	b := r.b[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *blobReader) skip(n int) {
+	r.take(n)
+}
+
+func (r *blobReader) byte() byte {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *blobReader) varint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.b[r.pos:])
+	if n <= 0 {
+		r.err = ErrMalformedTemplate
+		return 0
+	}
+	r.pos += n
+	return v
+}
@@ -0,0 +1,348 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/powerman/rpc-codec/jsonrpc2"
+	"github.com/trey-jones/stratum"
+	"github.com/trey-jones/xmrwasp/config"
+	"github.com/trey-jones/xmrwasp/logger"
+	"github.com/trey-jones/xmrwasp/metrics"
+)
+
+const (
+	// the daemon is checked for a new block this often, and a template is refreshed after
+	// daemonTemplateRefresh even without one, to pick up new transactions
+	daemonPollInterval    = time.Second
+	daemonTemplateRefresh = 30 * time.Second
+	daemonTimeout         = 10 * time.Second
+	// templates are kept for shares on recent jobs
+	daemonTemplates = 4
+	// RandomX is the only algorithm the daemon will take blocks for
+	daemonAlgo = "rx/0"
+)
+
+var (
+	ErrDaemonUnreachable = errors.New("daemon is unreachable")
+)
+
+// Upstream is the proxy's connection to a pool, or to a daemon that it solo mines on
+type Upstream interface {
+	Call(serviceMethod string, args interface{}, reply interface{}) error
+	Notifications() chan stratum.Notification
+	Close() error
+}
+
+// dialUpstream connects to the pool, or to the daemon if the pool is one
+func dialUpstream(pool config.Pool) (Upstream, error) {
+	if pool.Daemon {
+		dc, err := dialDaemon(pool)
+		if err != nil {
+			return nil, err
+		}
+		return dc, nil
+	}
+	sc, err := dialPool(pool)
+	if err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// daemonClient mines on a monerod node instead of a pool.  It looks like a pool connection to
+// the proxy: it makes jobs from block templates, and shares that meet the network difficulty
+// are submitted as blocks.  Other shares are only counted by the proxy.
+type daemonClient struct {
+	url    string
+	wallet string
+	client *http.Client
+
+	notifications chan stratum.Notification
+	polling       sync.Once
+	done          chan struct{}
+	closeOnce     sync.Once
+
+	mu        sync.Mutex
+	templates map[string]*blockTemplate
+	jobIDs    []string // oldest first
+	lastJobID uint64
+	height    uint64
+	fetched   time.Time
+}
+
+type blockTemplateReply struct {
+	Blob           string `json:"blocktemplate_blob"`
+	HashingBlob    string `json:"blockhashing_blob"`
+	Difficulty     uint64 `json:"difficulty"`
+	Height         uint64 `json:"height"`
+	ReservedOffset int    `json:"reserved_offset"`
+	SeedHash       string `json:"seed_hash"`
+}
+
+// dialDaemon sets up a client for the daemon's JSON-RPC endpoint.  The daemon isn't contacted
+// until login.
+func dialDaemon(pool config.Pool) (*daemonClient, error) {
+	scheme := "http"
+	transport := &http.Transport{}
+	if pool.TLS {
+		tlsConf, err := poolTLSConfig(pool, config.Get().PoolCA)
+		if err != nil {
+			return nil, err
+		}
+		scheme = "https"
+		transport.TLSClientConfig = tlsConf
+	}
+	client := &http.Client{Transport: transport, Timeout: daemonTimeout}
+	return newDaemonClient(scheme+"://"+pool.URL+"/json_rpc", pool.Login, client), nil
+}
+
+func newDaemonClient(url, wallet string, client *http.Client) *daemonClient {
+	return &daemonClient{
+		url:           url,
+		wallet:        wallet,
+		client:        client,
+		notifications: make(chan stratum.Notification, 10),
+		done:          make(chan struct{}),
+		templates:     make(map[string]*blockTemplate),
+	}
+}
+
+// Call answers the proxy's pool requests
+func (d *daemonClient) Call(serviceMethod string, args interface{}, reply interface{}) error {
+	switch serviceMethod {
+	case "login":
+		if r, ok := reply.(*LoginReply); ok {
+			return d.login(r)
+		}
+	case "submit":
+		s, ok := args.(*share)
+		r, ok2 := reply.(*StatusReply)
+		if ok && ok2 {
+			return d.submit(s, r)
+		}
+	case "keepalived":
+		if r, ok := reply.(*StatusReply); ok {
+			return d.keepalived(r)
+		}
+	}
+	return fmt.Errorf("daemon can't answer %v", serviceMethod)
+}
+
+// Notifications are new jobs, made when the daemon has a new template
+func (d *daemonClient) Notifications() chan stratum.Notification {
+	return d.notifications
+}
+
+// Close stops checking the daemon for new templates
+func (d *daemonClient) Close() error {
+	d.closeOnce.Do(func() { close(d.done) })
+	return nil
+}
+
+func (d *daemonClient) login(reply *LoginReply) error {
+	params, err := d.fetchJob()
+	if err != nil {
+		return err
+	}
+	reply.Job, err = NewJobFromServer(params)
+	if err != nil {
+		return err
+	}
+	reply.ID = "solo"
+	reply.Status = "OK"
+	d.polling.Do(func() { go d.poll() })
+	return nil
+}
+
+// submit sends the share to the daemon as a block, if it is one
+func (d *daemonClient) submit(s *share, reply *StatusReply) error {
+	d.mu.Lock()
+	t, ok := d.templates[s.JobID]
+	d.mu.Unlock()
+	if !ok {
+		return ErrBadJobID
+	}
+
+	result, err := s.getResultUint64()
+	if err != nil {
+		return err
+	}
+	reply.Status = "OK"
+	if result >= targetFromDifficulty(t.difficulty) {
+		// the proxy has counted it, and that's all it is good for
+		return nil
+	}
+
+	nonce, err := hex.DecodeString(s.Nonce)
+	if err != nil || len(nonce) != nonceLength {
+		return ErrMalformedShare
+	}
+	var extraNonce []byte
+	if t.reservedOffset > 0 {
+		extraNonce, err = hex.DecodeString(s.ExtraNonce)
+		if err != nil || len(extraNonce) != extraNonceLength {
+			return ErrMalformedShare
+		}
+	}
+
+	block := hex.EncodeToString(t.blockWithNonce(extraNonce, nonce))
+	var status struct {
+		Status string `json:"status"`
+	}
+	err = d.rpc("submit_block", []string{block}, &status)
+	if err == nil && status.Status != "OK" {
+		err = errors.New(status.Status)
+	}
+	if err != nil {
+		logger.Get().Printf("Daemon rejected block at height %v: %v\n", t.height, err)
+		return err
+	}
+	metrics.BlocksFound.Inc()
+	logger.Get().Printf("****    Found block at height %v!\n", t.height)
+	return nil
+}
+
+func (d *daemonClient) keepalived(reply *StatusReply) error {
+	if _, err := d.blockCount(); err != nil {
+		return err
+	}
+	reply.Status = "KEEPALIVED"
+	return nil
+}
+
+// poll sends a new job whenever the daemon has a new block, or the template is getting old
+func (d *daemonClient) poll() {
+	ticker := time.NewTicker(daemonPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.done:
+			return
+		}
+
+		count, err := d.blockCount()
+		if err != nil {
+			logger.Get().Debugln("Unable to check daemon for new blocks: ", err)
+			continue
+		}
+		d.mu.Lock()
+		stale := count != d.height || time.Since(d.fetched) >= daemonTemplateRefresh
+		d.mu.Unlock()
+		if !stale {
+			continue
+		}
+
+		params, err := d.fetchJob()
+		if err != nil {
+			logger.Get().Println("Unable to get block template from daemon: ", err)
+			continue
+		}
+		select {
+		case d.notifications <- stratum.Notification{Method: "job", Params: params}:
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// fetchJob gets a new block template and makes a pool job out of it.  The template goes along
+// with the job, so that the proxy can give each worker its own extra nonce.
+func (d *daemonClient) fetchJob() (map[string]interface{}, error) {
+	var reply blockTemplateReply
+	params := map[string]interface{}{
+		"wallet_address": d.wallet,
+		"reserve_size":   extraNonceLength,
+	}
+	if err := d.rpc("get_block_template", params, &reply); err != nil {
+		return nil, err
+	}
+	blob, err := hex.DecodeString(reply.Blob)
+	if err != nil {
+		return nil, ErrMalformedTemplate
+	}
+	t, err := newBlockTemplate(blob, reply.ReservedOffset, reply.Difficulty, reply.Height, reply.SeedHash)
+	if err != nil {
+		return nil, err
+	}
+	// the reserved space is empty, so the daemon hashes the same blob as a worker with a zero
+	// extra nonce.  If it doesn't, blocks found on our blobs would be rejected.
+	hashingBlob, err := hex.DecodeString(reply.HashingBlob)
+	if err != nil || !bytes.Equal(t.hashingBlob(make([]byte, extraNonceLength)), hashingBlob) {
+		logger.Get().Println("Block template doesn't hash the way the daemon does, at height ", reply.Height)
+		return nil, ErrMalformedTemplate
+	}
+
+	d.mu.Lock()
+	d.lastJobID++
+	jobID := strconv.FormatUint(d.lastJobID, 10)
+	d.templates[jobID] = t
+	d.jobIDs = append(d.jobIDs, jobID)
+	if len(d.jobIDs) > daemonTemplates {
+		delete(d.templates, d.jobIDs[0])
+		d.jobIDs = d.jobIDs[1:]
+	}
+	d.height = t.height
+	d.fetched = time.Now()
+	d.mu.Unlock()
+
+	return map[string]interface{}{
+		"blob":      hex.EncodeToString(t.hashingBlob(make([]byte, extraNonceLength))),
+		"job_id":    jobID,
+		"target":    encodeDifficulty(t.difficulty),
+		"algo":      daemonAlgo,
+		"height":    float64(t.height),
+		"seed_hash": t.seedHash,
+		"template":  t,
+	}, nil
+}
+
+func (d *daemonClient) blockCount() (uint64, error) {
+	var reply struct {
+		Count uint64 `json:"count"`
+	}
+	err := d.rpc("get_block_count", nil, &reply)
+	return reply.Count, err
+}
+
+// rpc calls a method of the daemon's JSON-RPC API
+func (d *daemonClient) rpc(method string, params, result interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      "0",
+		"method":  method,
+		"params":  params,
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := d.client.Post(d.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.Get().Debugln("Daemon request failed: ", err)
+		return ErrDaemonUnreachable
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("daemon answered %v to %v", resp.Status, method)
+	}
+
+	var reply struct {
+		Result json.RawMessage `json:"result"`
+		Error  *jsonrpc2.Error `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return err
+	}
+	if reply.Error != nil {
+		return reply.Error
+	}
+	return json.Unmarshal(reply.Result, result)
+}
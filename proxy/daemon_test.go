@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDaemon answers the parts of the monerod JSON-RPC API that the daemon client uses
+type fakeDaemon struct {
+	mu          sync.Mutex
+	height      uint64
+	template    []byte
+	reserved    int
+	hashingBlob []byte
+	blocks      []string
+}
+
+func (f *fakeDaemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var result interface{}
+	switch req.Method {
+	case "get_block_count":
+		result = map[string]interface{}{"count": f.height, "status": "OK"}
+	case "get_block_template":
+		result = map[string]interface{}{
+			"blocktemplate_blob": hex.EncodeToString(f.template),
+			"blockhashing_blob":  hex.EncodeToString(f.hashingBlob),
+			"difficulty":         100000,
+			"height":             f.height,
+			"reserved_offset":    f.reserved,
+			"seed_hash":          "abcd",
+			"status":             "OK",
+		}
+	case "submit_block":
+		var blobs []string
+		json.Unmarshal(req.Params, &blobs)
+		f.blocks = append(f.blocks, blobs...)
+		result = map[string]interface{}{"status": "OK"}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": "0", "result": result})
+}
+
+func (f *fakeDaemon) submitted() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.blocks...)
+}
+
+// testBlockTemplate is a block with a version 2 miner transaction and two other transactions.
+// It returns the offset of the reserved space in the miner transaction extra.
+func testBlockTemplate() ([]byte, int) {
+	var b []byte
+	b = append(b, 16, 16)                            // versions
+	b = appendVarint(b, 1700000000)                  // timestamp
+	b = append(b, bytes.Repeat([]byte{0xaa}, 32)...) // previous block
+	b = append(b, 0, 0, 0, 0)                        // nonce
+
+	b = append(b, 2)          // transaction version
+	b = appendVarint(b, 1060) // unlock time
+	b = append(b, 1, txInGen) // one input
+	b = appendVarint(b, 1000) // height
+	b = append(b, 1)          // one output
+	b = appendVarint(b, 6e11) // amount
+	b = append(b, txOutToTaggedKey)
+	b = append(b, bytes.Repeat([]byte{0xbb}, 33)...)
+	b = append(b, 1+32+2+extraNonceLength, 0x01)
+	b = append(b, bytes.Repeat([]byte{0xcc}, 32)...)
+	b = append(b, 0x02, extraNonceLength)
+	reserved := len(b)
+	b = append(b, make([]byte, extraNonceLength)...)
+	b = append(b, 0) // no ring signatures
+
+	b = append(b, 2)
+	b = append(b, bytes.Repeat([]byte{0x11}, 32)...)
+	b = append(b, bytes.Repeat([]byte{0x22}, 32)...)
+	return b, reserved
+}
+
+func TestTreeHash(t *testing.T) {
+	a, b, c := [32]byte{1}, [32]byte{2}, [32]byte{3}
+	require.Equal(t, a, treeHash([][32]byte{a}))
+	require.Equal(t, keccak256(a[:], b[:]), treeHash([][32]byte{a, b}))
+	bc := keccak256(b[:], c[:])
+	require.Equal(t, keccak256(a[:], bc[:]), treeHash([][32]byte{a, b, c}))
+
+	empty := keccak256()
+	require.Equal(t, "c5d2460186f7233c927e7db2dcc703c0e500b653ca82273b7bfad8045d85a470", hex.EncodeToString(empty[:]))
+}
+
+func TestBlockTemplate(t *testing.T) {
+	blob, reserved := testBlockTemplate()
+	tmpl, err := newBlockTemplate(blob, reserved, 100000, 1000, "abcd")
+	require.NoError(t, err)
+	require.Len(t, tmpl.txHashes, 2)
+
+	one, two := tmpl.hashingBlob(encodeExtraNonce(1)), tmpl.hashingBlob(encodeExtraNonce(2))
+	require.Equal(t, blob[:nonceOffset+nonceLength], one[:nonceOffset+nonceLength])
+	require.NotEqual(t, one, two)
+	// header, merkle root, and three transactions
+	require.Len(t, one, nonceOffset+nonceLength+32+1)
+	require.Equal(t, byte(3), one[len(one)-1])
+
+	block := tmpl.blockWithNonce(encodeExtraNonce(1), []byte{1, 2, 3, 4})
+	require.Equal(t, []byte{1, 2, 3, 4}, block[nonceOffset:nonceOffset+nonceLength])
+	require.Equal(t, encodeExtraNonce(1), block[reserved:reserved+extraNonceLength])
+	require.Equal(t, make([]byte, extraNonceLength), blob[reserved:reserved+extraNonceLength])
+
+	// the reserved space has to be in the miner transaction
+	_, err = newBlockTemplate(blob, 10, 100000, 1000, "abcd")
+	require.Equal(t, ErrMalformedTemplate, err)
+	_, err = newBlockTemplate(blob[:len(blob)-1], reserved, 100000, 1000, "abcd")
+	require.Equal(t, ErrMalformedTemplate, err)
+}
+
+// TestGenesisHashingBlob checks the hashing blob against the real chain.  The Monero genesis
+// block has a version 1 miner transaction and no other transactions, and its hash is the hash of
+// its hashing blob.
+func TestGenesisHashingBlob(t *testing.T) {
+	minerTx, err := hex.DecodeString("013c01ff0001ffffffffffff03029b2e4c0281c0b02e7c53291a94d1d0cbff8883f8024f5142ee494ffbbd08807121017767aafcde9be00dcfd098715ebcf7f410daebc582fda69d24a28e9d0bc890d1")
+	require.NoError(t, err)
+	blob := []byte{1, 0, 0}                    // versions, zero timestamp
+	blob = append(blob, make([]byte, 32)...)   // no previous block
+	blob = append(blob, 0x10, 0x27, 0, 0)      // nonce 10000
+	blob = append(append(blob, minerTx...), 0) // no other transactions
+	minerTxOffset := len(blob) - len(minerTx) - 1
+
+	// the short timestamp puts the nonce earlier than in any later block, so the template is
+	// laid out by hand rather than parsed
+	tmpl := &blockTemplate{blob: blob, minerTxOffset: minerTxOffset,
+		minerTxPrefix: minerTxOffset + len(minerTx), minerTxEnd: minerTxOffset + len(minerTx)}
+	hashingBlob := tmpl.hashingBlob(nil)
+	txHash := keccak256(minerTx)
+	require.Equal(t, "c88ce9783b4f11190d7b9c17a69c1c52200f9faaee8e98dd07e6811175177139", hex.EncodeToString(txHash[:]))
+	blockHash := keccak256(appendVarint(nil, uint64(len(hashingBlob))), hashingBlob)
+	require.Equal(t, "418015bb9ae982a1975da7d79277c2705727a56894ba0fb246adaabb1f4632e3", hex.EncodeToString(blockHash[:]))
+}
+
+func TestDaemonClient(t *testing.T) {
+	blob, reserved := testBlockTemplate()
+	tmpl, err := newBlockTemplate(blob, reserved, 100000, 1000, "abcd")
+	require.NoError(t, err)
+	daemon := &fakeDaemon{height: 1000, template: blob, reserved: reserved,
+		hashingBlob: tmpl.hashingBlob(make([]byte, extraNonceLength))}
+	srv := httptest.NewServer(daemon)
+	defer srv.Close()
+	d := newDaemonClient(srv.URL+"/json_rpc", "wallet", srv.Client())
+	defer d.Close()
+
+	reply := LoginReply{}
+	require.NoError(t, d.Call("login", nil, &reply))
+	j := reply.Job
+	require.NoError(t, j.init())
+	require.Equal(t, encodeDifficulty(100000), j.Target)
+	require.Equal(t, "abcd", j.SeedHash)
+	require.True(t, j.hasExtraNonce())
+
+	// each worker gets its own blob
+	w1, w2 := j.Next(), j.Next()
+	require.NoError(t, j.writeExtraNonce(w1, 1))
+	require.NoError(t, j.writeExtraNonce(w2, 2))
+	require.NotEqual(t, w1.Blob[2*(nonceOffset+nonceLength):], w2.Blob[2*(nonceOffset+nonceLength):])
+	rebuilt, err := j.blobWithNonce("01000000", "00000000")
+	require.NoError(t, err)
+	require.Equal(t, w1.Blob, hex.EncodeToString(rebuilt))
+
+	// shares below the network difficulty aren't sent to the daemon
+	status := StatusReply{}
+	low := &share{JobID: j.ID, ExtraNonce: "02000000", Nonce: "01020304", Result: strings.Repeat("ff", 32)}
+	require.NoError(t, d.Call("submit", low, &status))
+	require.Equal(t, "OK", status.Status)
+	require.Empty(t, daemon.submitted())
+
+	block := &share{JobID: j.ID, ExtraNonce: "02000000", Nonce: "01020304", Result: strings.Repeat("00", 32)}
+	require.NoError(t, d.Call("submit", block, &status))
+	found := daemon.submitted()
+	require.Len(t, found, 1)
+	require.Equal(t, "01020304", found[0][2*nonceOffset:2*(nonceOffset+nonceLength)])
+	require.Equal(t, "02000000", found[0][2*reserved:2*(reserved+extraNonceLength)])
+
+	require.Equal(t, ErrBadJobID, d.Call("submit", &share{JobID: "gone", Result: block.Result}, &status))
+
+	// a new block on the chain means a new job
+	daemon.mu.Lock()
+	daemon.height++
+	daemon.mu.Unlock()
+	select {
+	case notif := <-d.Notifications():
+		next, err := NewJobFromServer(notif.Params.(map[string]interface{}))
+		require.NoError(t, err)
+		require.Equal(t, uint64(1001), next.Height)
+		require.NotEqual(t, j.ID, next.ID)
+	case <-time.After(5 * daemonPollInterval):
+		t.Fatal("no job after a new block")
+	}
+
+	require.NoError(t, d.Call("keepalived", nil, &status))
+
+	// a template that the daemon hashes differently is refused
+	daemon.mu.Lock()
+	daemon.hashingBlob = tmpl.hashingBlob(encodeExtraNonce(1))
+	daemon.mu.Unlock()
+	_, err = d.fetchJob()
+	require.Equal(t, ErrMalformedTemplate, err)
+
+	srv.Close()
+	require.Equal(t, ErrDaemonUnreachable, d.Call("keepalived", nil, &status))
+}
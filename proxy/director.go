@@ -1,11 +1,20 @@
 package proxy
 
 import (
+	"context"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/trey-jones/xmrwasp/config"
 	"github.com/trey-jones/xmrwasp/logger"
+	"github.com/trey-jones/xmrwasp/metrics"
+)
+
+const (
+	// how often the director looks for a proxy whose workers would fit on the others
+	consolidateInterval = 5 * time.Minute
 )
 
 var (
@@ -19,13 +28,22 @@ type Director struct {
 	statInterval time.Duration
 
 	workers chan Worker
+	// reload tells the run loop to apply a new config
+	reload chan struct{}
+	// reloadMu keeps a reload's log level from being applied after a newer one's
+	reloadMu sync.Mutex
 
 	currentProxyID uint64
 	proxies        map[uint64]*Proxy
-	newProxyMu     sync.Mutex
+	newProxyMu     sync.Mutex // also protects proxies
 
 	// stat tracking only
 	lastTotalShares uint64
+	// shares from proxies that have been removed, so the totals don't go backwards
+	retiredShares   uint64
+	retiredRejected uint64
+	// hashes done for each site key
+	sites siteAccounts
 }
 
 func GetDirector() *Director {
@@ -40,6 +58,7 @@ func newDirector() *Director {
 	d := &Director{
 		aliveSince:   time.Now(),
 		statInterval: time.Duration(config.Get().StatInterval) * time.Second,
+		reload:       make(chan struct{}, 1),
 
 		proxies: make(map[uint64]*Proxy),
 	}
@@ -48,6 +67,26 @@ func newDirector() *Director {
 	return d
 }
 
+// group is the kind of work a proxy does.  Workers only share proxies with workers from
+// listeners in the same group.  The zero group mines on the top level pools.
+type group struct {
+	profile string
+	// donate overrides the configured donation level if donateSet is true
+	donateSet bool
+	donate    int
+	// login and password replace the pool login for workers from a site with its own
+	login    string
+	password string
+}
+
+func listenerGroup(l config.Listener) group {
+	g := group{profile: l.Profile}
+	if l.Donate != nil {
+		g.donateSet, g.donate = true, *l.Donate
+	}
+	return g
+}
+
 // Stats is a struct containing information about server uptime and activity, generated on demand
 type Stats struct {
 	Timestamp time.Time
@@ -57,35 +96,216 @@ type Stats struct {
 	Workers   int
 	Shares    uint64
 	NewShares uint64
+	Rejected  uint64
 
 	debug map[string]interface{}
 }
 
-func (d *Director) addProxy() *Proxy {
-	p := New(d.nextProxyID())
+// ProxyStats describes a single proxy and its pool connection
+type ProxyStats struct {
+	ID       uint64
+	Pool     string
+	Profile  string
+	Algo     string
+	AuthID   string
+	Alive    time.Duration
+	Workers  int
+	Shares   uint64
+	Rejected uint64
+	Donating bool
+}
+
+// WorkerStats describes a single worker
+type WorkerStats struct {
+	ID      uint64
+	ProxyID uint64
+
+	// Login, RigID and Agent are whatever the worker sent when it logged in
+	Login string
+	RigID string
+	Agent string
+	// SiteKey is the site a Coinhive style miner authed with
+	SiteKey    string
+	RemoteAddr string
+	Transport  string
+	Connected  time.Time
+	LastShare  time.Time
+	LastSeen   time.Time
+
+	// Difficulty is the vardiff difficulty, 0 if the worker gets the pool target
+	Difficulty uint64
+	// Accepted counts the worker's good shares, including those that didn't meet the pool target
+	Accepted uint64
+	Rejected uint64
+	Hashes   uint64
+	// Hashrate is estimated over the last 10 minutes, in hashes per second
+	Hashrate   float64
+	Hashrate1m float64
+}
+
+func (d *Director) addProxy(g group) *Proxy {
+	p := newProxy(d.nextProxyID(), g)
 	p.director = d
 	d.proxies[p.ID] = p
+	metrics.Proxies.Inc()
 
 	return p
 }
 
 func (d *Director) run() {
 	statPrinter := time.NewTicker(d.statInterval)
-	defer statPrinter.Stop()
+	consolidate := time.NewTicker(consolidateInterval)
+	defer func() {
+		statPrinter.Stop()
+		consolidate.Stop()
+	}()
 	for {
-		<-statPrinter.C
-		d.printStats()
+		select {
+		case <-statPrinter.C:
+			d.printStats()
+		case <-d.reload:
+			if interval := time.Duration(config.Get().StatInterval) * time.Second; interval != d.statInterval {
+				d.statInterval = interval
+				statPrinter.Stop()
+				statPrinter = time.NewTicker(interval)
+			}
+		case <-consolidate.C:
+			if config.Get().SpinDown > 0 {
+				d.consolidate()
+			}
+		}
 	}
 }
 
+// Shutdown lets the shares in flight on every proxy finish, closes all worker and pool connections,
+// and prints a final report.  It gives up waiting when ctx is done.
+func (d *Director) Shutdown(ctx context.Context) {
+	wg := sync.WaitGroup{}
+	for _, p := range d.proxyList() {
+		wg.Add(1)
+		go func(p *Proxy) {
+			defer wg.Done()
+			p.Shutdown(ctx)
+		}(p)
+	}
+	wg.Wait()
+
+	d.printStats()
+}
+
 func (d *Director) printStats() {
 	stats := d.GetStats()
+	atomic.StoreUint64(&d.lastTotalShares, stats.Shares)
 	logger.Get().Printf("  uptime:%s  \t proxies:%v \t workers:%v \t shares:%v(+%v)\n",
 		stats.Alive, stats.Proxies, stats.Workers, stats.Shares, stats.NewShares)
 }
 
 func (d *Director) removeProxy(pr *Proxy) {
+	d.newProxyMu.Lock()
+	defer d.newProxyMu.Unlock()
+	d.deleteProxy(pr)
+}
+
+// deleteProxy forgets the proxy, keeping its share counts.  Callers must hold newProxyMu.
+func (d *Director) deleteProxy(pr *Proxy) {
+	if _, ok := d.proxies[pr.ID]; !ok {
+		return
+	}
 	delete(d.proxies, pr.ID)
+	atomic.AddUint64(&d.retiredShares, atomic.LoadUint64(&pr.shares))
+	atomic.AddUint64(&d.retiredRejected, atomic.LoadUint64(&pr.rejected))
+	metrics.Proxies.Dec()
+}
+
+// retireProxy removes the proxy if it is still empty.  Once it returns true, the director
+// won't hand the proxy out again.
+func (d *Director) retireProxy(pr *Proxy) bool {
+	d.newProxyMu.Lock()
+	defer d.newProxyMu.Unlock()
+	pr.workerMu.Lock()
+	defer pr.workerMu.Unlock()
+	if pr.workerCount > 0 {
+		return false
+	}
+	pr.ready = false
+	d.deleteProxy(pr)
+	return true
+}
+
+// consolidate moves the workers from the least busy proxy onto the others in its group, if
+// they have room.  The emptied proxy then spins down.
+func (d *Director) consolidate() {
+	d.newProxyMu.Lock()
+	loads := make(map[group]map[uint64]int)
+	// proxies whose pool has extra nonce jobs take more workers, so the smallest capacity in the group is used
+	capacities := make(map[group]int)
+	for id, p := range d.proxies {
+		capacity := p.capacity()
+		if workers, ready := p.load(); ready || workers >= capacity {
+			if loads[p.group] == nil {
+				loads[p.group] = make(map[uint64]int)
+			}
+			loads[p.group][id] = workers
+			if c, ok := capacities[p.group]; !ok || capacity < c {
+				capacities[p.group] = capacity
+			}
+		}
+	}
+	var source *Proxy
+	for g, groupLoads := range loads {
+		if id, ok := drainCandidate(groupLoads, capacities[g]); ok {
+			source = d.proxies[id]
+			// nextProxy won't choose it once the lock is released
+			source.drain()
+			break
+		}
+	}
+	d.newProxyMu.Unlock()
+	if source == nil {
+		return
+	}
+
+	workers := source.workerList()
+	logger.Get().Printf("Moving %v workers off proxy %v to use fewer pool connections\n", len(workers), source.ID)
+	for _, w := range workers {
+		source.move(w, d.nextProxy(source.group))
+	}
+}
+
+// drainCandidate picks the proxy with the fewest workers, if they all fit on the other proxies
+// that have workers.  loads is the number of workers on each proxy.
+func drainCandidate(loads map[uint64]int, capacity int) (uint64, bool) {
+	var source uint64
+	fewest := capacity + 1
+	for id, workers := range loads {
+		if workers > 0 && (workers < fewest || workers == fewest && id > source) {
+			source, fewest = id, workers
+		}
+	}
+	if fewest > capacity {
+		return 0, false
+	}
+
+	room := 0
+	for id, workers := range loads {
+		if id != source && workers > 0 && workers < capacity {
+			room += capacity - workers
+		}
+	}
+
+	return source, room >= fewest
+}
+
+// proxyList is a copy of the current proxies, so that they can be inspected without holding the lock
+func (d *Director) proxyList() []*Proxy {
+	d.newProxyMu.Lock()
+	defer d.newProxyMu.Unlock()
+	proxies := make([]*Proxy, 0, len(d.proxies))
+	for _, p := range d.proxies {
+		proxies = append(proxies, p)
+	}
+
+	return proxies
 }
 
 func (d *Director) nextProxyID() uint64 {
@@ -93,49 +313,55 @@ func (d *Director) nextProxyID() uint64 {
 	return d.currentProxyID
 }
 
-// NextProxy gets the first available proxy that has room.
+// NextProxy gets the first available proxy that has room for a worker from the listener.
 // If no proxy is available, a new one is created.
-func (d *Director) NextProxy() *Proxy {
+func (d *Director) NextProxy(l config.Listener) *Proxy {
+	return d.nextProxy(listenerGroup(l))
+}
+
+func (d *Director) nextProxy(g group) *Proxy {
 	// This takes care of the race, but might bottleneck - TODO revisit this later.
 	// consider storing nextproxy until full/notready then getting a new one?  still a race...
 	d.newProxyMu.Lock()
 	defer d.newProxyMu.Unlock()
+	// the busiest proxy with room is chosen, so workers end up on as few pool connections as possible
 	var pr *Proxy
+	busiest := -1
 	for _, p := range d.proxies {
-		if p.isReady() {
-			pr = p
-			break
+		if workers, ready := p.load(); ready && p.group == g && workers > busiest {
+			pr, busiest = p, workers
 		}
 	}
 	if pr == nil {
 		// avoid locking in most cases by looping once first
-		pr = d.addProxy()
+		pr = d.addProxy(g)
 	}
 
 	return pr
 }
 
+// GetStats totals up the activity of all proxies.  NewShares is relative to the last printed report.
 func (d *Director) GetStats() *Stats {
 	totalProxies := 0
 	totalWorkers := 0
-	proxyIDs := make([]int, 0)
-	var totalSharesSubmitted uint64
-	// var aliveSince time.Time
-	for ID, p := range d.proxies {
-		proxyIDs = append(proxyIDs, int(ID))
+	// taken together, so a proxy being removed is counted exactly once
+	d.newProxyMu.Lock()
+	proxies := make([]*Proxy, 0, len(d.proxies))
+	for _, p := range d.proxies {
+		proxies = append(proxies, p)
+	}
+	totalSharesSubmitted := atomic.LoadUint64(&d.retiredShares)
+	totalRejected := atomic.LoadUint64(&d.retiredRejected)
+	d.newProxyMu.Unlock()
+
+	for _, p := range proxies {
+		ps := p.Stats()
 		totalProxies++
-		totalWorkers += len(p.workers)
-		totalSharesSubmitted += p.shares
-	}
-	recentShares := totalSharesSubmitted - d.lastTotalShares
-	d.lastTotalShares = totalSharesSubmitted
-	// if len(proxyIDs) > 0 {
-	// 	sort.Ints(proxyIDs)
-	// 	oldestProxyID := proxyIDs[0]
-	// 	oldestProxy := d.proxies[uint64(oldestProxyID)]
-	// 	aliveSince = oldestProxy.aliveSince
-	// }
-	// duration := time.Now().Sub(aliveSince).Truncate(1 * time.Second)
+		totalWorkers += ps.Workers
+		totalSharesSubmitted += ps.Shares
+		totalRejected += ps.Rejected
+	}
+	recentShares := totalSharesSubmitted - atomic.LoadUint64(&d.lastTotalShares)
 	duration := time.Now().Sub(d.aliveSince).Truncate(1 * time.Second)
 
 	stats := &Stats{
@@ -145,9 +371,38 @@ func (d *Director) GetStats() *Stats {
 		Workers:   totalWorkers,
 		Shares:    totalSharesSubmitted,
 		NewShares: recentShares,
+		Rejected:  totalRejected,
 	}
 
 	// if debug, populate debug
 
 	return stats
 }
+
+// GetProxyStats returns the state of each proxy, ordered by ID.
+func (d *Director) GetProxyStats() []*ProxyStats {
+	proxies := d.proxyList()
+	stats := make([]*ProxyStats, 0, len(proxies))
+	for _, p := range proxies {
+		stats = append(stats, p.Stats())
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].ID < stats[j].ID })
+
+	return stats
+}
+
+// GetWorkerStats returns the state of every worker on every proxy.
+func (d *Director) GetWorkerStats() []*WorkerStats {
+	stats := make([]*WorkerStats, 0)
+	for _, p := range d.proxyList() {
+		stats = append(stats, p.WorkerStats()...)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].ProxyID != stats[j].ProxyID {
+			return stats[i].ProxyID < stats[j].ProxyID
+		}
+		return stats[i].ID < stats[j].ID
+	})
+
+	return stats
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/trey-jones/xmrwasp/config"
+)
+
+func TestDrainCandidate(t *testing.T) {
+	tests := []struct {
+		loads  map[uint64]int
+		source uint64
+		ok     bool
+	}{
+		{map[uint64]int{}, 0, false},
+		{map[uint64]int{1: 5}, 0, false},
+		// the quietest proxy is emptied onto the others
+		{map[uint64]int{1: 5, 2: 3, 3: 8}, 2, true},
+		// unless they don't have room
+		{map[uint64]int{1: 9, 2: 3}, 0, false},
+		{map[uint64]int{1: 7, 2: 3}, 2, true},
+		// empty proxies spin down on their own, and don't count as room
+		{map[uint64]int{1: 0, 2: 3}, 0, false},
+		{map[uint64]int{1: 10, 2: 10}, 0, false},
+	}
+	for _, test := range tests {
+		source, ok := drainCandidate(test.loads, 10)
+		require.Equal(t, test.ok, ok, "%v", test.loads)
+		if ok {
+			require.Equal(t, test.source, source, "%v", test.loads)
+		}
+	}
+}
+
+func TestRetireProxy(t *testing.T) {
+	p := &Proxy{ID: 1, ready: true, workerCount: 1, shares: 5, rejected: 2}
+	d := &Director{proxies: map[uint64]*Proxy{1: p}}
+
+	// busy proxies stay
+	require.False(t, d.retireProxy(p))
+	require.True(t, p.isReady())
+	require.Equal(t, p, d.NextProxy(config.Listener{}))
+
+	// empty ones go, but their shares are still counted
+	p.workerCount = 0
+	require.True(t, d.retireProxy(p))
+	require.False(t, p.isReady())
+	require.Empty(t, d.proxies)
+	stats := d.GetStats()
+	require.Equal(t, uint64(5), stats.Shares)
+	require.Equal(t, uint64(2), stats.Rejected)
+
+	// removing it again changes nothing
+	d.removeProxy(p)
+	require.Equal(t, uint64(5), d.GetStats().Shares)
+}
+
+func TestNextProxyPrefersBusiest(t *testing.T) {
+	d := &Director{proxies: map[uint64]*Proxy{
+		1: {ID: 1, ready: true, workerCount: 3},
+		2: {ID: 2, ready: true, workerCount: 7},
+		3: {ID: 3, ready: true, workerCount: maxProxyWorkers},
+		4: {ID: 4, ready: true, workerCount: 9, draining: true},
+	}}
+	require.Equal(t, uint64(2), d.NextProxy(config.Listener{}).ID)
+}
+
+func TestNextProxyKeepsGroupsApart(t *testing.T) {
+	donate := 5
+	browsers := config.Listener{Profile: "browsers", Donate: &donate}
+	d := &Director{proxies: map[uint64]*Proxy{
+		1: {ID: 1, ready: true, workerCount: 7},
+		2: {ID: 2, ready: true, workerCount: 3, group: listenerGroup(browsers)},
+		3: {ID: 3, ready: true, workerCount: 9, group: group{profile: "browsers"}},
+	}}
+	require.Equal(t, uint64(1), d.NextProxy(config.Listener{Transport: "tcp", Difficulty: 1000}).ID)
+	require.Equal(t, uint64(2), d.NextProxy(browsers).ID)
+	require.Equal(t, uint64(3), d.NextProxy(config.Listener{Profile: "browsers"}).ID)
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"sync/atomic"
+
+	"github.com/trey-jones/xmrwasp/config"
+	"github.com/trey-jones/xmrwasp/logger"
+)
+
+const (
+	// the extra nonce is written little endian into the reserved space of the job blob, or of
+	// the block template
+	extraNonceLength = 4
+	// workers with their own extra nonce don't share a nonce space, so many more fit on a proxy
+	maxExtraNonceWorkers = 1 << 16
+)
+
+// hasExtraNonce is true for jobs from pools that leave space in the blob for the proxy and say
+// how to submit it, and from daemons that leave space in the block template
+func (j *Job) hasExtraNonce() bool {
+	return j.ReservedOffset > 0 && j.extraNonceField != "" || j.template != nil && j.template.reservedOffset > 0
+}
+
+// setExtraNonceField takes up the pool's reserved space if the pool is configured with the share
+// field to submit the extra nonce in.  It is set before the job is handed out.
+func (j *Job) setExtraNonceField(pool config.Pool) {
+	j.extraNonceField = pool.ExtraNonce
+}
+
+// checkReservedSpace ignores reserved space that isn't inside the blob, or that overlaps the
+// nonce, so the job can still be mined without an extra nonce.  Daemon templates are checked
+// when they are made.
+func (j *Job) checkReservedSpace(blobBytes []byte) {
+	if j.ReservedOffset == 0 {
+		return
+	}
+	if j.ReservedOffset < nonceOffset+nonceLength || j.ReservedOffset+extraNonceLength > len(blobBytes) {
+		logger.Get().Println("Ignoring reserved space that doesn't fit in the blob clear of the nonce, at offset ", j.ReservedOffset)
+		j.ReservedOffset = 0
+	}
+}
+
+// encodeExtraNonce is the extra nonce as it appears in the blob and in shares
+func encodeExtraNonce(extraNonce uint32) []byte {
+	b := make([]byte, extraNonceLength)
+	binary.LittleEndian.PutUint32(b, extraNonce)
+	return b
+}
+
+// extraNonceBlob is the job blob with an extra nonce in it.  For daemon jobs, that means a new
+// merkle root.
+func (j *Job) extraNonceBlob(extraNonce []byte) ([]byte, error) {
+	if j.template != nil {
+		return j.template.hashingBlob(extraNonce), nil
+	}
+	blob, err := hex.DecodeString(j.Blob)
+	if err != nil || j.ReservedOffset+extraNonceLength > len(blob) {
+		return nil, ErrMalformedJob
+	}
+	copy(blob[j.ReservedOffset:], extraNonce)
+	return blob, nil
+}
+
+// writeExtraNonce gives next, a job made by Next, the worker's extra nonce and starts its nonce
+// from zero.  With its own extra nonce the worker has the whole nonce space.
+func (j *Job) writeExtraNonce(next *Job, extraNonce uint32) error {
+	blob, err := j.extraNonceBlob(encodeExtraNonce(extraNonce))
+	if err != nil {
+		return err
+	}
+	copy(blob[nonceOffset:nonceOffset+nonceLength], make([]byte, nonceLength))
+	next.Blob = hex.EncodeToString(blob)
+	return nil
+}
+
+// extraNonce is the worker's extra nonce.  Worker IDs are unique on a proxy, so the ID is used.
+func extraNonce(w Worker) uint32 {
+	return uint32(w.ID())
+}
+
+// setShareExtraNonce gives the share the extra nonce the worker was given for its job, if the job
+// has one, and the field that the pool wants it in.  Safe for concurrent use.
+func (p *Proxy) setShareExtraNonce(w Worker, s *share) {
+	p.jobMu.Lock()
+	job := p.findJob(s.JobID)
+	p.jobMu.Unlock()
+	if job == nil || !job.hasExtraNonce() {
+		return
+	}
+	s.ExtraNonce = hex.EncodeToString(encodeExtraNonce(extraNonce(w)))
+	s.extraNonceField = job.extraNonceField
+}
+
+// setExtraNonceJobs records whether the upstream's jobs have space for an extra nonce, which
+// decides how many workers the proxy can take.  Safe for concurrent use.
+func (p *Proxy) setExtraNonceJobs(j *Job) {
+	var v int32
+	if j != nil && j.hasExtraNonce() {
+		v = 1
+	}
+	atomic.StoreInt32(&p.extraNonceJobs, v)
+}
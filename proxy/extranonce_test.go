@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/trey-jones/xmrwasp/config"
+)
+
+func TestPoolReservedOffset(t *testing.T) {
+	j, err := NewJobFromServer(map[string]interface{}{
+		"blob":            testJobBlob,
+		"job_id":          "1",
+		"target":          "b88d0600",
+		"reserved_offset": float64(60),
+	})
+	require.NoError(t, err)
+	require.Equal(t, 60, j.ReservedOffset)
+	require.Empty(t, j.Extra)
+
+	// workers aren't told about the reserved space
+	next, err := json.Marshal(j.Next())
+	require.NoError(t, err)
+	require.NotContains(t, string(next), "reserved_offset")
+
+	// nor is it used unless the pool says where the extra nonce goes
+	require.False(t, j.hasExtraNonce())
+	j.setExtraNonceField(config.Pool{ExtraNonce: "workerNonce"})
+	require.True(t, j.hasExtraNonce())
+
+	// the reserved space has to be in the blob, and clear of the nonce, or it is ignored
+	for _, offset := range []int{nonceOffset, len(testJobBlob)/2 - 2} {
+		bad := &Job{Blob: testJobBlob, ID: "2", Target: "b88d0600", ReservedOffset: offset}
+		require.NoError(t, bad.init())
+		require.Zero(t, bad.ReservedOffset, offset)
+	}
+
+	// login replies are decoded the same way
+	login := &Job{}
+	require.NoError(t, json.Unmarshal([]byte(`{"blob":"`+testJobBlob+`","job_id":"1","target":"b88d0600","reserved_offset":60}`), login))
+	require.Equal(t, 60, login.ReservedOffset)
+	require.Empty(t, login.Extra)
+}
+
+func TestPoolExtraNonce(t *testing.T) {
+	j := &Job{ID: "1", Blob: testJobBlob, Target: "b88d0600", ReservedOffset: 60}
+	require.NoError(t, j.init())
+	j.setExtraNonceField(config.Pool{ExtraNonce: "workerNonce"})
+	p := &Proxy{currentJob: j, prevJob: &Job{}, donateJob: &Job{}, prevDonateJob: &Job{}}
+
+	worker := j.Next()
+	require.NoError(t, j.writeExtraNonce(worker, 0x0201))
+	require.Equal(t, "01020000", worker.Blob[120:128])
+	require.Equal(t, "00000000", worker.Blob[2*nonceOffset:2*(nonceOffset+nonceLength)])
+	blob, err := j.blobWithNonce("01020000", "00000000")
+	require.NoError(t, err)
+	require.Equal(t, worker.Blob, hex.EncodeToString(blob))
+
+	// the pool gets the extra nonce back in its own field
+	s := &share{JobID: "1", Nonce: "deadbeef", Result: "00"}
+	p.setShareExtraNonce(&testWorker{id: 0x0201}, s)
+	require.Equal(t, "01020000", s.ExtraNonce)
+	submitted, err := json.Marshal(s)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"id":"","job_id":"1","nonce":"deadbeef","result":"00","workerNonce":"01020000"}`, string(submitted))
+
+	// and without an extra nonce the share is as it always was
+	s = &share{JobID: "2", Nonce: "deadbeef", Result: "00"}
+	p.setShareExtraNonce(&testWorker{id: 0x0201}, s)
+	require.Empty(t, s.ExtraNonce)
+	submitted, err = json.Marshal(s)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"id":"","job_id":"2","nonce":"deadbeef","result":"00"}`, string(submitted))
+}
+
+func TestWriteExtraNonce(t *testing.T) {
+	blob, reserved := testBlockTemplate()
+	tmpl, err := newBlockTemplate(blob, reserved, 100000, 1000, "abcd")
+	require.NoError(t, err)
+	j := &Job{Blob: hex.EncodeToString(tmpl.hashingBlob(make([]byte, extraNonceLength))), template: tmpl}
+	require.NoError(t, j.init())
+	require.True(t, j.hasExtraNonce())
+
+	worker := j.Next()
+	require.NoError(t, j.writeExtraNonce(worker, 0x0201))
+	require.Equal(t, hex.EncodeToString(tmpl.hashingBlob([]byte{1, 2, 0, 0}))[2*(nonceOffset+nonceLength):],
+		worker.Blob[2*(nonceOffset+nonceLength):])
+	require.Equal(t, "00000000", worker.Blob[2*nonceOffset:2*(nonceOffset+nonceLength)])
+
+	// the proxy can rebuild the blob the worker hashed from the share
+	rebuilt, err := j.blobWithNonce("01020000", "00000000")
+	require.NoError(t, err)
+	require.Equal(t, worker.Blob, hex.EncodeToString(rebuilt))
+	_, err = j.blobWithNonce("", "00000000")
+	require.Equal(t, ErrMalformedShare, err)
+
+	// the same nonce from workers with different extra nonces are different shares
+	a := &share{ExtraNonce: "01000000", Nonce: "deadbeef"}
+	b := &share{ExtraNonce: "02000000", Nonce: "deadbeef"}
+	require.NotEqual(t, a.key(), b.key())
+}
+
+func TestExtraNonceCapacity(t *testing.T) {
+	p := &Proxy{}
+	require.Equal(t, maxProxyWorkers, p.capacity())
+	p.setExtraNonceJobs(&Job{template: &blockTemplate{reservedOffset: 60}})
+	require.Equal(t, maxExtraNonceWorkers, p.capacity())
+	p.setExtraNonceJobs(&Job{ReservedOffset: 60, extraNonceField: "workerNonce"})
+	require.Equal(t, maxExtraNonceWorkers, p.capacity())
+	p.setExtraNonceJobs(&Job{ReservedOffset: 60})
+	require.Equal(t, maxProxyWorkers, p.capacity())
+	p.setExtraNonceJobs(&Job{})
+	require.Equal(t, maxProxyWorkers, p.capacity())
+}
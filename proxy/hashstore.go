@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// the memory store forgets tokens this long after they were made
+	tokenLifetime = 24 * time.Hour
+	// and looks for old tokens this often
+	tokenPruneInterval = time.Hour
+)
+
+var (
+	// ErrInsufficientFunds is sent to site owners as is, so it uses Coinhive's wording (and spelling)
+	ErrInsufficientFunds = errors.New("insufficent_funds")
+
+	hashStoreMu sync.RWMutex
+	hashStore   HashStore = NewMemoryHashStore()
+)
+
+// TokenBalance is the hashes done by one miner session
+type TokenBalance struct {
+	SiteKey string
+	Hashes  uint64
+	Created time.Time
+}
+
+// UserBalance is the hashes done for a user of a site, over all sessions
+type UserBalance struct {
+	SiteKey   string
+	Name      string
+	Total     uint64
+	Withdrawn uint64
+}
+
+// Balance is the hashes the user still has to spend
+func (b *UserBalance) Balance() uint64 {
+	return b.Total - b.Withdrawn
+}
+
+// HashStore keeps the hashes credited to Coinhive style tokens and users, so that site owners
+// can check them.  Implementations must be safe for concurrent use.
+type HashStore interface {
+	// NewToken records a token given to a miner of the site
+	NewToken(siteKey, token string, created time.Time) error
+	// Credit adds hashes to the token, and to the user of the site if user isn't empty
+	Credit(siteKey, token, user string, hashes uint64) error
+	// Token returns nil if the token is unknown
+	Token(token string) (*TokenBalance, error)
+	// RedeemToken forgets the token if it belongs to the site and has done at least hashes, so
+	// that it can only be verified once.  It returns the token as it was, or nil if it is
+	// unknown or belongs to another site.
+	RedeemToken(siteKey, token string, hashes uint64) (*TokenBalance, error)
+	// User returns nil if the user is unknown
+	User(siteKey, name string) (*UserBalance, error)
+	// Withdraw takes hashes from the user's balance, or fails with ErrInsufficientFunds
+	Withdraw(siteKey, name string, amount uint64) (*UserBalance, error)
+}
+
+// GetHashStore returns the store that hashes are credited to
+func GetHashStore() HashStore {
+	hashStoreMu.RLock()
+	defer hashStoreMu.RUnlock()
+	return hashStore
+}
+
+// SetHashStore replaces the memory store, eg. with one that persists the hashes
+func SetHashStore(s HashStore) {
+	hashStoreMu.Lock()
+	defer hashStoreMu.Unlock()
+	hashStore = s
+}
+
+// MemoryHashStore is a HashStore that is lost on restart
+type MemoryHashStore struct {
+	mu         sync.Mutex
+	tokens     map[string]*TokenBalance
+	users      map[userKey]*UserBalance
+	lastPruned time.Time
+}
+
+type userKey struct {
+	siteKey string
+	name    string
+}
+
+func NewMemoryHashStore() *MemoryHashStore {
+	return &MemoryHashStore{
+		tokens:     make(map[string]*TokenBalance),
+		users:      make(map[userKey]*UserBalance),
+		lastPruned: time.Now(),
+	}
+}
+
+// NewToken implements HashStore
+func (s *MemoryHashStore) NewToken(siteKey, token string, created time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[token] = &TokenBalance{SiteKey: siteKey, Created: created}
+	if created.Sub(s.lastPruned) >= tokenPruneInterval {
+		s.prune(created)
+	}
+	return nil
+}
+
+// prune forgets old tokens.  Callers must hold mu.
+func (s *MemoryHashStore) prune(now time.Time) {
+	for token, tb := range s.tokens {
+		if now.Sub(tb.Created) >= tokenLifetime {
+			delete(s.tokens, token)
+		}
+	}
+	s.lastPruned = now
+}
+
+// Credit implements HashStore
+func (s *MemoryHashStore) Credit(siteKey, token, user string, hashes uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tb, ok := s.tokens[token]; ok {
+		tb.Hashes += hashes
+	}
+	if user == "" {
+		return nil
+	}
+	key := userKey{siteKey, user}
+	ub, ok := s.users[key]
+	if !ok {
+		ub = &UserBalance{SiteKey: siteKey, Name: user}
+		s.users[key] = ub
+	}
+	ub.Total += hashes
+	return nil
+}
+
+// Token implements HashStore
+func (s *MemoryHashStore) Token(token string) (*TokenBalance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tb, ok := s.tokens[token]
+	if !ok {
+		return nil, nil
+	}
+	copied := *tb
+	return &copied, nil
+}
+
+// RedeemToken implements HashStore
+func (s *MemoryHashStore) RedeemToken(siteKey, token string, hashes uint64) (*TokenBalance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tb, ok := s.tokens[token]
+	if !ok || tb.SiteKey != siteKey {
+		return nil, nil
+	}
+	if tb.Hashes >= hashes {
+		delete(s.tokens, token)
+	}
+	copied := *tb
+	return &copied, nil
+}
+
+// User implements HashStore
+func (s *MemoryHashStore) User(siteKey, name string) (*UserBalance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ub, ok := s.users[userKey{siteKey, name}]
+	if !ok {
+		return nil, nil
+	}
+	copied := *ub
+	return &copied, nil
+}
+
+// Withdraw implements HashStore
+func (s *MemoryHashStore) Withdraw(siteKey, name string, amount uint64) (*UserBalance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ub, ok := s.users[userKey{siteKey, name}]
+	if !ok || ub.Balance() < amount {
+		return nil, ErrInsufficientFunds
+	}
+	ub.Withdrawn += amount
+	copied := *ub
+	return &copied, nil
+}
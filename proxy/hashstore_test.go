@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryHashStore(t *testing.T) {
+	s := NewMemoryHashStore()
+	created := time.Now()
+	require.NoError(t, s.NewToken("site", "token", created))
+
+	require.NoError(t, s.Credit("site", "token", "alice", 1000))
+	require.NoError(t, s.Credit("site", "token", "", 500))
+	// unknown tokens still count for the user
+	require.NoError(t, s.Credit("site", "gone", "alice", 200))
+	require.NoError(t, s.Credit("other", "gone", "alice", 7))
+
+	tb, err := s.Token("token")
+	require.NoError(t, err)
+	require.Equal(t, &TokenBalance{SiteKey: "site", Hashes: 1500, Created: created}, tb)
+	tb, err = s.Token("gone")
+	require.NoError(t, err)
+	require.Nil(t, tb)
+
+	// a token is only redeemed once it has done enough hashes, and only by its own site
+	tb, err = s.RedeemToken("other", "token", 1500)
+	require.NoError(t, err)
+	require.Nil(t, tb)
+	tb, _ = s.RedeemToken("site", "token", 1501)
+	require.Equal(t, uint64(1500), tb.Hashes)
+	tb, _ = s.RedeemToken("site", "token", 1500)
+	require.Equal(t, uint64(1500), tb.Hashes)
+	tb, _ = s.RedeemToken("site", "token", 1500)
+	require.Nil(t, tb)
+	require.NoError(t, s.NewToken("site", "token", created))
+
+	ub, err := s.User("site", "alice")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1200), ub.Balance())
+	ub, err = s.User("site", "bob")
+	require.NoError(t, err)
+	require.Nil(t, ub)
+
+	ub, err = s.Withdraw("site", "alice", 1000)
+	require.NoError(t, err)
+	require.Equal(t, &UserBalance{SiteKey: "site", Name: "alice", Total: 1200, Withdrawn: 1000}, ub)
+	_, err = s.Withdraw("site", "alice", 201)
+	require.Equal(t, ErrInsufficientFunds, err)
+	_, err = s.Withdraw("site", "bob", 1)
+	require.Equal(t, ErrInsufficientFunds, err)
+	ub, _ = s.User("other", "alice")
+	require.Equal(t, uint64(7), ub.Balance())
+
+	// old tokens are forgotten when new ones are made
+	require.NoError(t, s.NewToken("site", "later", created.Add(tokenLifetime)))
+	tb, _ = s.Token("token")
+	require.Nil(t, tb)
+}
@@ -3,6 +3,7 @@ package proxy
 import (
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"math"
 
@@ -23,16 +24,40 @@ var (
 	ErrUnknownTargetFormat = errors.New("unrecognized format for job target")
 )
 
+// jobFields are the job fields that are not passed on to workers as extras.  The pool's "id"
+// identifies the proxy's login, which is no business of the workers.
+var jobFields = []string{"blob", "job_id", "target", "algo", "height", "seed_hash", "id", "reserved_offset", "template"}
+
 // Job is a mining job.  Break it up and send chunks to workers.
 type Job struct {
 	Blob   string `json:"blob"`
 	ID     string `json:"job_id"`
 	Target string `json:"target"`
 
-	submittedNonces []string `json:"-"`
-	initialNonce    uint32   `json:"-"`
-	currentBlob     []byte   `json:"-"`
-	currentNonce    uint32   `json:"-"`
+	// sent by RandomX pools.  Miners need the seed hash (the RandomX key) to hash at all.
+	Algo     string `json:"algo,omitempty"`
+	Height   uint64 `json:"height,omitempty"`
+	SeedHash string `json:"seed_hash,omitempty"`
+
+	// ReservedOffset is where the pool left space in the blob for the proxy's extra nonce, if it
+	// did.  It is only used if the pool says which share field the extra nonce goes in, and it
+	// isn't sent on to workers.
+	ReservedOffset int `json:"-"`
+	// extraNonceField is the share field the pool wants the extra nonce in
+	extraNonceField string
+
+	// Extra holds any other fields the pool sent, which are passed on to workers as is
+	Extra map[string]interface{} `json:"-"`
+
+	// template is the daemon's block template, for jobs from a daemon.  Each worker's blob is
+	// made from it.
+	template *blockTemplate
+
+	// shares belong to the job, so they are forgotten as soon as the job is replaced
+	shares       *shareSet `json:"-"`
+	initialNonce uint32    `json:"-"`
+	currentBlob  []byte    `json:"-"`
+	currentNonce uint32    `json:"-"`
 }
 
 // NewJobFromServer creates a Job from a pool notice
@@ -48,6 +73,18 @@ func NewJobFromServer(job map[string]interface{}) (*Job, error) {
 	if j.Target, ok = job["target"].(string); !ok {
 		return nil, ErrMalformedJob
 	}
+	// optional, not every pool is on RandomX
+	j.Algo, _ = job["algo"].(string)
+	j.SeedHash, _ = job["seed_hash"].(string)
+	if height, ok := job["height"].(float64); ok && height > 0 {
+		j.Height = uint64(height)
+	}
+	if offset, ok := job["reserved_offset"].(float64); ok && offset > 0 {
+		j.ReservedOffset = int(offset)
+	}
+	// only jobs made by the daemon client have a template, pools can't send one
+	j.template, _ = job["template"].(*blockTemplate)
+	j.Extra = extraJobFields(job)
 
 	if err := j.init(); err != nil {
 		return nil, err
@@ -56,12 +93,78 @@ func NewJobFromServer(job map[string]interface{}) (*Job, error) {
 	return j, nil
 }
 
+// extraJobFields picks out the fields that Job doesn't know about
+func extraJobFields(job map[string]interface{}) map[string]interface{} {
+	var extra map[string]interface{}
+	for k, v := range job {
+		if isJobField(k) {
+			continue
+		}
+		if extra == nil {
+			extra = make(map[string]interface{})
+		}
+		extra[k] = v
+	}
+	return extra
+}
+
+func isJobField(name string) bool {
+	for _, f := range jobFields {
+		if name == f {
+			return true
+		}
+	}
+	return false
+}
+
+// UnmarshalJSON keeps unknown fields as extras.  Jobs in login replies are decoded this way.
+func (j *Job) UnmarshalJSON(b []byte) error {
+	type job Job
+	if err := json.Unmarshal(b, (*job)(j)); err != nil {
+		return err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+	// not sent on to workers, so it isn't in the JSON that Job makes
+	if offset, ok := fields["reserved_offset"].(float64); ok && offset > 0 {
+		j.ReservedOffset = int(offset)
+	}
+	j.Extra = extraJobFields(fields)
+	return nil
+}
+
+// MarshalJSON includes the extra fields alongside the known ones
+func (j Job) MarshalJSON() ([]byte, error) {
+	type job Job // without the methods, so it is marshalled normally
+	known, err := json.Marshal(job(j))
+	if err != nil || len(j.Extra) == 0 {
+		return known, err
+	}
+
+	fields := make(map[string]interface{}, len(j.Extra)+len(jobFields))
+	for k, v := range j.Extra {
+		fields[k] = v
+	}
+	var knownFields map[string]json.RawMessage
+	if err := json.Unmarshal(known, &knownFields); err != nil {
+		return nil, err
+	}
+	for k, v := range knownFields {
+		fields[k] = v
+	}
+
+	return json.Marshal(fields)
+}
+
 func (j *Job) init() error {
 	currentNonce, currentBlob, err := j.Nonce()
 	if err != nil {
 		return err
 	}
-	j.submittedNonces = make([]string, 0)
+	j.checkReservedSpace(currentBlob)
+	j.shares = newShareSet()
 	j.currentNonce = currentNonce
 	j.initialNonce = currentNonce
 	j.currentBlob = currentBlob
@@ -73,8 +176,13 @@ func (j *Job) init() error {
 // and increments the nonce
 func (j *Job) Next() *Job {
 	nextJob := &Job{
-		ID:     j.ID,
-		Target: j.Target,
+		ID:       j.ID,
+		Target:   j.Target,
+		Algo:     j.Algo,
+		Height:   j.Height,
+		SeedHash: j.SeedHash,
+		// never modified after the job is received, so it can be shared
+		Extra: j.Extra,
 	}
 
 	nonceBytes := make([]byte, nonceLength, nonceLength)
@@ -93,9 +201,9 @@ func (j *Job) Next() *Job {
 // NewJob builds a job for distribution to a worker
 func NewJob(blobBytes []byte, nonce uint32, id, target string) *Job {
 	j := &Job{
-		ID:              id,
-		Target:          target,
-		submittedNonces: make([]string, 0),
+		ID:     id,
+		Target: target,
+		shares: newShareSet(),
 	}
 	nonceBytes := make([]byte, nonceLength, nonceLength)
 	binary.BigEndian.PutUint32(nonceBytes, nonce)
@@ -118,21 +226,55 @@ func (j *Job) Nonce() (nonce uint32, blobBytes []byte, err error) {
 	return
 }
 
-// can we count on uint32 hex targets?
-// NOT WORKING PROPERLY
-func (j *Job) getTargetUint64() (uint64, error) {
-	target := j.Target
-	if len(target) == 8 {
-		target += "00000000"
+// blobWithNonce returns the job blob as the worker hashed it, with its extra nonce (if the job
+// has one) and the nonce it found
+func (j *Job) blobWithNonce(extraNonce, nonce string) ([]byte, error) {
+	blobBytes, err := hex.DecodeString(j.Blob)
+	if err != nil {
+		return nil, err
 	}
-	if len(target) != 16 {
-		logger.Get().Println("Job target format is : ", target)
-		return 0, ErrUnknownTargetFormat
+	nonceBytes, err := hex.DecodeString(nonce)
+	if err != nil || len(nonceBytes) != nonceLength || len(blobBytes) < nonceOffset+nonceLength {
+		return nil, ErrMalformedShare
 	}
-	targetBytes, err := hex.DecodeString(target)
+	if j.hasExtraNonce() {
+		extraNonceBytes, err := hex.DecodeString(extraNonce)
+		if err != nil || len(extraNonceBytes) != extraNonceLength {
+			return nil, ErrMalformedShare
+		}
+		if blobBytes, err = j.extraNonceBlob(extraNonceBytes); err != nil {
+			return nil, ErrMalformedShare
+		}
+	}
+	copy(blobBytes[nonceOffset:], nonceBytes)
+
+	return blobBytes, nil
+}
+
+// getTargetUint64 decodes the little endian job target.  Pools send either the full 64 bit target,
+// or a compact 32 bit target, which is expanded the same way xmrig does it:
+// the 32 bit difficulty is carried over to 64 bits.
+func (j *Job) getTargetUint64() (uint64, error) {
+	targetBytes, err := hex.DecodeString(j.Target)
 	if err != nil {
 		return 0, err
 	}
 
-	return binary.BigEndian.Uint64(targetBytes), nil
+	switch len(targetBytes) {
+	case 4:
+		target := binary.LittleEndian.Uint32(targetBytes)
+		if target == 0 {
+			return 0, ErrUnknownTargetFormat
+		}
+		return math.MaxUint64 / (math.MaxUint32 / uint64(target)), nil
+	case 8:
+		target := binary.LittleEndian.Uint64(targetBytes)
+		if target == 0 {
+			return 0, ErrUnknownTargetFormat
+		}
+		return target, nil
+	}
+
+	logger.Get().Println("Job target format is : ", j.Target)
+	return 0, ErrUnknownTargetFormat
 }
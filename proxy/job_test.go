@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/trey-jones/stratum"
+)
+
+const testJobBlob = "0b0b98bea7e805e0010a2126d287a2a0cc833d312cb786385a7c2f9de69d25537f584a9bc9977b00000000666fd8753bf61a8631f12984e3fd44f4014eca629276817b56f32e9b68bd82f416"
+
+// bufferConn lets a codec write to a buffer
+type bufferConn struct {
+	bytes.Buffer
+}
+
+func (bufferConn) Close() error { return nil }
+
+// notifier is the part of the stratum server codecs used to send jobs
+type notifier interface {
+	Notify(method string, args interface{}) error
+}
+
+func TestJobFieldsPassThrough(t *testing.T) {
+	poolJob := map[string]interface{}{
+		"blob":      testJobBlob,
+		"job_id":    "123",
+		"target":    "b88d0600",
+		"id":        "pool-login-id",
+		"algo":      "rx/0",
+		"height":    float64(2500000),
+		"seed_hash": "d1b8f8c52fcbb0ad2c9ba25e7d72e5b1d6a6e11a62ea5e0e4f32fd0e8f4e1f5a",
+		"something": map[string]interface{}{"new": true},
+	}
+	j, err := NewJobFromServer(poolJob)
+	require.NoError(t, err)
+	require.Equal(t, "rx/0", j.Algo)
+	require.Equal(t, uint64(2500000), j.Height)
+	require.Equal(t, map[string]interface{}{"something": map[string]interface{}{"new": true}}, j.Extra)
+
+	codecs := map[string]func(*bufferConn) notifier{
+		"default": func(c *bufferConn) notifier {
+			return stratum.NewDefaultServerCodec(c).(*stratum.DefaultServerCodec)
+		},
+		"coinhive": func(c *bufferConn) notifier {
+			return stratum.NewCoinhiveServerCodec(c).(*stratum.CoinhiveServerCodec)
+		},
+	}
+	for name, newCodec := range codecs {
+		conn := &bufferConn{}
+		require.NoError(t, newCodec(conn).Notify("job", j.Next()), name)
+
+		var notification struct {
+			Params map[string]interface{} `json:"params"`
+		}
+		require.NoError(t, json.Unmarshal(conn.Bytes(), &notification), name)
+		sent := notification.Params
+		require.Equal(t, "123", sent["job_id"], name)
+		require.Equal(t, "rx/0", sent["algo"], name)
+		require.Equal(t, float64(2500000), sent["height"], name)
+		require.Equal(t, poolJob["seed_hash"], sent["seed_hash"], name)
+		require.Equal(t, poolJob["something"], sent["something"], name)
+		require.NotContains(t, sent, "id", name)
+	}
+}
+
+func TestJobFromLoginReply(t *testing.T) {
+	reply := LoginReply{}
+	err := json.Unmarshal([]byte(`{"id":"1","status":"OK","job":{"blob":"`+testJobBlob+`","job_id":"1","target":"b88d0600","seed_hash":"abcd","height":10,"extra":"field"}}`), &reply)
+	require.NoError(t, err)
+	require.NoError(t, reply.Job.init())
+	require.Equal(t, "abcd", reply.Job.SeedHash)
+	require.Equal(t, uint64(10), reply.Job.Height)
+
+	next, err := json.Marshal(reply.Job.Next())
+	require.NoError(t, err)
+	var sent map[string]interface{}
+	require.NoError(t, json.Unmarshal(next, &sent))
+	require.Equal(t, "field", sent["extra"])
+	require.Equal(t, "abcd", sent["seed_hash"])
+
+	// older pools send none of the optional fields, and none are sent on
+	j := &Job{Blob: testJobBlob, ID: "1", Target: "b88d0600"}
+	require.NoError(t, j.init())
+	next, err = json.Marshal(j.Next())
+	require.NoError(t, err)
+	sent = nil
+	require.NoError(t, json.Unmarshal(next, &sent))
+	require.Len(t, sent, 3)
+}
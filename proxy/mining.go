@@ -5,6 +5,7 @@ import (
 	"strconv"
 
 	"github.com/sourcegraph/jsonrpc2"
+	"github.com/trey-jones/xmrwasp/config"
 	"github.com/trey-jones/xmrwasp/logger"
 )
 
@@ -35,14 +36,16 @@ func (p *PassThruParams) SetContext(ctx context.Context) {
 
 type AuthReply struct {
 	Token  string `json:"token"`
-	Hashes string `json:"hashes"`
+	Hashes uint64 `json:"hashes"`
 }
 
 type LoginReply struct {
-	ID     string          `json:"id"`
-	Job    *Job            `json:"job"`
-	Status string          `json:"status"`
-	Error  *jsonrpc2.Error `json:"error,omitempty"`
+	ID     string `json:"id"`
+	Job    *Job   `json:"job"`
+	Status string `json:"status"`
+	// Extensions are the protocol extensions that the proxy supports
+	Extensions []string        `json:"extensions,omitempty"`
+	Error      *jsonrpc2.Error `json:"error,omitempty"`
 }
 
 type StatusReply struct {
@@ -57,12 +60,31 @@ func (m *Mining) getWorker(ctx context.Context) Worker {
 	return ctx.Value("worker").(Worker)
 }
 
-// Auth is special login method for Coinhive miners
+// Auth is special login method for Coinhive miners.  Miners with an unknown site key are
+// turned away, and the rest mine with the login of their site, if it has one.
 func (m *Mining) Auth(p PassThruParams, resp *AuthReply) error {
 	worker := m.getWorker(p.Context())
+	siteKey, _ := p["site_key"].(string)
+	user, _ := p["user"].(string)
+	worker.Proxy().touch(worker)
+	worker.Proxy().identify(worker, user, "", "")
+
+	token, moved, err := worker.Proxy().authorize(worker, siteKey, config.Get().SiteKeys)
+	if err != nil {
+		if r, ok := worker.(Rejecter); ok {
+			r.Reject(err.Error())
+		}
+		return err
+	}
+	resp.Token = token
+	resp.Hashes = worker.Proxy().workerState(worker).sessionHashes()
+	if moved {
+		// the new proxy has already sent a job
+		return nil
+	}
 	defer func() {
 		// not doing this async seems to confuse the RPC server
-		go worker.NewJob(worker.Proxy().NextJob())
+		go worker.NewJob(worker.Proxy().NextJob(worker))
 	}()
 
 	return nil
@@ -70,16 +92,38 @@ func (m *Mining) Auth(p PassThruParams, resp *AuthReply) error {
 
 func (m *Mining) Login(p PassThruParams, resp *LoginReply) error {
 	worker := m.getWorker(p.Context())
-	resp.Job = worker.Proxy().NextJob()
+	login, _ := p["login"].(string)
+	rigID, _ := p["rigid"].(string)
+	agent, _ := p["agent"].(string)
+	worker.Proxy().touch(worker)
+	worker.Proxy().identify(worker, login, rigID, agent)
+	worker.Proxy().workerState(worker).setAlgos(algoList(p["algo"]))
+	// the reply lists the nicehash extension, so the worker can be held to it
+	worker.Proxy().useNiceHash(worker)
+
+	// a worker that can't mine what the pool mines goes to a pool that it can
+	if _, err := worker.Proxy().routeAlgo(worker, config.Get()); err != nil {
+		logger.Get().Printf("Turning away worker %v: %v\n", worker.RemoteAddr(), err)
+		return err
+	}
+	job := worker.Proxy().NextJob(worker)
+	if err := worker.Proxy().checkAlgo(worker); err != nil {
+		// the pool mines something other than its profile says
+		logger.Get().Printf("Turning away worker %v: %v\n", worker.RemoteAddr(), err)
+		return err
+	}
+	resp.Job = job
 	resp.ID = strconv.Itoa(int(worker.ID()))
 	resp.Status = "OK"
+	resp.Extensions = worker.Proxy().extensions()
 
 	return nil
 }
 
 func (m *Mining) Getjob(p PassThruParams, resp *Job) error {
 	worker := m.getWorker(p.Context())
-	*resp = *worker.Proxy().NextJob()
+	worker.Proxy().touch(worker)
+	*resp = *worker.Proxy().NextJob(worker)
 
 	return nil
 }
@@ -90,7 +134,8 @@ func (m *Mining) Getjob(p PassThruParams, resp *Job) error {
 // But the coinhive miner doesn't care, it just doesn't keep up with submissions.
 func (m *Mining) Submit(p PassThruParams, resp *StatusReply) error {
 	worker := m.getWorker(p.Context())
-	status, err := worker.Proxy().Submit(p)
+	worker.Proxy().touch(worker)
+	status, err := worker.Proxy().Submit(worker, p)
 	if err != nil {
 		return err
 	}
@@ -100,8 +145,12 @@ func (m *Mining) Submit(p PassThruParams, resp *StatusReply) error {
 }
 
 // Keepalived lets the client tell you they're still there, and you get to say "I'm still here too"
-// Right now, we don't keep track of idle connections, so this doesn't really matter.
+// Workers that don't submit shares need to send this to avoid being disconnected for being idle.
+// xmrig sends the id from its login reply, but the worker is known by its connection, so an id
+// from before the worker was moved to another proxy is fine.
 func (m *Mining) Keepalived(p PassThruParams, resp *StatusReply) error {
+	worker := m.getWorker(p.Context())
+	worker.Proxy().touch(worker)
 	resp.Status = "KEEPALIVED"
 	return nil
 }
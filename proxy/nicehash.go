@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"errors"
+	"sync/atomic"
+)
+
+const (
+	// in nicehash mode each worker on a proxy has its own value of the top nonce byte
+	niceHashWorkers = 256
+	// the nonce is little endian, so its top byte is the last one
+	reservedNonceOffset = nonceOffset + nonceLength - 1
+)
+
+var (
+	ErrNonceOutOfRange = errors.New("share nonce is outside the worker's range")
+)
+
+// freeNonceByte finds a top nonce byte that none of the proxy's workers have.  Callers must hold workerMu.
+func (p *Proxy) freeNonceByte() (byte, bool) {
+	var used [niceHashWorkers]bool
+	for _, state := range p.states {
+		if b, ok := state.reservedNonce(); ok {
+			used[b] = true
+		}
+	}
+	for b, taken := range used {
+		if !taken {
+			return byte(b), true
+		}
+	}
+	return 0, false
+}
+
+// useNiceHash gives a worker that is told about the nicehash extension its own top nonce byte.
+// Other workers pick their nonces as they like, so they don't get one.  If the proxy has no bytes
+// left, the worker is moved to one that has, without being sent a job.
+func (p *Proxy) useNiceHash(w Worker) {
+	if !p.niceHash {
+		return
+	}
+	ws := p.workerState(w)
+	ws.useNiceHash()
+	p.workerMu.Lock()
+	b, ok := p.freeNonceByte()
+	if ok {
+		ws.reserveNonce(b)
+	}
+	p.workerMu.Unlock()
+	if !ok {
+		p.transfer(w, p.director.nextProxy(p.group))
+	}
+}
+
+// capacity is the most workers the proxy can have.  Safe for concurrent use.
+func (p *Proxy) capacity() int {
+	switch {
+	case p.niceHash:
+		return niceHashWorkers
+	case atomic.LoadInt32(&p.extraNonceJobs) == 1:
+		return maxExtraNonceWorkers
+	}
+	return maxProxyWorkers
+}
+
+// reserveNonce starts the job nonce at the bottom of the worker's range.  Miners in nicehash
+// mode leave the top byte alone.
+func (j *Job) reserveNonce(b byte) error {
+	blob, err := hex.DecodeString(j.Blob)
+	if err != nil || len(blob) <= reservedNonceOffset {
+		return ErrMalformedJob
+	}
+	for i := nonceOffset; i < reservedNonceOffset; i++ {
+		blob[i] = 0
+	}
+	blob[reservedNonceOffset] = b
+	j.Blob = hex.EncodeToString(blob)
+	return nil
+}
+
+// checkReservedNonce makes sure a share nonce is in the worker's range
+func checkReservedNonce(nonce string, b byte) error {
+	nonceBytes, err := hex.DecodeString(nonce)
+	if err != nil || len(nonceBytes) != nonceLength {
+		return ErrMalformedShare
+	}
+	if nonceBytes[nonceLength-1] != b {
+		return ErrNonceOutOfRange
+	}
+	return nil
+}
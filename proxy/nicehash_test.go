@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFreeNonceByte(t *testing.T) {
+	p := &Proxy{niceHash: true, states: map[uint64]*workerState{1: {}, 2: {}, 3: {}}}
+	p.states[1].reserveNonce(0)
+	p.states[2].reserveNonce(2)
+
+	b, ok := p.freeNonceByte()
+	require.True(t, ok)
+	require.Equal(t, byte(1), b)
+
+	p.states = make(map[uint64]*workerState)
+	for i := 0; i < niceHashWorkers; i++ {
+		p.states[uint64(i)] = &workerState{}
+		p.states[uint64(i)].reserveNonce(byte(i))
+	}
+	_, ok = p.freeNonceByte()
+	require.False(t, ok)
+	require.Equal(t, niceHashWorkers, p.capacity())
+}
+
+func TestUseNiceHash(t *testing.T) {
+	w := &testWorker{id: 1}
+	p := &Proxy{states: map[uint64]*workerState{1: {}, 2: {}}}
+	p.states[2].reserveNonce(0)
+
+	// workers are only held to a nonce byte in nicehash mode
+	p.useNiceHash(w)
+	_, ok := p.states[1].reservedNonce()
+	require.False(t, ok)
+	require.False(t, p.states[1].usesNiceHash())
+
+	p.niceHash = true
+	p.useNiceHash(w)
+	b, ok := p.states[1].reservedNonce()
+	require.True(t, ok)
+	require.Equal(t, byte(1), b)
+	require.True(t, p.states[1].usesNiceHash())
+}
+
+func TestReservedNonce(t *testing.T) {
+	j := &Job{Blob: testJobBlob}
+	require.NoError(t, j.reserveNonce(0xab))
+	require.Equal(t, "000000ab", j.Blob[nonceOffset*2:(nonceOffset+nonceLength)*2])
+	require.Equal(t, testJobBlob[:nonceOffset*2], j.Blob[:nonceOffset*2])
+
+	ws := &workerState{}
+	require.NoError(t, ws.checkNonce("12345678"))
+	ws.reserveNonce(0xab)
+	require.NoError(t, ws.checkNonce("123456ab"))
+	require.Equal(t, ErrNonceOutOfRange, ws.checkNonce("12345678"))
+	require.Equal(t, ErrMalformedShare, ws.checkNonce("56ab"))
+
+	require.Equal(t, ErrMalformedJob, (&Job{Blob: "00"}).reserveNonce(1))
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/trey-jones/stratum"
+	"github.com/trey-jones/xmrwasp/config"
+)
+
+var (
+	ErrBadPoolCA          = errors.New("no certificates found in pool CA file")
+	ErrFingerprintInvalid = errors.New("pool certificate does not match pinned fingerprint")
+)
+
+// dialPool connects to the pool, using TLS if the pool asks for it.
+func dialPool(pool config.Pool) (*stratum.Client, error) {
+	if !pool.TLS {
+		return stratum.DialTimeout("tcp", pool.URL, poolDialTimeout)
+	}
+	tlsConf, err := poolTLSConfig(pool, config.Get().PoolCA)
+	if err != nil {
+		return nil, err
+	}
+
+	return dialTLS(pool, tlsConf)
+}
+
+func dialTLS(pool config.Pool, tlsConf *tls.Config) (*stratum.Client, error) {
+	dialer := &net.Dialer{Timeout: poolDialTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", pool.URL, tlsConf)
+	if err != nil {
+		return nil, err
+	}
+
+	return stratum.NewClient(conn), nil
+}
+
+// poolTLSConfig builds the client TLS config for a pool.
+// If the pool has a pinned fingerprint, the certificate must match it, and the usual chain
+// verification is skipped, since pools often use self-signed certificates.
+// Otherwise the certificate is verified against the system roots, or caFile if it is given.
+func poolTLSConfig(pool config.Pool, caFile string) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(pool.URL)
+	if err != nil {
+		return nil, err
+	}
+	tlsConf := &tls.Config{ServerName: host}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, ErrBadPoolCA
+		}
+		tlsConf.RootCAs = roots
+	}
+
+	if pool.TLSFingerprint != "" {
+		fingerprint := normalizeFingerprint(pool.TLSFingerprint)
+		tlsConf.InsecureSkipVerify = true
+		tlsConf.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return ErrFingerprintInvalid
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if hex.EncodeToString(sum[:]) != fingerprint {
+				return ErrFingerprintInvalid
+			}
+			return nil
+		}
+	}
+
+	return tlsConf, nil
+}
+
+// fingerprints are often copied with colons and in upper case
+func normalizeFingerprint(f string) string {
+	return strings.ToLower(strings.Replace(f, ":", "", -1))
+}
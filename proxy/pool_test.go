@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/trey-jones/stratum"
+	"github.com/trey-jones/xmrwasp/config"
+)
+
+type tlsMockPool struct{}
+
+func (m *tlsMockPool) Login(p map[string]interface{}, resp *LoginReply) error {
+	resp.ID = "tls"
+	resp.Status = "OK"
+	return nil
+}
+
+// startTLSMockPool serves a stratum pool over TLS with a fresh self-signed certificate for localhost
+func startTLSMockPool(t *testing.T) (addr string, cert *x509.Certificate, stop func()) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err = x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	tlsConf := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+	listener, err := tls.Listen("tcp", "localhost:0", tlsConf)
+	require.NoError(t, err)
+
+	s := stratum.NewServer()
+	s.RegisterName("mining", &tlsMockPool{})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.ServeCodec(stratum.NewDefaultServerCodec(conn))
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return net.JoinHostPort("localhost", port), cert, func() { listener.Close() }
+}
+
+func testTLSLogin(pool config.Pool, caFile string) error {
+	tlsConf, err := poolTLSConfig(pool, caFile)
+	if err != nil {
+		return err
+	}
+	sc, err := dialTLS(pool, tlsConf)
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+
+	reply := LoginReply{}
+	err = sc.Call("login", map[string]interface{}{"login": "x", "pass": "x"}, &reply)
+	if err != nil {
+		return err
+	}
+	if reply.ID != "tls" {
+		return errors.New("login reached the wrong pool")
+	}
+	return nil
+}
+
+func TestTLSPoolFingerprint(t *testing.T) {
+	addr, cert, stop := startTLSMockPool(t)
+	defer stop()
+	sum := sha256.Sum256(cert.Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	pool := config.Pool{URL: addr, TLS: true, TLSFingerprint: fingerprint}
+	require.NoError(t, testTLSLogin(pool, ""))
+
+	// pinning is indifferent to case and colons
+	colons := ""
+	for i := 0; i < len(fingerprint); i += 2 {
+		if i > 0 {
+			colons += ":"
+		}
+		colons += fingerprint[i : i+2]
+	}
+	pool.TLSFingerprint = colons
+	require.NoError(t, testTLSLogin(pool, ""))
+
+	pool.TLSFingerprint = hex.EncodeToString(make([]byte, sha256.Size))
+	require.Error(t, testTLSLogin(pool, ""))
+}
+
+func TestTLSPoolCA(t *testing.T) {
+	addr, cert, stop := startTLSMockPool(t)
+	defer stop()
+
+	pool := config.Pool{URL: addr, TLS: true}
+	// self-signed, so system roots should refuse it
+	require.Error(t, testTLSLogin(pool, ""))
+
+	f, err := ioutil.TempFile("", "poolca")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	require.NoError(t, pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	f.Close()
+	require.NoError(t, testTLSLogin(pool, f.Name()))
+
+	empty, err := ioutil.TempFile("", "poolca")
+	require.NoError(t, err)
+	defer os.Remove(empty.Name())
+	empty.Close()
+	_, err = poolTLSConfig(pool, empty.Name())
+	require.Equal(t, ErrBadPoolCA, err)
+}
@@ -1,15 +1,20 @@
 package proxy
 
 import (
+	"context"
 	"errors"
+	"io"
 	"math"
+	"net/rpc"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/trey-jones/stratum"
 	"github.com/trey-jones/xmrwasp/config"
 	"github.com/trey-jones/xmrwasp/logger"
+	"github.com/trey-jones/xmrwasp/metrics"
 )
 
 const (
@@ -20,19 +25,26 @@ const (
 	maxProxyWorkers = 1024
 
 	retryDelay = 60 * time.Second
+	// pools that don't answer quickly are skipped in favor of the next one
+	poolDialTimeout = 10 * time.Second
 
 	donateCycle time.Duration = 3600 // seconds
 	// amount of time to keep the donate connection open after donation ends
 	donateShutdownDelay = 30 * time.Second
-	donateTimeout       = 10 * time.Second
+	// the donation server is another XMR WASP, on its TLS stratum port
+	donateURL = "donate.xmrwasp.com:1112"
 
 	keepAliveInterval = 5 * time.Minute
+
+	// idle workers and workers past their lifetime are disconnected this often
+	workerCheckInterval = 30 * time.Second
 )
 
 var (
 	ErrBadJobID       = errors.New("invalid job id")
 	ErrDuplicateShare = errors.New("duplicate share")
 	ErrMalformedShare = errors.New("malformed share")
+	ErrProxyClosing   = errors.New("proxy is shutting down")
 )
 
 // Worker does the work for the proxy.  It exposes methods that allow interface with the proxy.
@@ -52,33 +64,52 @@ type Worker interface {
 	Disconnect()
 
 	NewJob(*Job)
+
+	// RemoteAddr and Transport describe the worker's connection, eg. "203.0.113.7:51234" and "tcp"
+	RemoteAddr() string
+	Transport() string
+	// Listener is the listener the worker connected to
+	Listener() config.Listener
 }
 
 // Proxy manages a group of workers.
 type Proxy struct {
 	ID       uint64
-	SC       *stratum.Client
-	DC       *stratum.Client
+	SC       Upstream
+	DC       Upstream
 	SS       *stratum.Server
 	director *Director
+	// group decides which pools the proxy mines on, and how much it donates
+	group group
+	// niceHash gives each worker its own top nonce byte
+	niceHash bool
+	// extraNonceJobs is 1 while the pool's jobs have space for an extra nonce.  Use atomic.
+	extraNonceJobs int32
 
 	authID     string // identifies the proxy to the pool
+	pool       config.Pool
+	poolIndex  int // position of pool in the configured list - 0 is the preferred pool
 	aliveSince time.Time
 	shares     uint64
+	rejected   uint64
 
 	workerCount int
 
 	// workers have to be ID'd so they can be removed when they die
 	workerIDs chan uint64
 	workers   map[uint64]Worker
+	// workers are only changed by the run loop, but may be read elsewhere
+	workerMu sync.RWMutex
+	// states are kept from Add until the worker is removed, also under workerMu
+	states map[uint64]*workerState
 
 	donateInterval time.Duration
 	donateLength   time.Duration
 	donating       bool
-	donateAddr     string
+	donatePool     config.Pool
 
 	addWorker chan Worker
-	delWorker chan Worker
+	delWorker chan uint64
 
 	submissions chan *share
 	donations   chan *share
@@ -86,7 +117,19 @@ type Proxy struct {
 	notify  chan stratum.Notification
 	dnotify chan stratum.Notification // donation jobs
 
-	ready bool
+	// ready and draining are under workerMu.  A draining proxy is having its workers moved elsewhere.
+	ready    bool
+	draining bool
+	// done is closed when the run loop exits, and stop makes it exit
+	done     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	// reload tells the run loop to apply a new config
+	reload chan struct{}
+
+	// Submit holds a read lock while the share is in flight, so that Shutdown can wait for them
+	submitMu sync.RWMutex
+	closing  bool
 
 	currentJob *Job
 	prevJob    *Job
@@ -94,17 +137,26 @@ type Proxy struct {
 	donateJob     *Job
 	prevDonateJob *Job
 
-	jobMu     sync.Mutex
-	jobWaiter *sync.WaitGroup // waits for the first job
+	jobMu      sync.Mutex
+	jobWaiter  *sync.WaitGroup // waits for the first job
+	jobRelease sync.Once
 }
 
 // New creates a new proxy, starts the work thread, and returns a pointer to it.
 func New(id uint64) *Proxy {
+	return newProxy(id, group{})
+}
+
+// newProxy creates a proxy for workers in group g
+func newProxy(id uint64, g group) *Proxy {
 	p := &Proxy{
 		ID:         id,
+		group:      g,
+		niceHash:   config.Get().JobMode == config.JobModeNiceHash,
 		aliveSince: time.Now(),
 		workerIDs:  make(chan uint64, 5),
 		workers:    make(map[uint64]Worker),
+		states:     make(map[uint64]*workerState),
 
 		currentJob:    &Job{},
 		prevJob:       &Job{},
@@ -112,12 +164,15 @@ func New(id uint64) *Proxy {
 		prevDonateJob: &Job{},
 
 		addWorker: make(chan Worker),
-		delWorker: make(chan Worker, 1),
+		delWorker: make(chan uint64, 1),
 
 		submissions: make(chan *share),
 		donations:   make(chan *share),
 
 		ready:     true,
+		done:      make(chan struct{}),
+		stop:      make(chan struct{}),
+		reload:    make(chan struct{}, 1),
 		donating:  false,
 		jobWaiter: &sync.WaitGroup{},
 	}
@@ -140,32 +195,64 @@ func (p *Proxy) generateIDs() {
 
 	for {
 		currentWorkerID++
-		p.workerIDs <- currentWorkerID
+		select {
+		case p.workerIDs <- currentWorkerID:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// failbackTicker ticks when a proxy on a fallback pool should check for a better one.  It is nil
+// when failback is turned off.
+func failbackTicker(interval time.Duration) *time.Ticker {
+	if interval <= 0 {
+		return nil
+	}
+	return time.NewTicker(interval)
+}
+
+// tickerC is the ticker's channel, or nil (which never ticks) if there is no ticker
+func tickerC(t *time.Ticker) <-chan time.Time {
+	if t == nil {
+		return nil
 	}
+	return t.C
 }
 
-// nextWorkerID returns the next sequential orderID.  It is safe for concurrent use.
+// nextWorkerID returns the next sequential orderID, or 0 if the proxy is shut down.
+// It is safe for concurrent use.
 func (p *Proxy) nextWorkerID() uint64 {
-	return <-p.workerIDs
+	select {
+	case id := <-p.workerIDs:
+		return id
+	case <-p.done:
+		return 0
+	}
 }
 
 func (p *Proxy) run() {
-	for {
-		err := p.login()
-		if err == nil {
-			break
-		}
-		logger.Get().Printf("Failed to acquire pool connection.  Retrying in %s.Error: %s\n", retryDelay, err)
-		// TODO allow fallback pools here
-		<-time.After(retryDelay)
-	}
+	p.connect()
 
 	keepalive := time.NewTicker(keepAliveInterval)
+	workerCheck := time.NewTicker(workerCheckInterval)
+	spinDown := time.Duration(config.Get().SpinDown) * time.Second
+	idle := time.NewTimer(spinDown)
+	if spinDown == 0 {
+		idle.Stop()
+	}
+	failbackInterval := time.Duration(config.Get().FailbackInterval) * time.Second
+	failback := failbackTicker(failbackInterval)
 	donateStart := time.NewTimer(p.donateInterval)
 	donateEnd := time.NewTimer(p.donateLength)
 	donateEnd.Stop() // will be reset after first donate period starts
 	defer func() {
 		keepalive.Stop()
+		workerCheck.Stop()
+		idle.Stop()
+		if failback != nil {
+			failback.Stop()
+		}
 		p.shutdown()
 	}()
 
@@ -181,6 +268,9 @@ func (p *Proxy) run() {
 				logger.Get().Println("Banned IP - killing proxy: ", p.ID)
 				return
 			}
+			if isConnectionError(err) {
+				p.reconnect()
+			}
 		case s := <-p.donations:
 			logger.Get().Debugln("donating share for job: ", s.JobID)
 			err := p.handleSubmit(s, p.DC) // donate server will handle it's own errors
@@ -190,8 +280,35 @@ func (p *Proxy) run() {
 			}
 		case w := <-p.addWorker:
 			p.receiveWorker(w)
-		case w := <-p.delWorker:
-			p.removeWorker(w)
+			idle.Stop()
+		case id := <-p.delWorker:
+			p.removeWorker(id)
+			if p.workerCount == 0 && spinDown > 0 {
+				idle.Reset(spinDown)
+			}
+		case <-p.stop:
+			return
+		case <-p.reload:
+			p.reconfigure(donateStart)
+			if d := time.Duration(config.Get().SpinDown) * time.Second; d != spinDown {
+				spinDown = d
+				idle.Stop()
+				if p.workerCount == 0 && spinDown > 0 {
+					idle.Reset(spinDown)
+				}
+			}
+			if interval := time.Duration(config.Get().FailbackInterval) * time.Second; interval != failbackInterval {
+				failbackInterval = interval
+				if failback != nil {
+					failback.Stop()
+				}
+				failback = failbackTicker(failbackInterval)
+			}
+		case <-idle.C:
+			if p.director.retireProxy(p) {
+				logger.Get().Printf("Spinning down proxy %v, it has had no workers for %v\n", p.ID, spinDown)
+				return
+			}
 
 		// this comes from the stratum client
 		case notif := <-p.notify:
@@ -200,6 +317,12 @@ func (p *Proxy) run() {
 			p.handleNotification(notif, true)
 
 		// these are based on known regular intervals
+		case <-workerCheck.C:
+			p.expireWorkers(time.Now())
+		case <-tickerC(failback):
+			if p.poolIndex > 0 {
+				p.failback()
+			}
 		case <-donateStart.C:
 			// logger.Get().Debugln("Switching to donation server")
 			p.donate()
@@ -216,7 +339,9 @@ func (p *Proxy) run() {
 			if reply.Error != nil {
 				err = reply.Error
 			}
-			if err != nil {
+			if isConnectionError(err) {
+				p.reconnect()
+			} else if err != nil {
 				logger.Get().Println("Received error from keepalive request: ", err)
 				return
 			}
@@ -226,8 +351,8 @@ func (p *Proxy) run() {
 }
 
 func (p *Proxy) donate() {
-	// logger.Get().Debugln("Dialing out to: ", p.donateAddr)
-	dc, err := stratum.DialTimeout("tcp", p.donateAddr, donateTimeout)
+	// logger.Get().Debugln("Dialing out to: ", p.donatePool.URL)
+	dc, err := dialUpstream(p.donatePool)
 	if err != nil {
 		logger.Get().Debugln("failed to connect to donate server")
 		return
@@ -248,6 +373,7 @@ func (p *Proxy) donate() {
 	p.jobMu.Lock()
 	p.donating = true
 	p.jobMu.Unlock()
+	metrics.Donating.Inc()
 	p.dnotify = p.DC.Notifications()
 
 	if err = reply.Job.init(); err != nil {
@@ -261,6 +387,7 @@ func (p *Proxy) undonate() {
 	p.jobMu.Lock()
 	p.donating = false
 	p.jobMu.Unlock()
+	metrics.Donating.Dec()
 	// give client 30 seconds, then DC
 	time.AfterFunc(donateShutdownDelay, func() {
 		// logger.Get().Debugln("Shutting down donation conn")
@@ -270,6 +397,8 @@ func (p *Proxy) undonate() {
 }
 
 func (p *Proxy) handleJob(job *Job) (err error) {
+	prepareVerifier(job)
+	p.setExtraNonceJobs(job)
 	p.jobMu.Lock()
 	p.prevJob, p.currentJob = p.currentJob, job
 	p.jobMu.Unlock()
@@ -284,15 +413,22 @@ func (p *Proxy) handleJob(job *Job) (err error) {
 	return
 }
 
-// broadcast a job to all workers
+// broadcast a job to the workers that can mine it.  The others are moved to a pool they can mine on.
 func (p *Proxy) broadcastJob() {
 	logger.Get().Debugln("Broadcasting new job to connected workers.")
-	for _, w := range p.workers {
-		go w.NewJob(p.NextJob())
+	algo := p.jobAlgo()
+	send, reroute := p.jobRecipients(algo)
+	for _, w := range send {
+		go w.NewJob(p.NextJob(w))
+	}
+	for _, w := range reroute {
+		// moving a worker waits on the run loop, which is broadcasting
+		go p.reroute(w, algo)
 	}
 }
 
 func (p *Proxy) handleDonateJob(job *Job) (err error) {
+	prepareVerifier(job)
 	// we can use the same mutex here right?
 	p.jobMu.Lock()
 	if p.donateJob == nil {
@@ -321,8 +457,13 @@ func (p *Proxy) handleNotification(notif stratum.Notification, donate bool) {
 			break
 		}
 		if !donate {
+			metrics.JobsReceived.With("pool").Inc()
+			p.jobMu.Lock()
+			job.setExtraNonceField(p.pool)
+			p.jobMu.Unlock()
 			err = p.handleJob(job)
 		} else {
+			metrics.JobsReceived.With("donate").Inc()
 			err = p.handleDonateJob(job)
 		}
 		if err != nil {
@@ -338,26 +479,162 @@ func (p *Proxy) handleNotification(notif stratum.Notification, donate bool) {
 	}
 }
 
+// connect logs in to the best available pool, and keeps trying until one of them accepts.
+func (p *Proxy) connect() {
+	for {
+		err := p.login()
+		if err == nil {
+			return
+		}
+		logger.Get().Printf("Failed to acquire pool connection.  Retrying in %s.Error: %s\n", retryDelay, err)
+		select {
+		case <-time.After(retryDelay):
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// reconnect replaces a pool connection that has gone away.
+func (p *Proxy) reconnect() {
+	logger.Get().Println("Lost connection to pool: ", p.pool.URL)
+	metrics.PoolReconnects.Inc()
+	p.connect()
+}
+
+// login walks the pool list in order of priority and stops at the first successful login.
 func (p *Proxy) login() error {
-	sc, err := stratum.Dial("tcp", config.Get().PoolAddr)
+	var err error
+	for i, pool := range p.pools() {
+		if err = p.loginTo(i, pool); err == nil {
+			return nil
+		}
+		logger.Get().Printf("Unable to log in to pool %s: %s\n", pool.URL, err)
+	}
+
+	return err
+}
+
+// failback moves the proxy to a higher priority pool if one has come back.
+func (p *Proxy) failback() {
+	pools := p.pools()
+	for i := 0; i < p.poolIndex && i < len(pools); i++ {
+		if err := p.loginTo(i, pools[i]); err == nil {
+			return
+		}
+		logger.Get().Debugln("Preferred pool is still unavailable: ", pools[i].URL)
+	}
+}
+
+// repool moves the proxy to the best pool in the pool list, after the list has changed.
+// If none of the new pools can be reached, the proxy stays where it is and keeps trying.
+func (p *Proxy) repool() {
+	pools := p.pools()
+	p.jobMu.Lock()
+	current := p.pool
+	p.jobMu.Unlock()
+
+	for i, pool := range pools {
+		if pool == current {
+			p.jobMu.Lock()
+			p.poolIndex = i
+			p.jobMu.Unlock()
+			if i > 0 {
+				p.failback()
+			}
+			return
+		}
+	}
+
+	logger.Get().Println("Pools have changed, moving proxy ", p.ID)
+	if err := p.login(); err != nil {
+		logger.Get().Printf("Unable to move proxy %v to the new pools, staying on %v: %v\n", p.ID, current.URL, err)
+		// failback tries every new pool until one works
+		p.jobMu.Lock()
+		p.poolIndex = len(pools)
+		p.jobMu.Unlock()
+	}
+}
+
+// pools is the pool list for the proxy's group, in order of preference
+func (p *Proxy) pools() config.Pools {
+	pools := config.Get().ProfilePools(p.group.profile)
+	if p.group.login == "" {
+		return pools
+	}
+	sitePools := make(config.Pools, len(pools))
+	for i, pool := range pools {
+		pool.Login = p.group.login
+		if p.group.password != "" {
+			pool.Password = p.group.password
+		}
+		sitePools[i] = pool
+	}
+	return sitePools
+}
+
+// reconfigure applies a reloaded config.  Only called from the run loop.
+func (p *Proxy) reconfigure(donateStart *time.Timer) {
+	p.repool()
+
+	interval, length := p.donateInterval, p.donateLength
+	p.configureDonations()
+	if !p.donating && (interval != p.donateInterval || length != p.donateLength) {
+		donateStart.Stop()
+		donateStart.Reset(p.donateInterval)
+	}
+}
+
+// Reload tells the proxy to apply a reloaded config.  Safe for concurrent use.
+func (p *Proxy) Reload() {
+	select {
+	case p.reload <- struct{}{}:
+	default:
+		// already waiting to reload, and it will see the latest config
+	}
+}
+
+// loginTo replaces the current pool connection, but only if the new pool accepts our login.
+func (p *Proxy) loginTo(index int, pool config.Pool) error {
+	sc, err := dialUpstream(pool)
 	if err != nil {
 		return err
 	}
 	logger.Get().Debugln("Client made pool connection.")
-	p.SC = sc
 
-	p.notify = p.SC.Notifications()
 	params := map[string]interface{}{
-		"login": config.Get().PoolLogin,
-		"pass":  config.Get().PoolPassword,
+		"login": pool.Login,
+		"pass":  pool.Password,
+	}
+	if algos := loginAlgos(pool); algos != nil {
+		params["algo"] = algos
 	}
 	reply := LoginReply{}
-	err = p.SC.Call("login", params, &reply)
+	err = sc.Call("login", params, &reply)
+	if reply.Error != nil {
+		err = reply.Error
+	}
+	if err == nil {
+		err = checkPoolAlgo(pool, reply.Job)
+	}
 	if err != nil {
+		sc.Close()
 		return err
 	}
-	logger.Get().Debugln("Successfully logged into pool.")
+	logger.Get().Debugln("Successfully logged into pool, with extensions: ", reply.Extensions)
+
+	if p.SC != nil {
+		p.SC.Close()
+	}
+	p.SC = sc
+	p.notify = p.SC.Notifications()
+	p.jobMu.Lock()
+	p.pool = pool
+	p.poolIndex = index
 	p.authID = reply.ID
+	p.jobMu.Unlock()
+	metrics.JobsReceived.With("pool").Inc()
+	reply.Job.setExtraNonceField(pool)
 	if err = reply.Job.init(); err != nil {
 		logger.Get().Println("bad job from login: ", reply.Job, "- err: ", err)
 		// still just wait for the next job
@@ -367,54 +644,122 @@ func (p *Proxy) login() error {
 		// this shouldn't happen
 	}
 
-	logger.Get().Printf("****    Connected and logged in to pool server: %s \n", config.Get().PoolAddr)
+	logger.Get().Printf("****    Connected and logged in to pool server: %s \n", pool.URL)
 	logger.Get().Println("****    Broadcasting jobs to workers.")
 
 	// now we have a job, so release jobs
-	p.jobWaiter.Done()
+	p.jobRelease.Do(p.jobWaiter.Done)
+
+	return nil
+}
+
+// isConnectionError is true if err means the pool connection is gone.
+func isConnectionError(err error) bool {
+	return err == rpc.ErrShutdown || err == io.ErrUnexpectedEOF || err == stratum.ErrCallTimedOut ||
+		err == ErrDaemonUnreachable
+}
 
+// findJob returns the job with the given ID, or nil.  Callers outside the run loop must hold jobMu.
+func (p *Proxy) findJob(id string) *Job {
+	for _, j := range []*Job{p.currentJob, p.prevJob, p.donateJob, p.prevDonateJob} {
+		if j != nil && j.ID != "" && j.ID == id {
+			return j
+		}
+	}
 	return nil
 }
 
 func (p *Proxy) validateShare(s *share) error {
-	var job *Job
-	switch {
-	case s.JobID == p.currentJob.ID:
-		job = p.currentJob
-	case s.JobID == p.prevJob.ID:
-		job = p.prevJob
-	case s.JobID == p.donateJob.ID:
-		job = p.donateJob
-	case s.JobID == p.prevDonateJob.ID:
-		job = p.prevDonateJob
-	default:
+	job := p.findJob(s.JobID)
+	if job == nil {
 		return ErrBadJobID
 	}
-	// for _, n := range job.submittedNonces {
-	// 	if n == s.Nonce {
-	// 		return ErrDuplicateShare
-	// 	}
-	// }
-	return s.validate(job)
+	return s.validate(job, config.Get().ShareValidation)
 }
 
 func (p *Proxy) receiveWorker(w Worker) {
+	p.workerMu.Lock()
 	p.workers[w.ID()] = w
 	p.workerCount++
+	p.workerMu.Unlock()
 }
 
-func (p *Proxy) removeWorker(w Worker) {
-	delete(p.workers, w.ID())
-	p.workerCount--
-	// potentially check for len(workers) == 0, start timer to spin down proxy if empty
-	// like apache, we might expire a proxy at some point anyway, just to try and reclaim potential resources
-	// in workers map, avert id overflow, etc.
+func (p *Proxy) removeWorker(id uint64) {
+	p.workerMu.Lock()
+	if _, ok := p.workers[id]; ok {
+		p.workerCount--
+	}
+	delete(p.workers, id)
+	delete(p.states, id)
+	p.workerMu.Unlock()
+}
+
+// workerList is a copy of the current workers, so that they can be used without holding the lock
+func (p *Proxy) workerList() []Worker {
+	p.workerMu.RLock()
+	defer p.workerMu.RUnlock()
+	workers := make([]Worker, 0, len(p.workers))
+	for _, w := range p.workers {
+		workers = append(workers, w)
+	}
+	return workers
+}
+
+// drain stops new workers from being given to the proxy, so that its workers can be moved elsewhere
+func (p *Proxy) drain() {
+	p.workerMu.Lock()
+	p.draining = true
+	p.workerMu.Unlock()
+}
+
+// move hands a worker over to another proxy without disconnecting it.  The worker gets a job
+// from its new proxy straight away.
+func (p *Proxy) move(w Worker, to *Proxy) {
+	p.transfer(w, to)
+	go w.NewJob(to.NextJob(w))
+}
+
+// transfer hands a worker over to another proxy, without sending it a job
+func (p *Proxy) transfer(w Worker, to *Proxy) {
+	p.workerMu.RLock()
+	state := p.states[w.ID()]
+	p.workerMu.RUnlock()
+
+	p.Remove(w)
+	to.add(w, state)
+}
+
+// expireWorkers disconnects workers that have gone quiet or have been connected too long.
+// They are removed from the proxy when their connection closes.
+func (p *Proxy) expireWorkers(now time.Time) {
+	cfg := config.Get()
+	idle := time.Duration(cfg.IdleTimeout) * time.Second
+	lifetime := time.Duration(cfg.MaxLifetime) * time.Second
+	if idle == 0 && lifetime == 0 {
+		return
+	}
+
+	p.workerMu.RLock()
+	defer p.workerMu.RUnlock()
+	for id, w := range p.workers {
+		state, ok := p.states[id]
+		if !ok {
+			continue
+		}
+		if reason, expired := state.expired(now, idle, lifetime); expired {
+			logger.Get().Debugf("Disconnecting worker %v.%v: %v", p.ID, id, reason)
+			go w.Disconnect()
+		}
+	}
 }
 
 func (p *Proxy) configureDonations() {
-	p.donateAddr = "donate.xmrwasp.com:3333"
-	// p.donateAddr = "localhost:13334"
+	p.donatePool = config.Pool{URL: donateURL, TLS: true}
+	// p.donatePool = config.Pool{URL: "localhost:13334"}
 	donateLevel := config.Get().DonateLevel
+	if p.group.donateSet {
+		donateLevel = p.group.donate
+	}
 	if donateLevel <= 0 {
 		donateLevel = 1
 	}
@@ -426,20 +771,80 @@ func (p *Proxy) configureDonations() {
 
 func (p *Proxy) shutdown() {
 	// kill worker connections - they should connect to a new proxy if active
+	p.workerMu.Lock()
 	p.ready = false
+	p.workerMu.Unlock()
+	close(p.done)
+	if p.donating {
+		metrics.Donating.Dec()
+		p.DC.Close()
+	}
 	for _, w := range p.workers {
 		w.Disconnect()
 	}
-	<-time.After(1 * time.Minute)
+	if p.SC != nil {
+		p.SC.Close()
+	}
 	p.director.removeProxy(p)
 }
 
 func (p *Proxy) isReady() bool {
-	// the worker count read is a race TODO
-	return p.ready && p.workerCount < maxProxyWorkers
+	_, ready := p.load()
+	return ready
+}
+
+// load is the number of workers on the proxy, and whether it can take more
+func (p *Proxy) load() (workers int, ready bool) {
+	p.workerMu.RLock()
+	defer p.workerMu.RUnlock()
+	capacity := p.capacity()
+	// states are added before the run loop counts the worker, so they are checked too
+	return p.workerCount, p.ready && !p.draining && p.workerCount < capacity && len(p.states) < capacity
 }
 
-func (p *Proxy) handleSubmit(s *share, c *stratum.Client) (err error) {
+// Stats returns a snapshot of the proxy state.  Safe for concurrent use.
+func (p *Proxy) Stats() *ProxyStats {
+	p.jobMu.Lock()
+	stats := &ProxyStats{
+		ID:       p.ID,
+		Pool:     p.pool.URL,
+		Profile:  p.group.profile,
+		Algo:     p.currentJob.Algo,
+		AuthID:   p.authID,
+		Alive:    time.Now().Sub(p.aliveSince).Truncate(1 * time.Second),
+		Donating: p.donating,
+	}
+	p.jobMu.Unlock()
+
+	p.workerMu.RLock()
+	stats.Workers = len(p.workers)
+	p.workerMu.RUnlock()
+	stats.Shares = atomic.LoadUint64(&p.shares)
+	stats.Rejected = atomic.LoadUint64(&p.rejected)
+
+	return stats
+}
+
+// WorkerStats returns a snapshot of each worker on the proxy.  Safe for concurrent use.
+func (p *Proxy) WorkerStats() []*WorkerStats {
+	p.workerMu.RLock()
+	defer p.workerMu.RUnlock()
+	stats := make([]*WorkerStats, 0, len(p.workers))
+	for _, w := range p.workers {
+		ws := &WorkerStats{
+			ID:      w.ID(),
+			ProxyID: p.ID,
+		}
+		if state, ok := p.states[w.ID()]; ok {
+			state.stats(ws)
+		}
+		stats = append(stats, ws)
+	}
+
+	return stats
+}
+
+func (p *Proxy) handleSubmit(s *share, c Upstream) (err error) {
 	defer func() {
 		close(s.Response)
 		close(s.Error)
@@ -452,6 +857,7 @@ func (p *Proxy) handleSubmit(s *share, c *stratum.Client) (err error) {
 	}
 
 	if err = p.validateShare(s); err != nil {
+		p.rejectShare(err)
 		logger.Get().Debug("share: ", s)
 		logger.Get().Println("rejecting share with: ", err)
 		s.Error <- err
@@ -460,12 +866,21 @@ func (p *Proxy) handleSubmit(s *share, c *stratum.Client) (err error) {
 
 	s.AuthID = p.authID
 	reply := StatusReply{}
-	if err = c.Call("submit", s, &reply); err != nil {
+	submitted := time.Now()
+	err = c.Call("submit", s, &reply)
+	metrics.SubmitLatency.Observe(time.Since(submitted).Seconds())
+	if err != nil {
+		if !isConnectionError(err) {
+			p.rejectShare(err)
+		}
 		s.Error <- err
 		return
 	}
 	if reply.Status == "OK" {
-		p.shares++
+		atomic.AddUint64(&p.shares, 1)
+		metrics.SharesAccepted.Inc()
+	} else {
+		p.rejectShare(reply.Error)
 	}
 
 	// logger.Get().Debugf("proxy %v share submit response: %s", p.ID, reply)
@@ -474,54 +889,232 @@ func (p *Proxy) handleSubmit(s *share, c *stratum.Client) (err error) {
 	return
 }
 
-// Submit sends worker shares to the pool.  Safe for concurrent use.
-func (p *Proxy) Submit(params map[string]interface{}) (*StatusReply, error) {
+// rejectShare counts a share that didn't make it.  Safe for concurrent use.
+func (p *Proxy) rejectShare(err error) {
+	atomic.AddUint64(&p.rejected, 1)
+	metrics.SharesRejected.With(rejectReason(err)).Inc()
+}
+
+// Submit sends worker shares to the pool.  With vardiff, shares that only meet the worker's
+// target are accepted without bothering the pool.  Safe for concurrent use.
+func (p *Proxy) Submit(w Worker, params map[string]interface{}) (reply *StatusReply, err error) {
 	s := newShare(params)
+	ws := p.workerState(w)
+	defer func() {
+		if err != nil || reply == nil || reply.Status != "OK" {
+			ws.reject()
+		}
+	}()
+
+	p.submitMu.RLock()
+	defer p.submitMu.RUnlock()
+	if p.closing {
+		return nil, ErrProxyClosing
+	}
 
 	if s.JobID == "" {
+		p.rejectShare(ErrBadJobID)
 		return nil, ErrBadJobID
 	}
 	if s.Nonce == "" {
+		p.rejectShare(ErrMalformedShare)
 		return nil, ErrMalformedShare
 	}
+	if err := ws.checkNonce(s.Nonce); err != nil {
+		p.rejectShare(err)
+		logger.Get().Println("rejecting share with: ", err)
+		return nil, err
+	}
+	p.setShareExtraNonce(w, s)
+	_, token, _ := ws.session()
+	s.alwaysVerify = token != ""
+
+	target, ok := ws.shareTarget(s.JobID)
+	if ok {
+		forward, err := p.checkWorkerShare(s, target, config.Get().ShareValidation)
+		if err != nil {
+			p.rejectShare(err)
+			logger.Get().Println("rejecting share with: ", err)
+			return nil, err
+		}
+		if !forward {
+			// only the proxy has seen this share, so it only earns hashes if it was hashed
+			p.acceptWorkerShare(w, ws, target, s.verified)
+			return &StatusReply{Status: "OK"}, nil
+		}
+	} else {
+		target = p.poolTarget(s.JobID)
+		if config.Get().ShareValidation >= ValidateFull {
+			if err := p.verifyShare(s); err != nil {
+				p.rejectShare(err)
+				logger.Get().Println("rejecting share with: ", err)
+				return nil, err
+			}
+		}
+	}
 
 	// if it matters - locking jobMu should be fine
 	// there might be a race for the job ids's but it shouldn't matter
-	if s.JobID == p.currentJob.ID || s.JobID == p.prevJob.ID {
-		p.submissions <- s
-	} else if s.JobID == p.donateJob.ID || s.JobID == p.prevDonateJob.ID {
-		p.donations <- s
-	} else {
+	var submissions chan *share
+	switch s.JobID {
+	case p.currentJob.ID, p.prevJob.ID:
+		submissions = p.submissions
+	case p.donateJob.ID, p.prevDonateJob.ID:
+		submissions = p.donations
+	default:
+		p.rejectShare(ErrBadJobID)
 		return nil, ErrBadJobID
 	}
+	select {
+	case submissions <- s:
+	case <-p.done:
+		return nil, ErrProxyClosing
+	}
 
-	return <-s.Response, <-s.Error
+	reply, err = <-s.Response, <-s.Error
+	if err == nil && reply != nil && reply.Status == "OK" {
+		p.acceptWorkerShare(w, ws, target, true)
+	}
+	return reply, err
+}
+
+// Shutdown waits for shares in flight to be answered by the pool, then disconnects the workers
+// and closes the pool connections.  It gives up waiting when ctx is done.  Safe for concurrent use.
+func (p *Proxy) Shutdown(ctx context.Context) {
+	drained := make(chan struct{})
+	go func() {
+		// new shares wait here, then are turned away
+		p.submitMu.Lock()
+		p.closing = true
+		p.submitMu.Unlock()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		logger.Get().Println("Gave up waiting for shares in flight on proxy ", p.ID)
+	}
+
+	p.stopOnce.Do(func() { close(p.stop) })
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+	}
 }
 
-// NextJob gets gets the next job (on the current block) and increments the nonce
-func (p *Proxy) NextJob() *Job {
+// acceptWorkerShare counts a good share for the worker, and sends a new job if its difficulty changed.
+// The hashes are only credited to the worker's token if credit is set, meaning the pool accepted
+// the share or the proxy recalculated its result.
+func (p *Proxy) acceptWorkerShare(w Worker, ws *workerState, target uint64, credit bool) {
+	if ws.accept(target) {
+		go w.NewJob(p.NextJob(w))
+	}
+	siteKey, token, user := ws.session()
+	if token == "" || target == 0 {
+		return
+	}
+	if !credit {
+		logger.Get().Debugln("Not crediting a share that could not be verified")
+		return
+	}
+	hashes := difficultyFromTarget(target)
+	if siteKey != "" {
+		p.director.sites.credit(siteKey, hashes)
+	}
+	if err := GetHashStore().Credit(siteKey, token, user, hashes); err != nil {
+		logger.Get().Println("Unable to credit hashes: ", err)
+	}
+}
+
+// NextJob gets gets the next job (on the current block) for the worker and increments the nonce
+func (p *Proxy) NextJob(w Worker) *Job {
 	p.jobWaiter.Wait() // only waits for first job from login
+	ws := p.workerState(w)
 	p.jobMu.Lock()
 	defer p.jobMu.Unlock()
-	var j *Job
-	if !p.donating {
-		j = p.currentJob.Next()
-	} else {
-		j = p.donateJob.Next()
+	source := p.currentJob
+	if p.donating {
+		source = p.donateJob
+	}
+	j := source.Next()
+	j.Target = ws.jobTarget(j)
+	if source.hasExtraNonce() {
+		if err := source.writeExtraNonce(j, extraNonce(w)); err != nil {
+			logger.Get().Println("Unable to give worker an extra nonce: ", err)
+		}
+	}
+	if b, ok := ws.reservedNonce(); ok {
+		if err := j.reserveNonce(b); err != nil {
+			logger.Get().Println("Unable to reserve nonce for worker: ", err)
+		}
 	}
 
 	return j
 }
 
+// identify records the login details sent by the worker
+func (p *Proxy) identify(w Worker, login, rigID, agent string) {
+	p.workerState(w).identify(login, rigID, agent)
+}
+
+// touch records activity from the worker, so it isn't disconnected for being idle
+func (p *Proxy) touch(w Worker) {
+	p.workerState(w).touch(time.Now())
+}
+
+// workerState returns what the proxy knows about the worker.  Safe for concurrent use.
+func (p *Proxy) workerState(w Worker) *workerState {
+	p.workerMu.RLock()
+	ws, ok := p.states[w.ID()]
+	p.workerMu.RUnlock()
+	if !ok {
+		// the worker is already gone, so there is nothing to keep
+		return &workerState{}
+	}
+	return ws
+}
+
 // Add a worker to the proxy - safe for concurrent use.
 func (p *Proxy) Add(w Worker) {
+	p.add(w, nil)
+}
+
+// add a worker, keeping its state if it came from another proxy
+func (p *Proxy) add(w Worker, state *workerState) {
 	w.SetProxy(p)
 	w.SetID(p.nextWorkerID())
-
-	p.addWorker <- w
+	if state == nil {
+		state = newWorkerState(w)
+	}
+	p.workerMu.Lock()
+	if p.niceHash && state.usesNiceHash() {
+		b, ok := p.freeNonceByte()
+		if !ok {
+			// another worker took the last nonce byte after the director handed the proxy out
+			p.workerMu.Unlock()
+			p.director.nextProxy(p.group).add(w, state)
+			return
+		}
+		state.reserveNonce(b)
+	}
+	p.states[w.ID()] = state
+	p.workerMu.Unlock()
+
+	select {
+	case p.addWorker <- w:
+	case <-p.done:
+		// the proxy spun down after the director handed it out
+		p.workerMu.Lock()
+		delete(p.states, w.ID())
+		p.workerMu.Unlock()
+		p.director.nextProxy(p.group).add(w, state)
+	}
 }
 
 // Remove a worker from the proxy - safe for concurrent use.
 func (p *Proxy) Remove(w Worker) {
-	p.delWorker <- w
+	select {
+	case p.delWorker <- w.ID():
+	case <-p.done:
+	}
 }
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testStoppableProxy has a run loop that only waits to be stopped
+func testStoppableProxy() *Proxy {
+	p := &Proxy{
+		done: make(chan struct{}),
+		stop: make(chan struct{}),
+	}
+	go func() {
+		<-p.stop
+		close(p.done)
+	}()
+	return p
+}
+
+func TestShutdownWaitsForSubmits(t *testing.T) {
+	p := testStoppableProxy()
+
+	// a share in flight
+	p.submitMu.RLock()
+	finished := make(chan struct{})
+	go func() {
+		p.Shutdown(context.Background())
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		t.Fatal("shutdown finished while a share was in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	p.submitMu.RUnlock()
+	<-finished
+	require.True(t, p.closing)
+	<-p.done
+
+	// the next share is turned away
+	_, err := p.Submit(&testWorker{}, map[string]interface{}{"job_id": "1", "nonce": "00000000"})
+	require.Equal(t, ErrProxyClosing, err)
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	p := testStoppableProxy()
+	p.submitMu.RLock()
+	defer p.submitMu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	p.Shutdown(ctx)
+
+	// the run loop is stopped anyway
+	<-p.done
+}
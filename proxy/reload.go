@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"github.com/trey-jones/xmrwasp/config"
+	"github.com/trey-jones/xmrwasp/logger"
+)
+
+// ReloadResult describes what changed when the config was reloaded
+type ReloadResult struct {
+	Changed []string `json:"changed"`
+	// RestartRequired lists the changes that won't take effect until the next restart
+	RestartRequired []string `json:"restart_required"`
+}
+
+// Reload reads the config file again and applies it to the running proxies.  Pools, donate level,
+// stat interval, debug logging and share validation change straight away.  If the new config is
+// invalid, the old one stays in place and the error is returned.
+func (d *Director) Reload() (*ReloadResult, error) {
+	d.reloadMu.Lock()
+	defer d.reloadMu.Unlock()
+	old, cfg, err := config.Reload()
+	if err != nil {
+		logger.Get().Println("Config reload failed, keeping the current config: ", err)
+		return nil, err
+	}
+
+	changed := config.Changed(old, cfg)
+	result := &ReloadResult{
+		Changed:         changed,
+		RestartRequired: config.RestartRequired(changed),
+	}
+	logger.Get().Println("Config reloaded, changed: ", changed)
+	if len(result.RestartRequired) > 0 {
+		logger.Get().Println("These changes need a restart to take effect: ", result.RestartRequired)
+	}
+
+	if cfg.Debug {
+		logger.Get().SetLevel(logger.Debug)
+	} else {
+		logger.Get().SetLevel(logger.Info)
+	}
+
+	select {
+	case d.reload <- struct{}{}:
+	default:
+	}
+	for _, p := range d.proxyList() {
+		p.Reload()
+	}
+
+	return result, nil
+}
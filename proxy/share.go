@@ -3,6 +3,7 @@ package proxy
 import (
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 
 	"github.com/trey-jones/xmrwasp/config"
@@ -12,42 +13,85 @@ import (
 const (
 	_ = iota
 	// ValidateNormal just checks that there is a valid job ID and the share is
-	// not a duplicate for this job
+	// not a duplicate for this job.  Duplicates are always checked.
 	ValidateNormal
 
 	// ValidateFormat checks the results and nonce for valid size
 	ValidateFormat
 
-	// ValidateDiff checks that the result difficulty meets the target
-	// NOT WORKING - the idea would be to include previous levels also
+	// ValidateDiff checks that the result difficulty meets the target,
+	// in addition to the previous levels
 	ValidateDiff
 
-	// ValidateFull TODO checks nonce against blob for result
-	// maybe not worth it!
+	// ValidateFull recalculates the RandomX hash for a sample of shares (see verifysample)
+	// and checks that it matches the result
 	ValidateFull
 )
 
 const (
-	// need more information about this uint64
+	// the last 8 bytes of the result hash, little endian, are compared to the target
 	shareValueOffset = 24
 	shareValueLength = 8
 )
 
 var (
-	ErrMalformedShareResult = errors.New("result is the correct length")
+	ErrMalformedShareResult = errors.New("result is not the correct length")
 	ErrDiffTooLow           = errors.New("share difficulty too low")
 )
 
+// rejectReason labels share errors for metrics.  Anything unrecognized came from the pool.
+func rejectReason(err error) string {
+	switch err {
+	case ErrBadJobID:
+		return "bad_job_id"
+	case ErrDuplicateShare:
+		return "duplicate"
+	case ErrMalformedShare, ErrMalformedShareResult:
+		return "malformed"
+	case ErrDiffTooLow:
+		return "low_difficulty"
+	case ErrBadResult:
+		return "bad_result"
+	case ErrNonceOutOfRange:
+		return "nonce_range"
+	}
+	return "pool"
+}
+
 type share struct {
 	AuthID string `json:"id"`
 	JobID  string `json:"job_id"`
 	Nonce  string `json:"nonce"`
 	Result string `json:"result"`
+	// ExtraNonce is the extra nonce the worker had, for jobs with reserved space.  Pools get it
+	// in extraNonceField.  For daemon jobs the proxy builds the block itself, so it isn't sent.
+	ExtraNonce      string `json:"-"`
+	extraNonceField string
+	// alwaysVerify is set for shares that earn hashes for a token, so their result is always
+	// recalculated rather than sampled.  verified is set once it has been, and matched.
+	alwaysVerify bool
+	verified     bool
 
 	Error    chan error        `json:"-"`
 	Response chan *StatusReply `json:"-"`
 }
 
+// MarshalJSON adds the extra nonce in the field the pool wants it in, if it wants one
+func (s *share) MarshalJSON() ([]byte, error) {
+	type submit share // without the methods, so it is marshalled normally
+	known, err := json.Marshal((*submit)(s))
+	if err != nil || s.ExtraNonce == "" || s.extraNonceField == "" {
+		return known, err
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(known, &fields); err != nil {
+		return nil, err
+	}
+	fields[s.extraNonceField] = s.ExtraNonce
+	return json.Marshal(fields)
+}
+
 // might return an invalid share, and that's fine - will fail validation
 func newShare(params map[string]interface{}) *share {
 	s := &share{
@@ -70,15 +114,7 @@ func newShare(params map[string]interface{}) *share {
 	return s
 }
 
-func (s *share) validate(j *Job) error {
-	// normal validate for no duplicate
-	for _, n := range j.submittedNonces {
-		if n == s.Nonce {
-			return ErrDuplicateShare
-		}
-	}
-
-	validateLevel := config.Get().ShareValidation
+func (s *share) validate(j *Job, validateLevel int) error {
 	if validateLevel >= ValidateFormat {
 		if err := s.validateFormat(); err != nil {
 			return err
@@ -91,13 +127,22 @@ func (s *share) validate(j *Job) error {
 		}
 	}
 
-	if validateLevel >= ValidateFull {
-		return s.validateResult(j)
+	// ValidateFull is too slow for the proxy run loop, so it's done before the share gets here
+
+	// only shares that are otherwise good are remembered
+	if !j.shares.add(s.key()) {
+		return ErrDuplicateShare
 	}
 
 	return nil
 }
 
+// key identifies the share within its job.  Workers without an extra nonce are given the same
+// blob for a job, so the same nonce from two different workers would also be the same share.
+func (s *share) key() string {
+	return s.ExtraNonce + s.Nonce
+}
+
 func (s *share) validateFormat() error {
 	if len(s.Nonce) != 8 || len(s.Result) != 64 {
 		return ErrMalformedShare
@@ -105,9 +150,8 @@ func (s *share) validateFormat() error {
 	return nil
 }
 
-// Disabled, not working
+// validateDifficulty rejects shares whose result does not meet the job target.
 func (s *share) validateDifficulty(j *Job) error {
-	return nil
 	target, err := j.getTargetUint64()
 	if err != nil {
 		// don't try to validate, just record so we can fix later
@@ -121,23 +165,26 @@ func (s *share) validateDifficulty(j *Job) error {
 		return err
 	}
 
-	logger.Get().Debugf("comparing result %v < target %v", result, target)
-	if result < target {
+	if result >= target {
+		logger.Get().Debugf("share result %v does not meet target %v", result, target)
 		return ErrDiffTooLow
 	}
 
 	return nil
 }
 
-// not implemented, and no rush to do so
+// validateResult recalculates the hash for a sample of shares and compares it to the result
 func (s *share) validateResult(j *Job) error {
-	return nil
+	if s.alwaysVerify {
+		return shareVerifier.verify(j, s, 100)
+	}
+	return shareVerifier.verify(j, s, config.Get().VerifySample)
 }
 
 func (s *share) getResultUint64() (uint64, error) {
 	resultBytes, err := hex.DecodeString(s.Result)
 	if err != nil {
-		return 0, err
+		return 0, ErrMalformedShareResult
 	}
 
 	if len(resultBytes) < shareValueOffset+shareValueLength {
@@ -146,5 +193,5 @@ func (s *share) getResultUint64() (uint64, error) {
 
 	valueBytes := resultBytes[shareValueOffset : shareValueOffset+shareValueLength]
 
-	return binary.BigEndian.Uint64(valueBytes), nil
+	return binary.LittleEndian.Uint64(valueBytes), nil
 }
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShareSet(t *testing.T) {
+	ss := newShareSet()
+	require.True(t, ss.add("0a0b0c0d"))
+	require.False(t, ss.add("0a0b0c0d"))
+	require.False(t, ss.add("0A0B0C0D"))
+	require.True(t, ss.add("0a0b0c0e"))
+	require.Equal(t, 2, ss.len())
+}
+
+func TestShareSetIsBounded(t *testing.T) {
+	ss := newShareSet()
+	for i := 0; i < maxJobShares+10; i++ {
+		require.True(t, ss.add(strconv.Itoa(i)))
+	}
+	require.Equal(t, maxJobShares, ss.len())
+
+	// the oldest shares are forgotten first
+	require.True(t, ss.add("0"))
+	require.False(t, ss.add(strconv.Itoa(maxJobShares+9)))
+}
+
+func TestShareSetConcurrent(t *testing.T) {
+	ss := newShareSet()
+	var accepted uint64
+	var mu sync.Mutex
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 1000; n++ {
+				if ss.add(strconv.Itoa(n)) {
+					mu.Lock()
+					accepted++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, uint64(1000), accepted)
+}
+
+func TestDuplicateShare(t *testing.T) {
+	j := &Job{
+		ID:     "1",
+		Blob:   "0606f8f788d1058707a9bdfea5390bdce41ccab6a3c7e923d3ba32827a0da9771398d9962a5fc80000000063b1df2fb16d38222fe97968b72f0d540277be4f910823e4d66e30b0483c87da04",
+		Target: "b88d0600",
+	}
+	require.NoError(t, j.init())
+
+	s := &share{JobID: "1", Nonce: "deadbeef", Result: "00"}
+	require.NoError(t, s.validate(j, ValidateNormal))
+	require.Equal(t, ErrDuplicateShare, s.validate(j, ValidateNormal))
+
+	// a malformed share is not remembered
+	malformed := &share{JobID: "1", Nonce: "cafe", Result: "00"}
+	require.Equal(t, ErrMalformedShare, malformed.validate(j, ValidateFormat))
+	require.NoError(t, malformed.validate(j, ValidateNormal))
+
+	// the next job starts fresh
+	next := &Job{ID: "2", Blob: j.Blob, Target: j.Target}
+	require.NoError(t, next.init())
+	require.NoError(t, s.validate(next, ValidateNormal))
+}
+
+func TestTargetDecoding(t *testing.T) {
+	tests := []struct {
+		target   string
+		expected uint64
+		err      error
+	}{
+		// compact targets keep their 32 bit difficulty
+		{"b88d0600", 1844674407370955, nil},       // difficulty 10000
+		{"711b0d00", 3689348814741910, nil},       // difficulty 5000
+		{"e4a63d00", 17353475139896097, nil},      // difficulty 1063
+		{"ffffffff", 18446744073709551615, nil},   // difficulty 1
+		{"edb5a0f7c6100000", 18446744073709, nil}, // difficulty 1000000
+		{"f0ffffff00000000", 4294967280, nil},
+		{"00000000", 0, ErrUnknownTargetFormat},
+		{"b88d06", 0, ErrUnknownTargetFormat},
+		{"notarealtarget", 0, ErrUnknownTargetFormat},
+	}
+	for _, test := range tests {
+		j := &Job{Target: test.target}
+		target, err := j.getTargetUint64()
+		if test.err != nil {
+			require.Error(t, err, test.target)
+			continue
+		}
+		require.NoError(t, err, test.target)
+		require.Equal(t, test.expected, target, test.target)
+	}
+}
+
+func TestValidateDifficulty(t *testing.T) {
+	tests := []struct {
+		target string
+		result string
+		err    error
+	}{
+		// just meets difficulty 10000
+		{"b88d0600", "639183aae1bf4c9a35884cb46b09cad9175f04efd7684e72ca10c7bab88d0600", nil},
+		// equal to the target is not enough
+		{"b88d0600", "639183aae1bf4c9a35884cb46b09cad9175f04efd7684e72cb10c7bab88d0600", ErrDiffTooLow},
+		// the RandomX reference hash for "This is a test" is only worth difficulty 4
+		{"b88d0600", "639183aae1bf4c9a35884cb46b09cad9175f04efd7684e7262a0ac1c2f0b4e3f", ErrDiffTooLow},
+		{"ffffffff", "639183aae1bf4c9a35884cb46b09cad9175f04efd7684e7262a0ac1c2f0b4e3f", nil},
+		{"edb5a0f7c6100000", "639183aae1bf4c9a35884cb46b09cad9175f04efd7684e72ecb5a0f7c6100000", nil},
+		{"edb5a0f7c6100000", "639183aae1bf4c9a35884cb46b09cad9175f04efd7684e72edb5a0f7c6100000", ErrDiffTooLow},
+		{"edb5a0f7c6100000", "639183aae1bf4c9a35884cb46b09cad9175f04efd7684e720000000000000000", nil},
+		{"b88d0600", "not hex", ErrMalformedShareResult},
+		{"b88d0600", "639183aae1bf4c9a", ErrMalformedShareResult},
+		// unknown targets are not validated
+		{"notarealtarget", "639183aae1bf4c9a35884cb46b09cad9175f04efd7684e7262a0ac1c2f0b4e3f", nil},
+	}
+	for _, test := range tests {
+		s := &share{Result: test.result}
+		j := &Job{Target: test.target}
+		require.Equal(t, test.err, s.validateDifficulty(j), test.target+" "+test.result)
+	}
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"strings"
+	"sync"
+)
+
+// maxJobShares bounds the memory used to remember shares for one job.
+// Once full, the oldest shares are forgotten first.
+const maxJobShares = 1 << 16
+
+// shareSet remembers which shares were submitted for a job.  Safe for concurrent use.
+type shareSet struct {
+	mu    sync.Mutex
+	seen  map[string]struct{}
+	order []string // ring buffer of keys in the order they were added
+	next  int
+}
+
+func newShareSet() *shareSet {
+	return &shareSet{
+		seen: make(map[string]struct{}),
+	}
+}
+
+// add records the share and returns false if it was already recorded.
+func (ss *shareSet) add(key string) bool {
+	key = strings.ToLower(key)
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if _, ok := ss.seen[key]; ok {
+		return false
+	}
+
+	if len(ss.order) < maxJobShares {
+		ss.order = append(ss.order, key)
+	} else {
+		delete(ss.seen, ss.order[ss.next])
+		ss.order[ss.next] = key
+		ss.next = (ss.next + 1) % maxJobShares
+	}
+	ss.seen[key] = struct{}{}
+
+	return true
+}
+
+// has reports whether the share was already recorded, without recording it
+func (ss *shareSet) has(key string) bool {
+	key = strings.ToLower(key)
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	_, ok := ss.seen[key]
+	return ok
+}
+
+func (ss *shareSet) len() int {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return len(ss.seen)
+}
@@ -1,7 +1,18 @@
-package proxy
+//go:build simulation
+// +build simulation
+
+// The simulation runs for several minutes against mock pools, which is longer than a default test
+// run allows, so it only builds with the simulation tag:
+//   go test -tags simulation ./proxy -timeout 15m
+// It is in package proxy_test because it drives real tcp and ws workers, and those packages
+// import proxy.  Check that it still builds with:
+//   go vet -tags simulation ./proxy
+
+package proxy_test
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"math"
 	"math/rand"
@@ -18,7 +29,9 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/trey-jones/stratum"
 	"github.com/trey-jones/wstest"
+	"github.com/trey-jones/xmrwasp/config"
 	"github.com/trey-jones/xmrwasp/logger"
+	"github.com/trey-jones/xmrwasp/proxy"
 	"github.com/trey-jones/xmrwasp/tcp"
 	"github.com/trey-jones/xmrwasp/ws"
 
@@ -61,9 +74,9 @@ func randomJobID() string {
 
 type MockPool struct{}
 
-func (m *MockPool) Login(p map[string]interface{}, resp *LoginReply) error {
+func (m *MockPool) Login(p map[string]interface{}, resp *proxy.LoginReply) error {
 	resp.ID = "0"
-	resp.Job = &Job{
+	resp.Job = &proxy.Job{
 		Blob:   "0606f8f788d1058707a9bdfea5390bdce41ccab6a3c7e923d3ba32827a0da9771398d9962a5fc80000000063b1df2fb16d38222fe97968b72f0d540277be4f910823e4d66e30b0483c87da04",
 		ID:     randomJobID(),
 		Target: "notarealtarget",
@@ -72,12 +85,12 @@ func (m *MockPool) Login(p map[string]interface{}, resp *LoginReply) error {
 	return nil
 }
 
-func (m *MockPool) Submit(p map[string]interface{}, resp *StatusReply) error {
+func (m *MockPool) Submit(p map[string]interface{}, resp *proxy.StatusReply) error {
 	resp.Status = "OK"
 	return nil
 }
 
-func (m *MockPool) Keepalived(p map[string]interface{}, resp *StatusReply) error {
+func (m *MockPool) Keepalived(p map[string]interface{}, resp *proxy.StatusReply) error {
 	resp.Status = "KEEPALIVED"
 	return nil
 }
@@ -92,15 +105,15 @@ type wsClient struct {
 func newWsClient(t *testing.T) error {
 	// using the test server throws "Too many open files" on mac - wstest seems to work ok and spins up workers faster
 	// url := strings.Replace(testWsServer.URL, "http", "ws", 1)
-	h := ews.NewHandler(ws.NewWorker)
+	h := ews.NewHandler(ws.NewFactory(config.Listener{Transport: "ws"}))
 	d := wstest.NewDialer(h, nil)
 	// conn, resp, err := websocket.DefaultDialer.Dial(url, nil)
 	conn, resp, err := d.Dial("ws://notarealserver", nil)
 	if err != nil {
-		t.Fatal("Failed to spawn WS worker: ", err)
+		return err
 	}
 	if got, want := resp.StatusCode, http.StatusSwitchingProtocols; got != want {
-		t.Fatalf("resp.StatusCode = %q, want %q", got, want)
+		return fmt.Errorf("resp.StatusCode = %d, want %d", got, want)
 	}
 
 	client := &wsClient{
@@ -205,7 +218,7 @@ func newTCPClient(t *testing.T) error {
 		c: stratum.NewClient(client),
 	}
 	c.notify = c.c.Notifications()
-	go tcp.SpawnWorker(server)
+	go tcp.SpawnWorker(server, config.Listener{Transport: "tcp"})
 	// hack around race for now
 	time.Sleep(250 * time.Millisecond)
 	go c.simulate(t)
@@ -222,7 +235,7 @@ func (c *tcpClient) simulate(t *testing.T) {
 
 	err := c.sendAuth()
 	if err != nil {
-		t.Fatal("TCP worker was unable to login: ", err)
+		t.Error("TCP worker was unable to login: ", err)
 		return
 	}
 
@@ -230,9 +243,10 @@ func (c *tcpClient) simulate(t *testing.T) {
 		select {
 		case notif := <-c.notify:
 			if notif.Method == "job" {
-				job, err := NewJobFromServer(notif.Params.(map[string]interface{}))
+				job, err := proxy.NewJobFromServer(notif.Params.(map[string]interface{}))
 				if err != nil {
-					t.Fatal("bad job from server: ", err)
+					t.Error("bad job from server: ", err)
+					return
 				}
 				c.jobIDMu.Lock()
 				c.jobID = job.ID
@@ -241,7 +255,8 @@ func (c *tcpClient) simulate(t *testing.T) {
 		case <-submitTime.C:
 			err := c.sendSubmit()
 			if err != nil {
-				t.Fatal("TCP worker got bad response on share submission: ", err)
+				t.Error("TCP worker got bad response on share submission: ", err)
+				return
 			}
 			nextSubmit = nextRandomSubmit()
 			submitTime = time.NewTimer(nextSubmit * time.Second)
@@ -253,7 +268,7 @@ func (c *tcpClient) simulate(t *testing.T) {
 }
 
 func (c *tcpClient) sendAuth() error {
-	loginReply := LoginReply{}
+	loginReply := proxy.LoginReply{}
 	err := c.c.Call("login", map[string]interface{}{}, &loginReply)
 	if err != nil {
 		return err
@@ -275,7 +290,7 @@ func (c *tcpClient) sendSubmit() error {
 		"result": "does not matter",
 	}
 	c.jobIDMu.Unlock()
-	reply := StatusReply{}
+	reply := proxy.StatusReply{}
 	err := c.c.Call("submit", params, &reply)
 	if err != nil {
 		return err
@@ -293,7 +308,7 @@ func nextRandomSubmit() time.Duration {
 func startMockPool(t *testing.T) {
 	listener, err := net.Listen("tcp", mockPoolURL)
 	if err != nil {
-		t.Fatal("Unable to start mock pool: ", err)
+		log.Fatal("Unable to start mock pool: ", err)
 	}
 	defer listener.Close()
 	s := stratum.NewServer()
@@ -316,7 +331,7 @@ func startMockPool(t *testing.T) {
 func startDonatePool(t *testing.T) {
 	listener, err := net.Listen("tcp", mockDonateURL)
 	if err != nil {
-		t.Fatal("Unable to start donate pool: ", err)
+		log.Fatal("Unable to start donate pool: ", err)
 	}
 	defer listener.Close()
 	s := stratum.NewServer()
@@ -337,7 +352,7 @@ func startDonatePool(t *testing.T) {
 }
 
 func startMockWebserver(t *testing.T) {
-	h := ews.NewHandler(ws.NewWorker)
+	h := ews.NewHandler(ws.NewFactory(config.Listener{Transport: "ws"}))
 	testWsServer = httptest.NewServer(h)
 }
 
@@ -348,7 +363,7 @@ func broadcastJobs(clients *[]*stratum.DefaultServerCodec) {
 	for {
 		<-jobSender.C
 		for _, c := range *clients {
-			fakeJob := &Job{
+			fakeJob := &proxy.Job{
 				ID: randomJobID(),
 				// fake, but valid
 				Blob:   "0707f8f788d1058707a9bdfea5390bdce41ccab6a3c7e923d3ba32827a0da9771398d9962a5fc80000000063b1df2fb16d38222fe97968b72f0d540277be4f910823e4d66e30b0483c87da04",
@@ -451,7 +466,8 @@ func testWsWorkers(t *testing.T) {
 		case <-workerSpawner.C:
 			err := newWsClient(t)
 			if err != nil {
-				t.Fatal("Failed to spawn a websocket worker: ", err)
+				t.Error("Failed to spawn a websocket worker: ", err)
+				return
 			}
 			nextWorker := time.Duration(rand.Intn(workerSpawnMax))
 			workerSpawner = time.NewTimer(nextWorker * time.Millisecond)
@@ -470,7 +486,8 @@ func testTCPWorkers(t *testing.T) {
 		case <-workerSpawner.C:
 			err := newTCPClient(t)
 			if err != nil {
-				t.Fatal("Failed to spawn a TCP worker: ", err)
+				t.Error("Failed to spawn a TCP worker: ", err)
+				return
 			}
 			nextWorker := time.Duration(rand.Intn(workerSpawnMax))
 			workerSpawner = time.NewTimer(nextWorker * time.Millisecond)
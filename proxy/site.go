@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/trey-jones/xmrwasp/config"
+	"github.com/trey-jones/xmrwasp/logger"
+)
+
+var (
+	// ErrInvalidSiteKey is sent to Coinhive style miners as is, so it uses their wording
+	ErrInvalidSiteKey = errors.New("invalid_site_key")
+)
+
+// Rejecter is implemented by workers that can tell the miner why it is being turned away, in
+// the miner's own protocol.  Reject disconnects the worker.
+type Rejecter interface {
+	Reject(reason string)
+}
+
+// SiteStats describes the work done for one site key
+type SiteStats struct {
+	SiteKey string
+	Workers int
+	Hashes  uint64
+}
+
+// siteAccounts adds up the hashes done for each site.  The zero value is ready to use, and it
+// is safe for concurrent use.
+type siteAccounts struct {
+	mu     sync.Mutex
+	hashes map[string]uint64
+}
+
+func (a *siteAccounts) credit(siteKey string, hashes uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.hashes == nil {
+		a.hashes = make(map[string]uint64)
+	}
+	a.hashes[siteKey] += hashes
+}
+
+// totals is a copy of the hashes done for each site
+func (a *siteAccounts) totals() map[string]uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	totals := make(map[string]uint64, len(a.hashes))
+	for siteKey, hashes := range a.hashes {
+		totals[siteKey] = hashes
+	}
+	return totals
+}
+
+// newToken makes a random session token for an authed worker
+func newToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// authorize checks the site key sent by a Coinhive style miner against keys.  An empty key store
+// accepts any site key.  A worker whose site has its own login is moved to a proxy that mines
+// with it, in which case moved is true and the new proxy has sent it a job.
+func (p *Proxy) authorize(w Worker, siteKey string, keys config.SiteKeys) (token string, moved bool, err error) {
+	site, ok := keys[siteKey]
+	if len(keys) > 0 && !ok {
+		logger.Get().Printf("Rejecting worker %v with unknown site key %q\n", w.RemoteAddr(), siteKey)
+		return "", false, ErrInvalidSiteKey
+	}
+
+	token = newToken()
+	p.workerState(w).authorize(siteKey, token)
+	if err := GetHashStore().NewToken(siteKey, token, time.Now()); err != nil {
+		logger.Get().Println("Unable to store token: ", err)
+	}
+
+	g := p.group
+	g.login, g.password = site.Login, site.Password
+	if g == p.group {
+		return token, false, nil
+	}
+	p.move(w, p.director.nextProxy(g))
+	return token, true, nil
+}
+
+// GetSiteStats returns the hashes done for each site key, and how many workers are mining for it now
+func (d *Director) GetSiteStats() []*SiteStats {
+	sites := make(map[string]*SiteStats)
+	for siteKey, hashes := range d.sites.totals() {
+		sites[siteKey] = &SiteStats{SiteKey: siteKey, Hashes: hashes}
+	}
+	for _, ws := range d.GetWorkerStats() {
+		if ws.SiteKey == "" {
+			continue
+		}
+		if _, ok := sites[ws.SiteKey]; !ok {
+			sites[ws.SiteKey] = &SiteStats{SiteKey: ws.SiteKey}
+		}
+		sites[ws.SiteKey].Workers++
+	}
+
+	stats := make([]*SiteStats, 0, len(sites))
+	for _, s := range sites {
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].SiteKey < stats[j].SiteKey })
+	return stats
+}
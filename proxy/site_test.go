@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/trey-jones/xmrwasp/config"
+)
+
+func TestAuthorize(t *testing.T) {
+	w := &testWorker{id: 1}
+	p := &Proxy{ID: 1, states: map[uint64]*workerState{1: {}}, workers: map[uint64]Worker{1: w}}
+	keys := config.SiteKeys{"partner": {}}
+
+	_, _, err := p.authorize(w, "stranger", keys)
+	require.Equal(t, ErrInvalidSiteKey, err)
+	siteKey, _, _ := p.workerState(w).session()
+	require.Empty(t, siteKey)
+
+	token, moved, err := p.authorize(w, "partner", keys)
+	require.NoError(t, err)
+	require.False(t, moved)
+	require.Len(t, token, 32)
+	siteKey, session, _ := p.workerState(w).session()
+	require.Equal(t, "partner", siteKey)
+	require.Equal(t, token, session)
+
+	// without a key store any site key is fine, and each session gets its own token
+	other, _, err := p.authorize(w, "anything", nil)
+	require.NoError(t, err)
+	require.NotEqual(t, token, other)
+}
+
+func TestSiteStats(t *testing.T) {
+	d := &Director{}
+	p := &Proxy{ID: 1, director: d, states: map[uint64]*workerState{1: {}, 2: {}}}
+	p.workers = map[uint64]Worker{1: &testWorker{id: 1}, 2: &testWorker{id: 2}}
+	d.proxies = map[uint64]*Proxy{1: p}
+	p.states[1].authorize("partner", "token")
+
+	p.acceptWorkerShare(p.workers[1], p.states[1], targetFromDifficulty(1000), true)
+	p.acceptWorkerShare(p.workers[1], p.states[1], targetFromDifficulty(3000), true)
+	// shares from workers without a site aren't counted for any
+	p.acceptWorkerShare(p.workers[2], p.states[2], targetFromDifficulty(5000), true)
+	d.sites.credit("gone", 10)
+
+	stats := d.GetSiteStats()
+	require.Len(t, stats, 2)
+	require.Equal(t, SiteStats{SiteKey: "gone", Hashes: 10}, *stats[0])
+	require.Equal(t, SiteStats{SiteKey: "partner", Workers: 1, Hashes: 4000}, *stats[1])
+	require.Equal(t, uint64(4000), p.states[1].sessionHashes())
+}
+
+func TestOnlyVerifiedSharesCredited(t *testing.T) {
+	store := NewMemoryHashStore()
+	defer SetHashStore(GetHashStore())
+	SetHashStore(store)
+	require.NoError(t, store.NewToken("partner", "token", time.Now()))
+
+	j := &Job{ID: "1", Blob: testJobBlob, Target: "b88d0600", SeedHash: hex.EncodeToString([]byte("test key 001"))}
+	require.NoError(t, j.init())
+	<-shareVerifier.prepare(j.SeedHash).ready
+	d := &Director{}
+	w := &testWorker{id: 1}
+	p := &Proxy{ID: 1, director: d, currentJob: j, prevJob: &Job{}, donateJob: &Job{}, prevDonateJob: &Job{},
+		states: map[uint64]*workerState{1: {}}, workers: map[uint64]Worker{1: w}}
+	p.states[1].authorize("partner", "token")
+
+	// every result meets the worker's target and none meet the pool's, so the proxy is the only
+	// one to see these shares, the way Submit does it
+	target := ^uint64(0)
+	submit := func(nonce, result string) error {
+		s := &share{JobID: "1", Nonce: nonce, Result: result, alwaysVerify: true}
+		forward, err := p.checkWorkerShare(s, target, ValidateNormal)
+		if err != nil {
+			return err
+		}
+		require.False(t, forward)
+		p.acceptWorkerShare(w, p.states[1], target, s.verified)
+		return nil
+	}
+	balance := func() uint64 {
+		tb, err := store.Token("token")
+		require.NoError(t, err)
+		return tb.Hashes
+	}
+
+	// a made up result is hashed even though shares aren't sampled, and earns nothing
+	nonce := testJobBlob[2*nonceOffset : 2*(nonceOffset+nonceLength)]
+	require.Equal(t, ErrBadResult, submit(nonce, strings.Repeat("ee", 32)))
+	require.Zero(t, balance())
+	require.Empty(t, d.sites.totals())
+
+	// nor does one the proxy can't hash
+	j.Algo = "rx/wow"
+	require.NoError(t, submit("01000000", strings.Repeat("ee", 32)))
+	require.Zero(t, balance())
+	j.Algo = ""
+
+	require.NoError(t, submit(nonce, "c56414121acda1713c2f2a819d8ae38aed7c80c35c2a769298d34f03833cd5f1"))
+	require.Equal(t, difficultyFromTarget(target), balance())
+}
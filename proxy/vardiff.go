@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/trey-jones/xmrwasp/logger"
+)
+
+const (
+	// the difficulty is adjusted after this many shares, or this many share times, whichever is first
+	vardiffWindowShares = 10
+	vardiffWindowTimes  = 4
+
+	// the most the difficulty can go up or down in one adjustment
+	vardiffMaxChange = 4
+
+	// targets are remembered for this many jobs, so late shares on an old job are checked correctly
+	vardiffJobMemory = 4
+)
+
+// vardiffConfig bounds the difficulty of a worker
+type vardiffConfig struct {
+	minDiff   uint64
+	maxDiff   uint64 // 0 means no limit other than the pool difficulty
+	shareTime time.Duration
+}
+
+// vardiff sets the difficulty of one worker, aiming for one share every shareTime.
+// Safe for concurrent use.
+type vardiff struct {
+	mu  sync.Mutex
+	cfg vardiffConfig
+
+	difficulty uint64
+
+	// the easiest target sent to the worker for each recent job
+	targets map[string]uint64
+	jobs    []string
+
+	windowStart  time.Time
+	windowShares int
+	windowHashes uint64
+}
+
+func newVardiff(cfg vardiffConfig, now time.Time) *vardiff {
+	if cfg.minDiff == 0 {
+		cfg.minDiff = 1
+	}
+	return &vardiff{
+		cfg:         cfg,
+		difficulty:  cfg.minDiff,
+		targets:     make(map[string]uint64),
+		windowStart: now,
+	}
+}
+
+// Difficulty is the current difficulty for the worker
+func (v *vardiff) Difficulty() uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.difficulty
+}
+
+// jobTarget returns the target to send to the worker with a job, in place of the pool's target.
+// The worker is never given a target harder than the pool target.
+func (v *vardiff) jobTarget(jobID, poolTarget string, now time.Time) string {
+	pool, err := (&Job{Target: poolTarget}).getTargetUint64()
+	if err != nil {
+		// the pool target can't be compared, so the worker gets it as is
+		return poolTarget
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	// workers that don't find shares still get easier work
+	v.retarget(now)
+
+	encoded := encodeDifficulty(v.difficulty)
+	target, _ := (&Job{Target: encoded}).getTargetUint64()
+	if target <= pool {
+		encoded, target = poolTarget, pool
+	}
+
+	prev, ok := v.targets[jobID]
+	if !ok {
+		v.jobs = append(v.jobs, jobID)
+		if len(v.jobs) > vardiffJobMemory {
+			delete(v.targets, v.jobs[0])
+			v.jobs = v.jobs[1:]
+		}
+	}
+	if target > prev {
+		v.targets[jobID] = target
+	}
+
+	return encoded
+}
+
+// shareTarget is the target a share on the job has to meet, if the worker was sent the job
+func (v *vardiff) shareTarget(jobID string) (uint64, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	target, ok := v.targets[jobID]
+	return target, ok
+}
+
+// accept counts a share that met target.  It returns true if the difficulty changed.
+func (v *vardiff) accept(target uint64, now time.Time) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.windowShares++
+	v.windowHashes += difficultyFromTarget(target)
+	return v.retarget(now)
+}
+
+// retarget adjusts the difficulty once enough time has passed or enough shares have come in.
+// Callers must hold mu.
+func (v *vardiff) retarget(now time.Time) bool {
+	elapsed := now.Sub(v.windowStart)
+	if v.windowShares < vardiffWindowShares && elapsed < v.cfg.shareTime*vardiffWindowTimes {
+		return false
+	}
+
+	var next uint64
+	if v.windowShares == 0 {
+		next = v.difficulty / 2
+	} else {
+		hashrate := float64(v.windowHashes) / elapsed.Seconds()
+		next = uint64(math.Min(hashrate*v.cfg.shareTime.Seconds(), math.MaxUint64/2))
+	}
+
+	switch {
+	case next > v.difficulty*vardiffMaxChange:
+		next = v.difficulty * vardiffMaxChange
+	case next < v.difficulty/vardiffMaxChange:
+		next = v.difficulty / vardiffMaxChange
+	}
+	if v.cfg.maxDiff > 0 && next > v.cfg.maxDiff {
+		next = v.cfg.maxDiff
+	}
+	if next < v.cfg.minDiff {
+		next = v.cfg.minDiff
+	}
+
+	v.windowStart = now
+	v.windowShares = 0
+	v.windowHashes = 0
+
+	changed := next != v.difficulty
+	v.difficulty = next
+	return changed
+}
+
+func targetFromDifficulty(difficulty uint64) uint64 {
+	if difficulty == 0 {
+		return math.MaxUint64
+	}
+	return math.MaxUint64 / difficulty
+}
+
+func difficultyFromTarget(target uint64) uint64 {
+	if target == 0 {
+		return math.MaxUint64
+	}
+	return math.MaxUint64 / target
+}
+
+// encodeDifficulty encodes a target the way pools do: the compact 32 bit form while the
+// difficulty fits in 32 bits, and the full 64 bit form after that.
+func encodeDifficulty(difficulty uint64) string {
+	if difficulty == 0 {
+		difficulty = 1
+	}
+	if difficulty <= math.MaxUint32 {
+		b := make([]byte, 4)
+		binary.LittleEndian.PutUint32(b, uint32(math.MaxUint32/difficulty))
+		return hex.EncodeToString(b)
+	}
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, targetFromDifficulty(difficulty))
+	return hex.EncodeToString(b)
+}
+
+// checkWorkerShare validates a share against the target the worker was given.  Only shares that
+// also meet the pool target need to be forwarded.  The rest are checked for duplicates here.
+func (p *Proxy) checkWorkerShare(s *share, target uint64, validateLevel int) (forward bool, err error) {
+	p.jobMu.Lock()
+	job := p.findJob(s.JobID)
+	p.jobMu.Unlock()
+	if job == nil {
+		return false, ErrBadJobID
+	}
+
+	if err = s.validateFormat(); err != nil {
+		return false, err
+	}
+	result, err := s.getResultUint64()
+	if err != nil {
+		return false, err
+	}
+	if result >= target {
+		logger.Get().Debugf("share result %v does not meet worker target %v", result, target)
+		return false, ErrDiffTooLow
+	}
+	if job.shares.has(s.key()) {
+		return false, ErrDuplicateShare
+	}
+	if validateLevel >= ValidateFull || s.alwaysVerify {
+		if err = s.validateResult(job); err != nil {
+			return false, err
+		}
+	}
+
+	poolTarget, err := job.getTargetUint64()
+	if err != nil || result < poolTarget {
+		return true, nil
+	}
+	if !job.shares.add(s.key()) {
+		return false, ErrDuplicateShare
+	}
+
+	return false, nil
+}
+
+// poolTarget is the target of the job, or 0 if it is unknown
+func (p *Proxy) poolTarget(jobID string) uint64 {
+	p.jobMu.Lock()
+	job := p.findJob(jobID)
+	p.jobMu.Unlock()
+	if job == nil {
+		return 0
+	}
+	target, err := job.getTargetUint64()
+	if err != nil {
+		return 0
+	}
+	return target
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"math"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testVardiff() *vardiff {
+	return newVardiff(vardiffConfig{minDiff: 1000, maxDiff: 100000, shareTime: 30 * time.Second}, time.Unix(0, 0))
+}
+
+func TestEncodeDifficulty(t *testing.T) {
+	require.Equal(t, "b88d0600", encodeDifficulty(10000))
+	require.Equal(t, "ffffffff", encodeDifficulty(1))
+	require.Len(t, encodeDifficulty(5000000000), 16)
+
+	// the compact form can't hold every difficulty exactly
+	for _, difficulty := range []uint64{1, 1000, 10000, 123456, 1000000, math.MaxUint32, 5000000000} {
+		target, err := (&Job{Target: encodeDifficulty(difficulty)}).getTargetUint64()
+		require.NoError(t, err)
+		require.InEpsilon(t, difficulty, difficultyFromTarget(target), 0.001, "difficulty %v", difficulty)
+	}
+}
+
+func TestVardiffRetarget(t *testing.T) {
+	v := testVardiff()
+	start := time.Unix(0, 0)
+	target := targetFromDifficulty(1000)
+
+	// a fast worker only goes up so much at a time
+	for i := 1; i < vardiffWindowShares; i++ {
+		require.False(t, v.accept(target, start.Add(time.Second)))
+	}
+	require.True(t, v.accept(target, start.Add(time.Second)))
+	require.Equal(t, uint64(4000), v.Difficulty())
+
+	// 10 shares of 4000 in 100s is 400 H/s, or 12000 per share time
+	for i := 0; i < vardiffWindowShares; i++ {
+		v.accept(targetFromDifficulty(4000), start.Add(101*time.Second))
+	}
+	require.Equal(t, uint64(12000), v.Difficulty())
+
+	// a worker that finds nothing gets easier work, but not below the minimum
+	v.jobTarget("1", "ffffffff", start.Add(101*time.Second+4*v.cfg.shareTime))
+	require.Equal(t, uint64(6000), v.Difficulty())
+	for i := 2; i < 10; i++ {
+		v.jobTarget("1", "ffffffff", start.Add(101*time.Second+time.Duration(4*i)*v.cfg.shareTime))
+	}
+	require.Equal(t, uint64(1000), v.Difficulty())
+
+	// or above the maximum
+	v.difficulty = 90000
+	for i := 0; i < vardiffWindowShares; i++ {
+		v.accept(targetFromDifficulty(90000), v.windowStart.Add(time.Second))
+	}
+	require.Equal(t, uint64(100000), v.Difficulty())
+}
+
+func TestVardiffJobTarget(t *testing.T) {
+	v := testVardiff()
+	now := time.Unix(0, 0)
+
+	// easier than the pool
+	require.Equal(t, encodeDifficulty(1000), v.jobTarget("1", "b88d0600", now))
+	target, ok := v.shareTarget("1")
+	require.True(t, ok)
+	require.Equal(t, uint64(1000), difficultyFromTarget(target))
+
+	// but never harder
+	require.Equal(t, "ffffff00", v.jobTarget("2", "ffffff00", now)) // difficulty 256
+	require.Equal(t, "notarealtarget", v.jobTarget("3", "notarealtarget", now))
+	_, ok = v.shareTarget("3")
+	require.False(t, ok)
+
+	// a harder target for the same job doesn't make earlier shares invalid
+	v.difficulty = 2000
+	v.jobTarget("1", "b88d0600", now)
+	target, _ = v.shareTarget("1")
+	require.Equal(t, uint64(1000), difficultyFromTarget(target))
+
+	// only recent jobs are remembered
+	for i := 10; i < 10+vardiffJobMemory; i++ {
+		v.jobTarget(strconv.Itoa(i), "b88d0600", now)
+	}
+	_, ok = v.shareTarget("1")
+	require.False(t, ok)
+	require.Len(t, v.targets, vardiffJobMemory)
+}
+
+func TestCheckWorkerShare(t *testing.T) {
+	j := &Job{ID: "1", Blob: testJobBlob, Target: "b88d0600"} // difficulty 10000
+	require.NoError(t, j.init())
+	p := &Proxy{currentJob: j, prevJob: &Job{}, donateJob: &Job{}, prevDonateJob: &Job{}}
+	workerTarget := targetFromDifficulty(1000)
+
+	tests := []struct {
+		nonce   string
+		result  string
+		forward bool
+		err     error
+	}{
+		// difficulty 10000 goes to the pool
+		{"00000001", "639183aae1bf4c9a35884cb46b09cad9175f04efd7684e72ca10c7bab88d0600", true, nil},
+		// difficulty 1000 is only good enough for the worker target
+		{"00000002", "639183aae1bf4c9a35884cb46b09cad9175f04efd7684e720000000000004100", false, nil},
+		{"00000002", "639183aae1bf4c9a35884cb46b09cad9175f04efd7684e720000000000004100", false, ErrDuplicateShare},
+		// difficulty 4
+		{"00000003", "639183aae1bf4c9a35884cb46b09cad9175f04efd7684e7262a0ac1c2f0b4e3f", false, ErrDiffTooLow},
+		{"00000004", "00", false, ErrMalformedShare},
+	}
+	for _, test := range tests {
+		s := &share{JobID: "1", Nonce: test.nonce, Result: test.result}
+		forward, err := p.checkWorkerShare(s, workerTarget, ValidateNormal)
+		require.Equal(t, test.err, err, test.nonce)
+		require.Equal(t, test.forward, forward, test.nonce)
+	}
+
+	_, err := p.checkWorkerShare(&share{JobID: "2"}, workerTarget, ValidateNormal)
+	require.Equal(t, ErrBadJobID, err)
+}
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trey-jones/xmrwasp/config"
+	"github.com/trey-jones/xmrwasp/logger"
+	"github.com/trey-jones/xmrwasp/randomx"
+)
+
+const (
+	// each RandomX cache is 256 MiB.  Two covers the seed hash change at an epoch boundary.
+	maxVerifierCaches = 2
+)
+
+var (
+	ErrBadResult = errors.New("share result does not match the job")
+
+	shareVerifier = newVerifier(maxVerifierCaches, verifierThreads())
+)
+
+// verifierThreads leaves at least half the CPUs for everything else
+func verifierThreads() int {
+	if n := runtime.NumCPU() / 2; n > 1 {
+		return n
+	}
+	return 1
+}
+
+// verifier recalculates share results with RandomX in light mode.  It never blocks a share
+// waiting for resources: while the cache for a seed hash is being built, or all verification
+// slots are busy, shares are passed along unchecked.  Safe for concurrent use.
+type verifier struct {
+	mu     sync.Mutex
+	caches map[string]*verifierCache
+	order  []string // oldest first
+	max    int
+
+	slots chan struct{}
+}
+
+type verifierCache struct {
+	ready chan struct{}
+	cache *randomx.Cache
+}
+
+func newVerifier(maxCaches, threads int) *verifier {
+	return &verifier{
+		caches: make(map[string]*verifierCache),
+		max:    maxCaches,
+		slots:  make(chan struct{}, threads),
+	}
+}
+
+// prepare starts building the cache for seedHash if it doesn't exist yet
+func (v *verifier) prepare(seedHash string) *verifierCache {
+	seedHash = strings.ToLower(seedHash)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if vc, ok := v.caches[seedHash]; ok {
+		return vc
+	}
+
+	key, err := hex.DecodeString(seedHash)
+	if err != nil || len(key) == 0 {
+		return nil
+	}
+
+	if len(v.order) >= v.max {
+		delete(v.caches, v.order[0])
+		v.order = v.order[1:]
+	}
+	vc := &verifierCache{ready: make(chan struct{})}
+	v.caches[seedHash] = vc
+	v.order = append(v.order, seedHash)
+
+	go func() {
+		started := time.Now()
+		vc.cache = randomx.NewCache(key)
+		close(vc.ready)
+		logger.Get().Debugf("RandomX cache for seed hash %v ready in %v", seedHash, time.Since(started))
+	}()
+
+	return vc
+}
+
+// cache returns the finished cache for seedHash, or nil if it isn't ready yet
+func (v *verifier) cache(seedHash string) *randomx.Cache {
+	vc := v.prepare(seedHash)
+	if vc == nil {
+		return nil
+	}
+	select {
+	case <-vc.ready:
+		return vc.cache
+	default:
+		return nil
+	}
+}
+
+// verifiable is true for jobs the verifier can hash.  Other RandomX variants also have a seed
+// hash, but only rx/0 is implemented.
+func verifiable(j *Job) bool {
+	return j.SeedHash != "" && (j.Algo == "" || strings.EqualFold(j.Algo, "rx/0"))
+}
+
+// verify checks a sample of shares, sampleRate being the percentage checked
+func (v *verifier) verify(j *Job, s *share, sampleRate int) error {
+	if !verifiable(j) || rand.Intn(100) >= sampleRate {
+		return nil
+	}
+
+	c := v.cache(j.SeedHash)
+	if c == nil {
+		return nil
+	}
+
+	select {
+	case v.slots <- struct{}{}:
+		defer func() { <-v.slots }()
+	default:
+		logger.Get().Debugln("Skipping share verification, all verifiers are busy")
+		return nil
+	}
+
+	blob, err := j.blobWithNonce(s.ExtraNonce, s.Nonce)
+	if err != nil {
+		return ErrMalformedShare
+	}
+
+	if hex.EncodeToString(c.Hash(blob)) != strings.ToLower(s.Result) {
+		return ErrBadResult
+	}
+	s.verified = true
+	return nil
+}
+
+// verifyShare does the full validation for shares on a job with a known seed hash.  It is
+// expensive, so it is done in the worker's goroutine rather than the proxy run loop.
+func (p *Proxy) verifyShare(s *share) error {
+	p.jobMu.Lock()
+	job := p.findJob(s.JobID)
+	p.jobMu.Unlock()
+	if job == nil {
+		return ErrBadJobID
+	}
+
+	// cheap checks first
+	if err := s.validateFormat(); err != nil {
+		return err
+	}
+	if err := s.validateDifficulty(job); err != nil {
+		return err
+	}
+	// the share is only remembered once it has passed everything, in the run loop
+	if job.shares.has(s.key()) {
+		return ErrDuplicateShare
+	}
+
+	return s.validateResult(job)
+}
+
+// prepareVerifier starts building the RandomX cache as soon as a job with a new seed hash arrives
+func prepareVerifier(j *Job) {
+	if verifiable(j) && config.Get().ShareValidation >= ValidateFull {
+		shareVerifier.prepare(j.SeedHash)
+	}
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyShare(t *testing.T) {
+	// a RandomX reference test vector, with the input used as the job blob
+	blob := testJobBlob
+	result := "c56414121acda1713c2f2a819d8ae38aed7c80c35c2a769298d34f03833cd5f1"
+	nonce := blob[2*nonceOffset : 2*(nonceOffset+nonceLength)]
+
+	v := newVerifier(1, 1)
+	j := &Job{Blob: blob, SeedHash: hex.EncodeToString([]byte("test key 001"))}
+
+	// nothing is checked until the cache is ready
+	require.NoError(t, v.verify(j, &share{Nonce: nonce, Result: "00"}, 100))
+	<-v.prepare(j.SeedHash).ready
+
+	require.NoError(t, v.verify(j, &share{Nonce: nonce, Result: result}, 100))
+	require.Equal(t, ErrBadResult, v.verify(j, &share{Nonce: "01000000", Result: result}, 100))
+
+	// unsampled shares and jobs without a seed hash are not checked
+	require.NoError(t, v.verify(j, &share{Nonce: "01000000", Result: result}, 0))
+	require.NoError(t, v.verify(&Job{Blob: blob}, &share{Nonce: "01000000", Result: result}, 100))
+
+	// nor are other RandomX variants, which have a seed hash too
+	j.Algo = "RX/0"
+	require.Equal(t, ErrBadResult, v.verify(j, &share{Nonce: "01000000", Result: result}, 100))
+	j.Algo = "rx/wow"
+	require.NoError(t, v.verify(j, &share{Nonce: "01000000", Result: result}, 100))
+}
+
+func TestVerifyDuplicateFirst(t *testing.T) {
+	j := &Job{ID: "1", Blob: testJobBlob, Target: "b88d0600", SeedHash: "abcd"}
+	require.NoError(t, j.init())
+	p := &Proxy{currentJob: j, prevJob: &Job{}, donateJob: &Job{}, prevDonateJob: &Job{}}
+
+	// a replayed share is turned away before it is hashed
+	s := &share{JobID: "1", Nonce: "deadbeef", Result: strings.Repeat("00", 32)}
+	require.True(t, j.shares.add(s.key()))
+	require.False(t, j.shares.has("cafebabe"))
+	require.Equal(t, ErrDuplicateShare, p.verifyShare(s))
+}
+
+func TestVerifierCacheLimit(t *testing.T) {
+	v := newVerifier(2, 1)
+	v.caches["aa"] = &verifierCache{}
+	v.caches["bb"] = &verifierCache{}
+	v.order = []string{"aa", "bb"}
+
+	require.Nil(t, v.prepare("not hex"))
+	require.Len(t, v.caches, 2)
+
+	// the stub caches are never finished, the new one is built in the background
+	require.NotNil(t, v.prepare("CC"))
+	require.Equal(t, []string{"bb", "cc"}, v.order)
+	_, ok := v.caches["aa"]
+	require.False(t, ok)
+}
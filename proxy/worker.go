@@ -0,0 +1,309 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/trey-jones/xmrwasp/config"
+)
+
+const (
+	// hashrate is estimated from the hashes done in the last hashrateBuckets minutes
+	hashrateBuckets      = 10
+	hashrateBucketLength = time.Minute
+)
+
+// workerState is what the proxy keeps about each of its workers
+type workerState struct {
+	// diff is nil unless vardiff is on or the listener has a fixed difficulty, otherwise
+	// workers get the pool target
+	diff *vardiff
+
+	remoteAddr string
+	transport  string
+	connected  time.Time
+
+	// sent by the worker when it logs in, so they can change after the state is made
+	mu        sync.Mutex
+	login     string
+	rigID     string
+	agent     string
+	algos     []string
+	lastShare time.Time
+	lastSeen  time.Time
+	// siteKey and token are set when a Coinhive style miner auths
+	siteKey string
+	token   string
+	// in nicehash mode a worker that was told about the extension only has nonces with this top
+	// byte, on its current proxy
+	niceHash      bool
+	nonceReserved bool
+	nonceByte     byte
+
+	// shares that met the worker's target, whether or not they were good enough for the pool
+	accepted uint64
+	rejected uint64
+	hashes   uint64
+	hashrate *hashrateMeter
+}
+
+func newWorkerState(w Worker) *workerState {
+	now := time.Now()
+	ws := &workerState{
+		remoteAddr: w.RemoteAddr(),
+		transport:  w.Transport(),
+		connected:  now,
+		lastSeen:   now,
+		hashrate:   newHashrateMeter(now),
+	}
+	cfg := config.Get()
+	if difficulty := w.Listener().Difficulty; difficulty > 0 {
+		// a fixed difficulty is a vardiff that can't move
+		ws.diff = newVardiff(vardiffConfig{
+			minDiff:   uint64(difficulty),
+			maxDiff:   uint64(difficulty),
+			shareTime: time.Duration(cfg.ShareTime) * time.Second,
+		}, now)
+	} else if cfg.Vardiff {
+		ws.diff = newVardiff(vardiffConfig{
+			minDiff:   uint64(cfg.MinDiff),
+			maxDiff:   uint64(cfg.MaxDiff),
+			shareTime: time.Duration(cfg.ShareTime) * time.Second,
+		}, now)
+	}
+	return ws
+}
+
+// identify records who the worker says it is.  Safe for concurrent use.
+func (ws *workerState) identify(login, rigID, agent string) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.login, ws.rigID, ws.agent = login, rigID, agent
+}
+
+// setAlgos records the algorithms the worker can mine.  Safe for concurrent use.
+func (ws *workerState) setAlgos(algos []string) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.algos = algos
+}
+
+// algoList is the algorithms the worker can mine, or nil if it didn't say.  Safe for concurrent use.
+func (ws *workerState) algoList() []string {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.algos
+}
+
+// authorize records the site the worker mines for, and its session token.  Safe for concurrent use.
+func (ws *workerState) authorize(siteKey, token string) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.siteKey, ws.token = siteKey, token
+}
+
+// useNiceHash records that the worker was told to keep to a top nonce byte.  Safe for concurrent use.
+func (ws *workerState) useNiceHash() {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.niceHash = true
+}
+
+// usesNiceHash is true if the worker keeps to a top nonce byte.  Safe for concurrent use.
+func (ws *workerState) usesNiceHash() bool {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.niceHash
+}
+
+// reserveNonce gives the worker its own top nonce byte.  Safe for concurrent use.
+func (ws *workerState) reserveNonce(b byte) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.nonceReserved, ws.nonceByte = true, b
+}
+
+// reservedNonce is the worker's top nonce byte, if it has one.  Safe for concurrent use.
+func (ws *workerState) reservedNonce() (byte, bool) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.nonceByte, ws.nonceReserved
+}
+
+// checkNonce makes sure the worker kept to its nonce range, if it has one
+func (ws *workerState) checkNonce(nonce string) error {
+	if b, ok := ws.reservedNonce(); ok {
+		return checkReservedNonce(nonce, b)
+	}
+	return nil
+}
+
+// session is the site key and token the worker authed with, and the user it mines for.
+// The token is empty if the worker hasn't authed.  Safe for concurrent use.
+func (ws *workerState) session() (siteKey, token, user string) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.siteKey, ws.token, ws.login
+}
+
+// sessionHashes is the number of hashes the worker has done since it connected
+func (ws *workerState) sessionHashes() uint64 {
+	return atomic.LoadUint64(&ws.hashes)
+}
+
+// touch records that the worker is still there.  Safe for concurrent use.
+func (ws *workerState) touch(now time.Time) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.lastSeen = now
+}
+
+// expired explains why the worker should be disconnected, if it should.  A zero idle or
+// lifetime means no limit.  Safe for concurrent use.
+func (ws *workerState) expired(now time.Time, idle, lifetime time.Duration) (string, bool) {
+	if lifetime > 0 && now.Sub(ws.connected) >= lifetime {
+		return "connection lifetime is over", true
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if idle > 0 && now.Sub(ws.lastSeen) >= idle {
+		return "idle", true
+	}
+	return "", false
+}
+
+// accept counts a good share that met target, which is 0 if the target is unknown.  It returns
+// true if the worker's difficulty changed.  Safe for concurrent use.
+func (ws *workerState) accept(target uint64) bool {
+	now := time.Now()
+	atomic.AddUint64(&ws.accepted, 1)
+	ws.mu.Lock()
+	ws.lastShare = now
+	ws.mu.Unlock()
+	if target == 0 {
+		return false
+	}
+	difficulty := difficultyFromTarget(target)
+	atomic.AddUint64(&ws.hashes, difficulty)
+	if ws.hashrate != nil {
+		ws.hashrate.add(difficulty, now)
+	}
+	return ws.diff != nil && ws.diff.accept(target, now)
+}
+
+// reject counts a share that was turned down by the proxy or the pool.  Safe for concurrent use.
+func (ws *workerState) reject() {
+	atomic.AddUint64(&ws.rejected, 1)
+}
+
+// jobTarget returns the target to give the worker with job, which is the pool target without vardiff
+func (ws *workerState) jobTarget(job *Job) string {
+	if ws.diff == nil {
+		return job.Target
+	}
+	return ws.diff.jobTarget(job.ID, job.Target, time.Now())
+}
+
+// shareTarget is the target the worker was given for the job.  False means the share should be
+// handled as if the worker had the pool target.
+func (ws *workerState) shareTarget(jobID string) (uint64, bool) {
+	if ws.diff == nil {
+		return 0, false
+	}
+	return ws.diff.shareTarget(jobID)
+}
+
+// difficulty is the current vardiff difficulty, or 0 without vardiff
+func (ws *workerState) difficulty() uint64 {
+	if ws.diff == nil {
+		return 0
+	}
+	return ws.diff.Difficulty()
+}
+
+// stats fills in a snapshot of the worker.  Safe for concurrent use.
+func (ws *workerState) stats(s *WorkerStats) {
+	now := time.Now()
+	s.RemoteAddr = ws.remoteAddr
+	s.Transport = ws.transport
+	s.Connected = ws.connected
+	ws.mu.Lock()
+	s.Login = ws.login
+	s.RigID = ws.rigID
+	s.Agent = ws.agent
+	s.SiteKey = ws.siteKey
+	s.LastShare = ws.lastShare
+	s.LastSeen = ws.lastSeen
+	ws.mu.Unlock()
+
+	s.Difficulty = ws.difficulty()
+	s.Accepted = atomic.LoadUint64(&ws.accepted)
+	s.Rejected = atomic.LoadUint64(&ws.rejected)
+	s.Hashes = atomic.LoadUint64(&ws.hashes)
+	if ws.hashrate != nil {
+		s.Hashrate = ws.hashrate.rate(hashrateBuckets, now)
+		s.Hashrate1m = ws.hashrate.rate(1, now)
+	}
+}
+
+// hashrateMeter adds up hashes by the minute.  Safe for concurrent use.
+type hashrateMeter struct {
+	mu      sync.Mutex
+	started time.Time
+	buckets [hashrateBuckets]uint64
+	current int64 // minutes since started
+}
+
+func newHashrateMeter(now time.Time) *hashrateMeter {
+	return &hashrateMeter{started: now}
+}
+
+// advance moves the meter up to now, emptying the buckets that have expired.  Callers must hold mu.
+func (m *hashrateMeter) advance(now time.Time) int64 {
+	n := int64(now.Sub(m.started) / hashrateBucketLength)
+	if n <= m.current {
+		return m.current
+	}
+	if n-m.current >= hashrateBuckets {
+		m.buckets = [hashrateBuckets]uint64{}
+	} else {
+		for i := m.current + 1; i <= n; i++ {
+			m.buckets[i%hashrateBuckets] = 0
+		}
+	}
+	m.current = n
+	return n
+}
+
+func (m *hashrateMeter) add(hashes uint64, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := m.advance(now)
+	m.buckets[n%hashrateBuckets] += hashes
+}
+
+// rate is the hashes per second over the last minutes, counting the current minute as one of them
+func (m *hashrateMeter) rate(minutes int, now time.Time) float64 {
+	if minutes > hashrateBuckets {
+		minutes = hashrateBuckets
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := m.advance(now)
+
+	var hashes uint64
+	for i := int64(0); i < int64(minutes) && i <= n; i++ {
+		hashes += m.buckets[(n-i)%hashrateBuckets]
+	}
+
+	elapsed := now.Sub(m.started)
+	window := time.Duration(minutes-1)*hashrateBucketLength + elapsed%hashrateBucketLength
+	if elapsed < window {
+		window = elapsed
+	}
+	if window < time.Second {
+		return 0
+	}
+	return float64(hashes) / window.Seconds()
+}
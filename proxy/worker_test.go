@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/trey-jones/xmrwasp/config"
+)
+
+type testWorker struct {
+	id       uint64
+	listener config.Listener
+}
+
+func (w *testWorker) ID() uint64         { return w.id }
+func (w *testWorker) SetID(id uint64)    { w.id = id }
+func (w *testWorker) SetProxy(*Proxy)    {}
+func (w *testWorker) Proxy() *Proxy      { return nil }
+func (w *testWorker) Disconnect()        {}
+func (w *testWorker) NewJob(*Job)        {}
+func (w *testWorker) RemoteAddr() string { return "203.0.113.7:51234" }
+func (w *testWorker) Transport() string  { return "tcp" }
+
+func (w *testWorker) Listener() config.Listener { return w.listener }
+
+func TestWorkerStats(t *testing.T) {
+	ws := &workerState{
+		remoteAddr: "203.0.113.7:51234",
+		transport:  "tcp",
+		connected:  time.Now(),
+		hashrate:   newHashrateMeter(time.Now().Add(-time.Minute)),
+	}
+	ws.identify("wallet.rig1", "rig1", "XMRig/6.21.0")
+	require.False(t, ws.accept(targetFromDifficulty(1000)))
+	require.False(t, ws.accept(0))
+	ws.reject()
+
+	stats := &WorkerStats{}
+	ws.stats(stats)
+	require.Equal(t, "wallet.rig1", stats.Login)
+	require.Equal(t, "rig1", stats.RigID)
+	require.Equal(t, "XMRig/6.21.0", stats.Agent)
+	require.Equal(t, "203.0.113.7:51234", stats.RemoteAddr)
+	require.Equal(t, "tcp", stats.Transport)
+	require.Equal(t, uint64(2), stats.Accepted)
+	require.Equal(t, uint64(1), stats.Rejected)
+	require.Equal(t, uint64(1000), stats.Hashes)
+	require.False(t, stats.LastShare.IsZero())
+	require.True(t, stats.Hashrate > 0)
+}
+
+func TestHashrateMeter(t *testing.T) {
+	start := time.Unix(0, 0)
+	m := newHashrateMeter(start)
+	require.Equal(t, 0.0, m.rate(hashrateBuckets, start))
+
+	// 600 hashes a minute for 10 minutes
+	for i := 0; i < 10; i++ {
+		m.add(600, start.Add(time.Duration(i)*time.Minute+30*time.Second))
+	}
+	end := start.Add(10 * time.Minute)
+	require.InDelta(t, 10.0, m.rate(hashrateBuckets, end.Add(-time.Second)), 0.1)
+	require.InDelta(t, 10.0, m.rate(1, end.Add(-time.Second)), 0.2)
+
+	// old hashes drop out
+	require.InDelta(t, 9.0, m.rate(hashrateBuckets, end.Add(time.Minute-time.Second)), 0.1)
+	require.Equal(t, 0.0, m.rate(1, end.Add(time.Second)))
+	require.Equal(t, 0.0, m.rate(hashrateBuckets, end.Add(hashrateBuckets*time.Minute)))
+}
+
+func TestWorkerExpired(t *testing.T) {
+	start := time.Unix(0, 0)
+	ws := &workerState{connected: start, lastSeen: start}
+
+	_, expired := ws.expired(start.Add(time.Hour), 0, 0)
+	require.False(t, expired)
+
+	ws.touch(start.Add(5 * time.Minute))
+	_, expired = ws.expired(start.Add(10*time.Minute), 10*time.Minute, 0)
+	require.False(t, expired)
+	reason, expired := ws.expired(start.Add(15*time.Minute), 10*time.Minute, 0)
+	require.True(t, expired)
+	require.Equal(t, "idle", reason)
+
+	// busy workers are still recycled
+	ws.touch(start.Add(time.Hour))
+	reason, expired = ws.expired(start.Add(time.Hour), 10*time.Minute, time.Hour)
+	require.True(t, expired)
+	require.Equal(t, "connection lifetime is over", reason)
+}
@@ -0,0 +1,173 @@
+package randomx
+
+import "encoding/binary"
+
+// RandomX uses single AES rounds (the x86 AESENC and AESDEC instructions) to fill and hash memory.
+// This is a table based software implementation of those rounds.
+
+var (
+	sbox, invSbox          [256]byte
+	encTable, decTable     [4][256]uint32
+	gen1RKeys, hash1RState [4][16]byte
+	gen4RKeys              [8][16]byte
+	hash1RXKeys            [2][16]byte
+)
+
+func init() {
+	initAESTables()
+
+	// the constants are derived from Blake2b hashes of their names (see the RandomX spec)
+	splitKeys(blake2bSum(64, []byte("RandomX AesGenerator1R keys")), gen1RKeys[:])
+	splitKeys(blake2bSum(64, []byte("RandomX AesGenerator4R keys 0-3")), gen4RKeys[:4])
+	splitKeys(blake2bSum(64, []byte("RandomX AesGenerator4R keys 4-7")), gen4RKeys[4:])
+	splitKeys(blake2bSum(64, []byte("RandomX AesHash1R state")), hash1RState[:])
+	splitKeys(blake2bSum(32, []byte("RandomX AesHash1R xkeys")), hash1RXKeys[:])
+}
+
+func splitKeys(b []byte, keys [][16]byte) {
+	for i := range keys {
+		copy(keys[i][:], b[16*i:])
+	}
+}
+
+func gmul(a, b byte) byte {
+	var p byte
+	for b != 0 {
+		if b&1 != 0 {
+			p ^= a
+		}
+		hi := a & 0x80
+		a <<= 1
+		if hi != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return p
+}
+
+func initAESTables() {
+	// multiplicative inverse in GF(2^8) followed by the affine transform
+	for i := 0; i < 256; i++ {
+		var inv byte
+		if i != 0 {
+			for j := 1; j < 256; j++ {
+				if gmul(byte(i), byte(j)) == 1 {
+					inv = byte(j)
+					break
+				}
+			}
+		}
+		s := inv ^ rotl8(inv, 1) ^ rotl8(inv, 2) ^ rotl8(inv, 3) ^ rotl8(inv, 4) ^ 0x63
+		sbox[i] = s
+		invSbox[s] = byte(i)
+	}
+
+	for i := 0; i < 256; i++ {
+		s := sbox[i]
+		// column vector (2s, s, s, 3s) packed little endian
+		e := uint32(gmul(s, 2)) | uint32(s)<<8 | uint32(s)<<16 | uint32(gmul(s, 3))<<24
+		d := invSbox[i]
+		// column vector (14d, 9d, 13d, 11d)
+		dd := uint32(gmul(d, 14)) | uint32(gmul(d, 9))<<8 | uint32(gmul(d, 13))<<16 | uint32(gmul(d, 11))<<24
+		for r := 0; r < 4; r++ {
+			encTable[r][i] = e<<(8*uint(r)) | e>>(32-8*uint(r))
+			decTable[r][i] = dd<<(8*uint(r)) | dd>>(32-8*uint(r))
+		}
+	}
+}
+
+func rotl8(b byte, n uint) byte {
+	return b<<n | b>>(8-n)
+}
+
+// aesEnc is one AES encryption round: ShiftRows, SubBytes, MixColumns, AddRoundKey
+func aesEnc(state *[16]byte, key *[16]byte) {
+	var out [16]byte
+	for c := 0; c < 4; c++ {
+		col := encTable[0][state[4*c]] ^
+			encTable[1][state[4*((c+1)%4)+1]] ^
+			encTable[2][state[4*((c+2)%4)+2]] ^
+			encTable[3][state[4*((c+3)%4)+3]]
+		binary.LittleEndian.PutUint32(out[4*c:], col^binary.LittleEndian.Uint32(key[4*c:]))
+	}
+	*state = out
+}
+
+// aesDec is one AES decryption round: InvShiftRows, InvSubBytes, InvMixColumns, AddRoundKey
+func aesDec(state *[16]byte, key *[16]byte) {
+	var out [16]byte
+	for c := 0; c < 4; c++ {
+		col := decTable[0][state[4*c]] ^
+			decTable[1][state[4*((c+3)%4)+1]] ^
+			decTable[2][state[4*((c+2)%4)+2]] ^
+			decTable[3][state[4*((c+1)%4)+3]]
+		binary.LittleEndian.PutUint32(out[4*c:], col^binary.LittleEndian.Uint32(key[4*c:]))
+	}
+	*state = out
+}
+
+func loadStates(seed []byte) (s [4][16]byte) {
+	for i := range s {
+		copy(s[i][:], seed[16*i:])
+	}
+	return s
+}
+
+// fillAes1Rx4 fills out from the 64 byte seed, and leaves the final state in the seed
+func fillAes1Rx4(seed []byte, out []byte) {
+	s := loadStates(seed)
+	for p := 0; p < len(out); p += 64 {
+		aesDec(&s[0], &gen1RKeys[0])
+		aesEnc(&s[1], &gen1RKeys[1])
+		aesDec(&s[2], &gen1RKeys[2])
+		aesEnc(&s[3], &gen1RKeys[3])
+		for i := range s {
+			copy(out[p+16*i:], s[i][:])
+		}
+	}
+	for i := range s {
+		copy(seed[16*i:], s[i][:])
+	}
+}
+
+// fillAes4Rx4 fills out from the 64 byte seed, with four rounds per output block
+func fillAes4Rx4(seed []byte, out []byte) {
+	s := loadStates(seed)
+	for p := 0; p < len(out); p += 64 {
+		for r := 0; r < 4; r++ {
+			aesDec(&s[0], &gen4RKeys[r])
+			aesEnc(&s[1], &gen4RKeys[r])
+			aesDec(&s[2], &gen4RKeys[r+4])
+			aesEnc(&s[3], &gen4RKeys[r+4])
+		}
+		for i := range s {
+			copy(out[p+16*i:], s[i][:])
+		}
+	}
+}
+
+// hashAes1Rx4 writes a 64 byte fingerprint of in to out
+func hashAes1Rx4(in []byte, out []byte) {
+	s := hash1RState
+	var block [16]byte
+	for p := 0; p < len(in); p += 64 {
+		for i := range s {
+			copy(block[:], in[p+16*i:])
+			if i%2 == 0 {
+				aesEnc(&s[i], &block)
+			} else {
+				aesDec(&s[i], &block)
+			}
+		}
+	}
+	for k := 0; k < 2; k++ {
+		aesEnc(&s[0], &hash1RXKeys[k])
+		aesDec(&s[1], &hash1RXKeys[k])
+		aesEnc(&s[2], &hash1RXKeys[k])
+		aesDec(&s[3], &hash1RXKeys[k])
+	}
+	for i := range s {
+		copy(out[16*i:], s[i][:])
+	}
+}
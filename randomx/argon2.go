@@ -0,0 +1,166 @@
+package randomx
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// The RandomX cache is the memory of a single lane Argon2d instance, without the final hash.
+
+const (
+	argonMemory     = 262144 // KiB, and also the number of 1 KiB blocks
+	argonIterations = 3
+	argonLanes      = 1
+	argonSalt       = "RandomX\x03"
+	argonVersion    = 0x13
+	argonSyncPoints = 4
+
+	argonBlockWords    = 128
+	argonSegmentBlocks = argonMemory / argonSyncPoints
+)
+
+type argonBlock [argonBlockWords]uint64
+
+func le32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+// argonFill initializes and fills the Argon2d memory for key
+func argonFill(key []byte) []argonBlock {
+	h0 := blake2bSum(64,
+		le32(argonLanes), le32(0), le32(argonMemory), le32(argonIterations),
+		le32(argonVersion), le32(0), // Argon2d
+		le32(uint32(len(key))), key,
+		le32(uint32(len(argonSalt))), []byte(argonSalt),
+		le32(0), le32(0), // no secret or associated data
+	)
+
+	memory := make([]argonBlock, argonMemory)
+	var buf [1024]byte
+	for i := uint32(0); i < 2; i++ {
+		blake2bLong(buf[:], h0, le32(i), le32(0))
+		for w := range memory[i] {
+			memory[i][w] = binary.LittleEndian.Uint64(buf[8*w:])
+		}
+	}
+
+	for pass := 0; pass < argonIterations; pass++ {
+		for slice := 0; slice < argonSyncPoints; slice++ {
+			argonFillSegment(memory, pass, slice)
+		}
+	}
+	return memory
+}
+
+func argonFillSegment(memory []argonBlock, pass, slice int) {
+	start := 0
+	if pass == 0 && slice == 0 {
+		start = 2
+	}
+	curr := slice*argonSegmentBlocks + start
+	prev := curr - 1
+	if curr == 0 {
+		prev = argonMemory - 1
+	}
+
+	for i := start; i < argonSegmentBlocks; i, curr, prev = i+1, curr+1, curr {
+		pseudoRand := memory[prev][0]
+		ref := argonRefIndex(pass, slice, i, uint32(pseudoRand))
+		argonFillBlock(&memory[prev], &memory[ref], &memory[curr], pass > 0)
+	}
+}
+
+// argonRefIndex maps the pseudo random value to a block that is already filled (same lane always)
+func argonRefIndex(pass, slice, index int, pseudoRand uint32) int {
+	var areaSize uint64
+	if pass == 0 {
+		areaSize = uint64(slice*argonSegmentBlocks + index - 1)
+	} else {
+		areaSize = uint64(argonMemory - argonSegmentBlocks + index - 1)
+	}
+
+	rel := uint64(pseudoRand)
+	rel = rel * rel >> 32
+	rel = areaSize - 1 - (areaSize * rel >> 32)
+
+	startPos := uint64(0)
+	if pass != 0 && slice != argonSyncPoints-1 {
+		startPos = uint64((slice + 1) * argonSegmentBlocks)
+	}
+	return int((startPos + rel) % argonMemory)
+}
+
+func argonFillBlock(prev, ref, next *argonBlock, withXor bool) {
+	var r, tmp argonBlock
+	for i := range r {
+		r[i] = prev[i] ^ ref[i]
+	}
+	tmp = r
+	if withXor {
+		for i := range tmp {
+			tmp[i] ^= next[i]
+		}
+	}
+
+	for i := 0; i < 8; i++ {
+		v := r[16*i : 16*i+16]
+		blamkaRound(&v[0], &v[1], &v[2], &v[3], &v[4], &v[5], &v[6], &v[7],
+			&v[8], &v[9], &v[10], &v[11], &v[12], &v[13], &v[14], &v[15])
+	}
+	for i := 0; i < 8; i++ {
+		b := 2 * i
+		blamkaRound(&r[b], &r[b+1], &r[b+16], &r[b+17], &r[b+32], &r[b+33], &r[b+48], &r[b+49],
+			&r[b+64], &r[b+65], &r[b+80], &r[b+81], &r[b+96], &r[b+97], &r[b+112], &r[b+113])
+	}
+
+	for i := range next {
+		next[i] = tmp[i] ^ r[i]
+	}
+}
+
+func blamkaRound(v0, v1, v2, v3, v4, v5, v6, v7, v8, v9, v10, v11, v12, v13, v14, v15 *uint64) {
+	blamkaG(v0, v4, v8, v12)
+	blamkaG(v1, v5, v9, v13)
+	blamkaG(v2, v6, v10, v14)
+	blamkaG(v3, v7, v11, v15)
+	blamkaG(v0, v5, v10, v15)
+	blamkaG(v1, v6, v11, v12)
+	blamkaG(v2, v7, v8, v13)
+	blamkaG(v3, v4, v9, v14)
+}
+
+func blamkaG(a, b, c, d *uint64) {
+	*a = fBlaMka(*a, *b)
+	*d = bits.RotateLeft64(*d^*a, -32)
+	*c = fBlaMka(*c, *d)
+	*b = bits.RotateLeft64(*b^*c, -24)
+	*a = fBlaMka(*a, *b)
+	*d = bits.RotateLeft64(*d^*a, -16)
+	*c = fBlaMka(*c, *d)
+	*b = bits.RotateLeft64(*b^*c, -63)
+}
+
+func fBlaMka(x, y uint64) uint64 {
+	return x + y + 2*(x&0xffffffff)*(y&0xffffffff)
+}
+
+// blake2bLong is the variable length hash H' from the Argon2 spec
+func blake2bLong(out []byte, in ...[]byte) {
+	outLen := le32(uint32(len(out)))
+	if len(out) <= 64 {
+		copy(out, blake2bSum(len(out), append([][]byte{outLen}, in...)...))
+		return
+	}
+
+	v := blake2bSum(64, append([][]byte{outLen}, in...)...)
+	copy(out, v[:32])
+	out = out[32:]
+	for len(out) > 64 {
+		v = blake2bSum(64, v)
+		copy(out, v[:32])
+		out = out[32:]
+	}
+	copy(out, blake2bSum(len(out), v))
+}
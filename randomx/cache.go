@@ -0,0 +1,35 @@
+package randomx
+
+// Cache holds everything needed to hash in light mode for one key (the seed hash).  It takes
+// a few seconds and 256 MiB to create, so it should be kept for as long as the key is in use.
+type Cache struct {
+	key      []byte
+	memory   []argonBlock
+	programs [cacheAccesses]*ssProgram
+}
+
+// NewCache initializes the cache for key
+func NewCache(key []byte) *Cache {
+	c := &Cache{
+		key:    append([]byte(nil), key...),
+		memory: argonFill(key),
+	}
+
+	gen := newBlake2Generator(key, 0)
+	for i := range c.programs {
+		c.programs[i] = generateSuperscalar(gen)
+	}
+
+	return c
+}
+
+// Key returns the key the cache was created with
+func (c *Cache) Key() []byte {
+	return c.key
+}
+
+// Hash calculates the RandomX hash of input using the light mode (cache only) interpreter.
+// Each hash takes a significant fraction of a second.
+func (c *Cache) Hash(input []byte) []byte {
+	return newVM(c).hash(input)
+}
@@ -0,0 +1,46 @@
+package randomx
+
+const (
+	cacheAccesses  = 8
+	cacheLineSize  = 64
+	cacheItemWords = cacheLineSize / 8
+	cacheItems     = argonMemory * 1024 / cacheLineSize
+
+	datasetBaseSize   = 2147483648
+	datasetExtraSize  = 33554368
+	datasetExtraItems = datasetExtraSize / cacheLineSize
+)
+
+var (
+	superscalarMul0 = uint64(6364136223846793005)
+	superscalarAdds = [8]uint64{
+		0,
+		9298411001130361340,
+		12065312585734608966,
+		9306329213124626780,
+		5281919268842080866,
+		10536153434571861004,
+		3398623926847679864,
+		9549104520008361294,
+	}
+)
+
+// datasetItem calculates one 64 byte dataset item from the cache, which is what makes
+// light mode possible without the 2 GiB dataset
+func (c *Cache) datasetItem(itemNumber uint64, r *[8]uint64) {
+	r[0] = (itemNumber + 1) * superscalarMul0
+	for i := 1; i < 8; i++ {
+		r[i] = r[0] ^ superscalarAdds[i]
+	}
+
+	registerValue := itemNumber
+	for _, prog := range c.programs {
+		mix := &c.memory[(registerValue%cacheItems)/(1024/cacheLineSize)]
+		offset := (registerValue % (1024 / cacheLineSize)) * cacheItemWords
+		prog.execute(r)
+		for q := 0; q < 8; q++ {
+			r[q] ^= mix[offset+uint64(q)]
+		}
+		registerValue = r[prog.addressReg]
+	}
+}
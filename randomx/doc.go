@@ -0,0 +1,6 @@
+// Package randomx is a pure Go implementation of the RandomX proof of work in light mode.
+//
+// It is much too slow for mining, but is fine for checking a sample of the shares that
+// miners submit.  Only the interpreter is implemented, and the results match the
+// reference implementation (https://github.com/tevador/RandomX) test vectors.
+package randomx
@@ -0,0 +1,76 @@
+package randomx
+
+import "math"
+
+// Go only computes with round to nearest, but RandomX programs switch the rounding mode
+// with CFROUND.  The other modes are emulated by finding the exact error of the
+// round to nearest result and stepping to the neighbouring float when needed.
+
+const (
+	roundToNearest = iota
+	roundDown
+	roundUp
+	roundToZero
+)
+
+// roundResult adjusts x, the rounded to nearest result, given the sign of (exact - x)
+func roundResult(x float64, errSign float64, mode uint64) float64 {
+	if errSign == 0 || mode == roundToNearest {
+		return x
+	}
+	switch mode {
+	case roundDown:
+		if errSign < 0 {
+			return math.Nextafter(x, math.Inf(-1))
+		}
+	case roundUp:
+		if errSign > 0 {
+			return math.Nextafter(x, math.Inf(1))
+		}
+	case roundToZero:
+		if x > 0 && errSign < 0 {
+			return math.Nextafter(x, math.Inf(-1))
+		}
+		if x < 0 && errSign > 0 {
+			return math.Nextafter(x, math.Inf(1))
+		}
+	}
+	return x
+}
+
+func fadd(a, b float64, mode uint64) float64 {
+	s := a + b
+	if s == 0 {
+		// an exact zero sum is -0 when rounding down
+		if mode == roundDown && (a != 0 || b != 0 || math.Signbit(a) || math.Signbit(b)) {
+			return math.Copysign(0, -1)
+		}
+		return s
+	}
+	bb := s - a
+	err := (a - (s - bb)) + (b - bb)
+	return roundResult(s, err, mode)
+}
+
+func fsub(a, b float64, mode uint64) float64 {
+	return fadd(a, -b, mode)
+}
+
+func fmul(a, b float64, mode uint64) float64 {
+	p := a * b
+	return roundResult(p, math.FMA(a, b, -p), mode)
+}
+
+func fdiv(a, b float64, mode uint64) float64 {
+	q := a / b
+	r := math.FMA(-q, b, a)
+	if b < 0 {
+		r = -r
+	}
+	return roundResult(q, r, mode)
+}
+
+func fsqrt(a float64, mode uint64) float64 {
+	s := math.Sqrt(a)
+	return roundResult(s, math.FMA(-s, s, a), mode)
+}
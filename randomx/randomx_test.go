@@ -0,0 +1,121 @@
+package randomx
+
+import (
+	"encoding/hex"
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testCachesMu sync.Mutex
+	testCaches   = make(map[string]*Cache)
+)
+
+// caches are slow to make, so tests share them
+func testCache(key string) *Cache {
+	testCachesMu.Lock()
+	defer testCachesMu.Unlock()
+	if c, ok := testCaches[key]; ok {
+		return c
+	}
+	c := NewCache([]byte(key))
+	testCaches[key] = c
+	return c
+}
+
+func TestAESConstants(t *testing.T) {
+	// spot checks against the constants in the reference implementation
+	require.Equal(t, "53a5ac6d09667162", hex.EncodeToString(gen1RKeys[0][:8]))
+	require.Equal(t, "ddaa2164db3d83d1", hex.EncodeToString(gen4RKeys[0][:8]))
+	require.Equal(t, "0d2cb592de56a89f", hex.EncodeToString(hash1RState[0][:8]))
+	require.Equal(t, "8983faf69f94248b", hex.EncodeToString(hash1RXKeys[0][:8]))
+}
+
+func TestCache(t *testing.T) {
+	c := testCache("test key 000")
+
+	word := func(i int) uint64 {
+		return c.memory[i/argonBlockWords][i%argonBlockWords]
+	}
+	require.Equal(t, uint64(0x191e0e1d23c02186), word(0))
+	require.Equal(t, uint64(0xf1b62fe6210bf8b1), word(1568413))
+	require.Equal(t, uint64(0x1f47f056d05cd99b), word(33554431))
+}
+
+func TestDatasetItem(t *testing.T) {
+	c := testCache("test key 000")
+
+	tests := []struct {
+		item     uint64
+		expected uint64
+	}{
+		{0, 0x680588a85ae222db},
+		{10000000, 0x7943a1f6186ffb72},
+		{20000000, 0x9035244d718095e1},
+		{30000000, 0x145a5091f7853099},
+	}
+	for _, test := range tests {
+		var r [8]uint64
+		c.datasetItem(test.item, &r)
+		require.Equal(t, test.expected, r[0], "item %v", test.item)
+	}
+}
+
+func TestHash(t *testing.T) {
+	tests := []struct {
+		key      string
+		input    string
+		inputHex bool
+		expected string
+	}{
+		{"test key 000", "This is a test", false, "639183aae1bf4c9a35884cb46b09cad9175f04efd7684e7262a0ac1c2f0b4e3f"},
+		{"test key 000", "Lorem ipsum dolor sit amet", false, "300a0adb47603dedb42228ccb2b211104f4da45af709cd7547cd049e9489c969"},
+		{"test key 000", "sed do eiusmod tempor incididunt ut labore et dolore magna aliqua", false, "c36d4ed4191e617309867ed66a443be4075014e2b061bcdaf9ce7b721d2b77a8"},
+		{"test key 001", "sed do eiusmod tempor incididunt ut labore et dolore magna aliqua", false, "e9ff4503201c0c2cca26d285c93ae883f9b1d30c9eb240b820756f2d5a7905fc"},
+		{"test key 001", "0b0b98bea7e805e0010a2126d287a2a0cc833d312cb786385a7c2f9de69d25537f584a9bc9977b00000000666fd8753bf61a8631f12984e3fd44f4014eca629276817b56f32e9b68bd82f416", true, "c56414121acda1713c2f2a819d8ae38aed7c80c35c2a769298d34f03833cd5f1"},
+	}
+
+	for _, test := range tests {
+		input := []byte(test.input)
+		if test.inputHex {
+			var err error
+			input, err = hex.DecodeString(test.input)
+			require.NoError(t, err)
+		}
+		hash := testCache(test.key).Hash(input)
+		require.Equal(t, test.expected, hex.EncodeToString(hash), "key %q input %q", test.key, test.input)
+	}
+}
+
+func TestRounding(t *testing.T) {
+	// 1/3 is inexact, so rounding down and up give neighbouring floats, one of them the nearest
+	down, up := fdiv(1, 3, roundDown), fdiv(1, 3, roundUp)
+	require.Equal(t, up, math.Nextafter(down, 1))
+	require.Contains(t, []float64{down, up}, fdiv(1, 3, roundToNearest))
+	require.Equal(t, fdiv(1, 3, roundDown), fdiv(1, 3, roundToZero))
+	require.Equal(t, fdiv(-1, 3, roundUp), fdiv(-1, 3, roundToZero))
+
+	// exact results are never adjusted
+	require.Equal(t, 0.75, fmul(1.5, 0.5, roundUp))
+	require.Equal(t, 2.0, fsqrt(4, roundDown))
+
+	// only rounding down makes an exact zero sum negative
+	require.True(t, signbit(fsub(1, 1, roundDown)))
+	require.False(t, signbit(fsub(1, 1, roundUp)))
+}
+
+func signbit(x float64) bool {
+	return 1/x < 0
+}
+
+func BenchmarkHash(b *testing.B) {
+	c := testCache("test key 000")
+	input := []byte("This is a test")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Hash(input)
+	}
+}
@@ -0,0 +1,620 @@
+package randomx
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// SuperscalarHash programs turn cache lines into dataset items.  Generating them means simulating
+// a simple out-of-order CPU exactly the way the reference implementation does.
+
+const (
+	superscalarLatency    = 170
+	superscalarMaxSize    = 3*superscalarLatency + 2
+	cycleMapSize          = superscalarLatency + 4
+	lookForwardCycles     = 4
+	maxThrowAwayCount     = 256
+	registerNeedsDisplace = 5
+)
+
+// superscalar instruction types
+const (
+	ssISubR = iota
+	ssIXorR
+	ssIAddRS
+	ssIMulR
+	ssIRorC
+	ssIAddC7
+	ssIXorC7
+	ssIAddC8
+	ssIXorC8
+	ssIAddC9
+	ssIXorC9
+	ssIMulhR
+	ssISmulhR
+	ssIMulRcp
+	ssInvalid = -1
+)
+
+// execution ports
+const (
+	portNull = 0
+	portP0   = 1
+	portP1   = 2
+	portP5   = 4
+	portP01  = portP0 | portP1
+	portP05  = portP0 | portP5
+	portP015 = portP0 | portP1 | portP5
+)
+
+type macroOp struct {
+	size      int
+	latency   int
+	uop1      int
+	uop2      int
+	dependent bool
+}
+
+func (m macroOp) simple() bool     { return m.uop2 == portNull }
+func (m macroOp) eliminated() bool { return m.uop1 == portNull }
+
+var (
+	opAddRR   = macroOp{size: 3, latency: 1, uop1: portP015}
+	opSubRR   = macroOp{size: 3, latency: 1, uop1: portP015}
+	opXorRR   = macroOp{size: 3, latency: 1, uop1: portP015}
+	opImulR   = macroOp{size: 3, latency: 4, uop1: portP1, uop2: portP5}
+	opMulR    = macroOp{size: 3, latency: 4, uop1: portP1, uop2: portP5}
+	opMovRR   = macroOp{size: 3}
+	opLeaSib  = macroOp{size: 4, latency: 1, uop1: portP01}
+	opImulRR  = macroOp{size: 4, latency: 3, uop1: portP1}
+	opRorRI   = macroOp{size: 4, latency: 1, uop1: portP05}
+	opAddRI   = macroOp{size: 7, latency: 1, uop1: portP015}
+	opXorRI   = macroOp{size: 7, latency: 1, uop1: portP015}
+	opMovRI64 = macroOp{size: 10, latency: 1, uop1: portP015}
+)
+
+type instructionInfo struct {
+	typ      int
+	ops      []macroOp
+	resultOp int
+	dstOp    int
+	srcOp    int
+}
+
+var (
+	infoISubR   = &instructionInfo{ssISubR, []macroOp{opSubRR}, 0, 0, 0}
+	infoIXorR   = &instructionInfo{ssIXorR, []macroOp{opXorRR}, 0, 0, 0}
+	infoIAddRS  = &instructionInfo{ssIAddRS, []macroOp{opLeaSib}, 0, 0, 0}
+	infoIMulR   = &instructionInfo{ssIMulR, []macroOp{opImulRR}, 0, 0, 0}
+	infoIRorC   = &instructionInfo{ssIRorC, []macroOp{opRorRI}, 0, 0, -1}
+	infoIAddC7  = &instructionInfo{ssIAddC7, []macroOp{opAddRI}, 0, 0, -1}
+	infoIXorC7  = &instructionInfo{ssIXorC7, []macroOp{opXorRI}, 0, 0, -1}
+	infoIAddC8  = &instructionInfo{ssIAddC8, []macroOp{opAddRI}, 0, 0, -1}
+	infoIXorC8  = &instructionInfo{ssIXorC8, []macroOp{opXorRI}, 0, 0, -1}
+	infoIAddC9  = &instructionInfo{ssIAddC9, []macroOp{opAddRI}, 0, 0, -1}
+	infoIXorC9  = &instructionInfo{ssIXorC9, []macroOp{opXorRI}, 0, 0, -1}
+	infoIMulhR  = &instructionInfo{ssIMulhR, []macroOp{opMovRR, opMulR, opMovRR}, 1, 0, 1}
+	infoISmulhR = &instructionInfo{ssISmulhR, []macroOp{opMovRR, opImulR, opMovRR}, 1, 0, 1}
+	infoIMulRcp = &instructionInfo{ssIMulRcp, []macroOp{opMovRI64, {size: 4, latency: 3, uop1: portP1, dependent: true}}, 1, 1, -1}
+	infoNop     = &instructionInfo{typ: ssInvalid}
+
+	slot3  = []*instructionInfo{infoISubR, infoIXorR}
+	slot3L = []*instructionInfo{infoISubR, infoIXorR, infoIMulhR, infoISmulhR}
+	slot4  = []*instructionInfo{infoIRorC, infoIAddRS}
+	slot7  = []*instructionInfo{infoIXorC7, infoIAddC7}
+	slot8  = []*instructionInfo{infoIXorC8, infoIAddC8}
+	slot9  = []*instructionInfo{infoIXorC9, infoIAddC9}
+)
+
+type decoderBuffer struct {
+	index  int
+	counts []int
+}
+
+var (
+	buffer484  = &decoderBuffer{0, []int{4, 8, 4}}
+	buffer7333 = &decoderBuffer{1, []int{7, 3, 3, 3}}
+	buffer3733 = &decoderBuffer{2, []int{3, 7, 3, 3}}
+	buffer493  = &decoderBuffer{3, []int{4, 9, 3}}
+	buffer4444 = &decoderBuffer{4, []int{4, 4, 4, 4}}
+	buffer3310 = &decoderBuffer{5, []int{3, 3, 10}}
+
+	decodeBuffers = []*decoderBuffer{buffer484, buffer7333, buffer3733, buffer493}
+)
+
+func (b *decoderBuffer) fetchNext(instrType, cycle, mulCount int, gen *blake2Generator) *decoderBuffer {
+	// a 128-bit multiplication needs the 3-3-10 configuration
+	if instrType == ssIMulhR || instrType == ssISmulhR {
+		return buffer3310
+	}
+	// keep the multiplication port saturated
+	if mulCount < cycle+1 {
+		return buffer4444
+	}
+	// IMUL_RCP needs a 4 byte slot at the start of the next buffer
+	if instrType == ssIMulRcp {
+		if gen.getByte()&1 != 0 {
+			return buffer484
+		}
+		return buffer493
+	}
+	return decodeBuffers[gen.getByte()&3]
+}
+
+// blake2Generator is the random source for program generation
+type blake2Generator struct {
+	data  [64]byte
+	index int
+}
+
+func newBlake2Generator(seed []byte, nonce uint32) *blake2Generator {
+	g := &blake2Generator{index: len(blake2Generator{}.data)}
+	if len(seed) > 60 {
+		seed = seed[:60]
+	}
+	copy(g.data[:], seed)
+	binary.LittleEndian.PutUint32(g.data[60:], nonce)
+	return g
+}
+
+func (g *blake2Generator) check(n int) {
+	if g.index+n > len(g.data) {
+		copy(g.data[:], blake2bSum(64, g.data[:]))
+		g.index = 0
+	}
+}
+
+func (g *blake2Generator) getByte() byte {
+	g.check(1)
+	b := g.data[g.index]
+	g.index++
+	return b
+}
+
+func (g *blake2Generator) getUint32() uint32 {
+	g.check(4)
+	v := binary.LittleEndian.Uint32(g.data[g.index:])
+	g.index += 4
+	return v
+}
+
+type registerInfo struct {
+	latency     int
+	lastOpGroup int
+	lastOpPar   int
+}
+
+type ssInstruction struct {
+	info             *instructionInfo
+	src, dst         int
+	mod              byte
+	imm32            uint32
+	opGroup          int
+	opGroupPar       int
+	canReuse         bool
+	groupParIsSource bool
+}
+
+func (s *ssInstruction) typ() int {
+	return s.info.typ
+}
+
+func (s *ssInstruction) createForSlot(gen *blake2Generator, slotSize, fetchType int, isLast bool) {
+	switch slotSize {
+	case 3:
+		// the last slot can also hold a multiplication
+		if isLast {
+			s.create(slot3L[gen.getByte()&3], gen)
+		} else {
+			s.create(slot3[gen.getByte()&1], gen)
+		}
+	case 4:
+		// the 4-4-4-4 buffer issues multiplications first
+		if fetchType == 4 && !isLast {
+			s.create(infoIMulR, gen)
+		} else {
+			s.create(slot4[gen.getByte()&1], gen)
+		}
+	case 7:
+		s.create(slot7[gen.getByte()&1], gen)
+	case 8:
+		s.create(slot8[gen.getByte()&1], gen)
+	case 9:
+		s.create(slot9[gen.getByte()&1], gen)
+	case 10:
+		s.create(infoIMulRcp, gen)
+	}
+}
+
+func (s *ssInstruction) create(info *instructionInfo, gen *blake2Generator) {
+	s.info = info
+	s.src, s.dst = -1, -1
+	s.canReuse, s.groupParIsSource = false, false
+	s.mod, s.imm32 = 0, 0
+
+	switch info.typ {
+	case ssISubR:
+		s.opGroup = ssIAddRS
+		s.groupParIsSource = true
+	case ssIXorR:
+		s.opGroup = ssIXorR
+		s.groupParIsSource = true
+	case ssIAddRS:
+		s.mod = gen.getByte()
+		s.opGroup = ssIAddRS
+		s.groupParIsSource = true
+	case ssIMulR:
+		s.opGroup = ssIMulR
+		s.groupParIsSource = true
+	case ssIRorC:
+		for s.imm32 == 0 {
+			s.imm32 = uint32(gen.getByte() & 63)
+		}
+		s.opGroup = ssIRorC
+		s.opGroupPar = -1
+	case ssIAddC7, ssIAddC8, ssIAddC9:
+		s.imm32 = gen.getUint32()
+		s.opGroup = ssIAddC7
+		s.opGroupPar = -1
+	case ssIXorC7, ssIXorC8, ssIXorC9:
+		s.imm32 = gen.getUint32()
+		s.opGroup = ssIXorC7
+		s.opGroupPar = -1
+	case ssIMulhR, ssISmulhR:
+		s.canReuse = true
+		s.opGroup = info.typ
+		s.opGroupPar = int(gen.getUint32())
+	case ssIMulRcp:
+		for {
+			s.imm32 = gen.getUint32()
+			if !isZeroOrPowerOf2(uint64(s.imm32)) {
+				break
+			}
+		}
+		s.opGroup = ssIMulRcp
+		s.opGroupPar = -1
+	}
+}
+
+func selectRegister(available []int, gen *blake2Generator) (int, bool) {
+	if len(available) == 0 {
+		return 0, false
+	}
+	index := 0
+	if len(available) > 1 {
+		index = int(gen.getUint32() % uint32(len(available)))
+	}
+	return available[index], true
+}
+
+func (s *ssInstruction) selectDestination(cycle int, allowChainedMul bool, registers *[8]registerInfo, gen *blake2Generator) bool {
+	var available []int
+	for i := 0; i < 8; i++ {
+		r := &registers[i]
+		if r.latency <= cycle &&
+			(s.canReuse || i != s.src) &&
+			(allowChainedMul || s.opGroup != ssIMulR || r.lastOpGroup != ssIMulR) &&
+			(r.lastOpGroup != s.opGroup || r.lastOpPar != s.opGroupPar) &&
+			(s.info.typ != ssIAddRS || i != registerNeedsDisplace) {
+			available = append(available, i)
+		}
+	}
+	reg, ok := selectRegister(available, gen)
+	if ok {
+		s.dst = reg
+	}
+	return ok
+}
+
+func (s *ssInstruction) selectSource(cycle int, registers *[8]registerInfo, gen *blake2Generator) bool {
+	var available []int
+	for i := 0; i < 8; i++ {
+		if registers[i].latency <= cycle {
+			available = append(available, i)
+		}
+	}
+	// r5 can't be the IADD_RS destination, so if it's one of only two choices it must be the source
+	if len(available) == 2 && s.info.typ == ssIAddRS {
+		if available[0] == registerNeedsDisplace || available[1] == registerNeedsDisplace {
+			s.src = registerNeedsDisplace
+			s.opGroupPar = registerNeedsDisplace
+			return true
+		}
+	}
+	reg, ok := selectRegister(available, gen)
+	if ok {
+		s.src = reg
+		if s.groupParIsSource {
+			s.opGroupPar = reg
+		}
+	}
+	return ok
+}
+
+func scheduleUop(uop int, portBusy *[cycleMapSize][3]int, cycle int, commit bool) int {
+	// check ports in the order P5, P0, P1 so the multiplication port isn't used by simple ops
+	for ; cycle < cycleMapSize; cycle++ {
+		if uop&portP5 != 0 && portBusy[cycle][2] == 0 {
+			if commit {
+				portBusy[cycle][2] = uop
+			}
+			return cycle
+		}
+		if uop&portP0 != 0 && portBusy[cycle][0] == 0 {
+			if commit {
+				portBusy[cycle][0] = uop
+			}
+			return cycle
+		}
+		if uop&portP1 != 0 && portBusy[cycle][1] == 0 {
+			if commit {
+				portBusy[cycle][1] = uop
+			}
+			return cycle
+		}
+	}
+	return -1
+}
+
+func scheduleMop(mop macroOp, portBusy *[cycleMapSize][3]int, cycle, depCycle int, commit bool) int {
+	if mop.dependent && depCycle > cycle {
+		cycle = depCycle
+	}
+	if mop.eliminated() {
+		return cycle
+	}
+	if mop.simple() {
+		return scheduleUop(mop.uop1, portBusy, cycle, commit)
+	}
+	// both uops must execute in the same cycle
+	for ; cycle < cycleMapSize; cycle++ {
+		cycle1 := scheduleUop(mop.uop1, portBusy, cycle, false)
+		cycle2 := scheduleUop(mop.uop2, portBusy, cycle, false)
+		if cycle1 >= 0 && cycle1 == cycle2 {
+			if commit {
+				scheduleUop(mop.uop1, portBusy, cycle1, true)
+				scheduleUop(mop.uop2, portBusy, cycle2, true)
+			}
+			return cycle1
+		}
+	}
+	return -1
+}
+
+// ssOp is a generated instruction reduced to what execution needs
+type ssOp struct {
+	typ      int
+	dst, src int
+	imm      uint64
+}
+
+type ssProgram struct {
+	instructions []ssInstruction
+	code         []ssOp
+	addressReg   int
+}
+
+func isMultiplication(typ int) bool {
+	return typ == ssIMulR || typ == ssIMulhR || typ == ssISmulhR || typ == ssIMulRcp
+}
+
+func generateSuperscalar(gen *blake2Generator) *ssProgram {
+	var portBusy [cycleMapSize][3]int
+	var registers [8]registerInfo
+	for i := range registers {
+		registers[i].lastOpGroup = ssInvalid
+		registers[i].lastOpPar = -1
+	}
+
+	prog := &ssProgram{}
+	decodeBuffer := &decoderBuffer{}
+	current := ssInstruction{info: infoNop}
+	macroOpIndex := 0
+	cycle, depCycle := 0, 0
+	portsSaturated := false
+	mulCount := 0
+	throwAwayCount := 0
+
+	for decodeCycle := 0; decodeCycle < superscalarLatency && !portsSaturated && len(prog.instructions) < superscalarMaxSize; decodeCycle++ {
+		decodeBuffer = decodeBuffer.fetchNext(current.typ(), decodeCycle, mulCount, gen)
+
+		bufferIndex := 0
+		for bufferIndex < len(decodeBuffer.counts) {
+			topCycle := cycle
+
+			if macroOpIndex >= len(current.info.ops) {
+				if portsSaturated || len(prog.instructions) >= superscalarMaxSize {
+					break
+				}
+				current.createForSlot(gen, decodeBuffer.counts[bufferIndex], decodeBuffer.index, len(decodeBuffer.counts) == bufferIndex+1)
+				macroOpIndex = 0
+			}
+			mop := current.info.ops[macroOpIndex]
+
+			scheduleCycle := scheduleMop(mop, &portBusy, cycle, depCycle, false)
+			if scheduleCycle < 0 {
+				portsSaturated = true
+				break
+			}
+
+			if macroOpIndex == current.info.srcOp {
+				forward := 0
+				for ; forward < lookForwardCycles && !current.selectSource(scheduleCycle, &registers, gen); forward++ {
+					scheduleCycle++
+					cycle++
+				}
+				if forward == lookForwardCycles {
+					if throwAwayCount < maxThrowAwayCount {
+						throwAwayCount++
+						macroOpIndex = len(current.info.ops)
+						continue
+					}
+					current = ssInstruction{info: infoNop}
+					break
+				}
+			}
+
+			if macroOpIndex == current.info.dstOp {
+				forward := 0
+				for ; forward < lookForwardCycles && !current.selectDestination(scheduleCycle, throwAwayCount > 0, &registers, gen); forward++ {
+					scheduleCycle++
+					cycle++
+				}
+				if forward == lookForwardCycles {
+					if throwAwayCount < maxThrowAwayCount {
+						throwAwayCount++
+						macroOpIndex = len(current.info.ops)
+						continue
+					}
+					current = ssInstruction{info: infoNop}
+					break
+				}
+			}
+			throwAwayCount = 0
+
+			scheduleCycle = scheduleMop(mop, &portBusy, scheduleCycle, scheduleCycle, true)
+			if scheduleCycle < 0 {
+				portsSaturated = true
+				break
+			}
+
+			depCycle = scheduleCycle + mop.latency
+
+			if macroOpIndex == current.info.resultOp {
+				r := &registers[current.dst]
+				r.latency = depCycle
+				r.lastOpGroup = current.opGroup
+				r.lastOpPar = current.opGroupPar
+			}
+			bufferIndex++
+			macroOpIndex++
+
+			if scheduleCycle >= superscalarLatency {
+				portsSaturated = true
+			}
+			cycle = topCycle
+
+			if macroOpIndex >= len(current.info.ops) {
+				instr := current
+				if instr.src < 0 {
+					instr.src = instr.dst
+				}
+				prog.instructions = append(prog.instructions, instr)
+				if isMultiplication(current.typ()) {
+					mulCount++
+				}
+			}
+		}
+		cycle++
+	}
+
+	// the address register is the one with the highest latency, assuming unlimited parallelism
+	var asicLatencies [8]int
+	for _, instr := range prog.instructions {
+		latDst := asicLatencies[instr.dst] + 1
+		latSrc := 0
+		if instr.dst != instr.src {
+			latSrc = asicLatencies[instr.src] + 1
+		}
+		if latSrc > latDst {
+			latDst = latSrc
+		}
+		asicLatencies[instr.dst] = latDst
+	}
+	max := 0
+	for i, lat := range asicLatencies {
+		if lat > max {
+			max = lat
+			prog.addressReg = i
+		}
+	}
+
+	prog.compile()
+	return prog
+}
+
+// compile resolves shifts, immediates and reciprocals once instead of for every dataset item
+func (p *ssProgram) compile() {
+	p.code = make([]ssOp, len(p.instructions))
+	for i, instr := range p.instructions {
+		op := ssOp{typ: instr.typ(), dst: instr.dst, src: instr.src}
+		switch op.typ {
+		case ssIAddRS:
+			op.imm = uint64((instr.mod >> 2) % 4)
+		case ssIRorC:
+			op.imm = uint64(instr.imm32)
+		case ssIAddC7, ssIAddC8, ssIAddC9, ssIXorC7, ssIXorC8, ssIXorC9:
+			op.imm = signExtend(instr.imm32)
+		case ssIMulRcp:
+			op.imm = reciprocal(uint64(instr.imm32))
+		}
+		p.code[i] = op
+	}
+}
+
+func (p *ssProgram) execute(r *[8]uint64) {
+	for i := range p.code {
+		op := &p.code[i]
+		dst, src := op.dst&7, op.src&7
+		switch op.typ {
+		case ssISubR:
+			r[dst] -= r[src]
+		case ssIXorR:
+			r[dst] ^= r[src]
+		case ssIAddRS:
+			r[dst] += r[src] << op.imm
+		case ssIMulR:
+			r[dst] *= r[src]
+		case ssIRorC:
+			r[dst] = bits.RotateLeft64(r[dst], -int(op.imm))
+		case ssIAddC7, ssIAddC8, ssIAddC9:
+			r[dst] += op.imm
+		case ssIXorC7, ssIXorC8, ssIXorC9:
+			r[dst] ^= op.imm
+		case ssIMulhR:
+			r[dst], _ = bits.Mul64(r[dst], r[src])
+		case ssISmulhR:
+			r[dst] = smulh(r[dst], r[src])
+		case ssIMulRcp:
+			r[dst] *= op.imm
+		}
+	}
+}
+
+func isZeroOrPowerOf2(x uint64) bool {
+	return x&(x-1) == 0
+}
+
+func signExtend(x uint32) uint64 {
+	return uint64(int64(int32(x)))
+}
+
+// smulh is the high 64 bits of the signed 128-bit product
+func smulh(a, b uint64) uint64 {
+	hi, _ := bits.Mul64(a, b)
+	if int64(a) < 0 {
+		hi -= b
+	}
+	if int64(b) < 0 {
+		hi -= a
+	}
+	return hi
+}
+
+// reciprocal is 2^x / divisor for the highest x that keeps the result within 64 bits
+func reciprocal(divisor uint64) uint64 {
+	const p2exp63 = uint64(1) << 63
+	quotient, remainder := p2exp63/divisor, p2exp63%divisor
+
+	shifts := bits.Len64(divisor)
+	for i := 0; i < shifts; i++ {
+		if remainder >= divisor-remainder {
+			quotient = quotient*2 + 1
+			remainder = remainder*2 - divisor
+		} else {
+			quotient = quotient * 2
+			remainder = remainder * 2
+		}
+	}
+	return quotient
+}
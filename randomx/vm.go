@@ -0,0 +1,463 @@
+package randomx
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+const (
+	programSize       = 256
+	programIterations = 2048
+	programCount      = 8
+
+	scratchpadL1 = 16384
+	scratchpadL2 = 262144
+	scratchpadL3 = 2097152
+
+	scratchpadL1Mask   = (scratchpadL1 - 1) &^ 7
+	scratchpadL2Mask   = (scratchpadL2 - 1) &^ 7
+	scratchpadL3Mask   = (scratchpadL3 - 1) &^ 7
+	scratchpadL3Mask64 = (scratchpadL3 - 1) &^ 63
+	cacheLineAlignMask = (datasetBaseSize - 1) &^ (cacheLineSize - 1)
+
+	conditionOffset  = 8
+	conditionMask    = 255
+	storeL3Condition = 14
+
+	mantissaMask        = (uint64(1) << 52) - 1
+	exponentMask        = (uint64(1) << 11) - 1
+	exponentBias        = 1023
+	dynamicMantissaMask = (uint64(1) << 56) - 1
+	constExponentBits   = 0x300
+	scaleMask           = 0x80F0000000000000
+
+	programBytes = 128 + 8*programSize
+)
+
+// instruction types, in opcode order
+const (
+	opIAddRS = iota
+	opIAddM
+	opISubR
+	opISubM
+	opIMulR
+	opIMulM
+	opIMulhR
+	opIMulhM
+	opISmulhR
+	opISmulhM
+	opIMulRcp
+	opINegR
+	opIXorR
+	opIXorM
+	opIRorR
+	opIRolR
+	opISwapR
+	opFSwapR
+	opFAddR
+	opFAddM
+	opFSubR
+	opFSubM
+	opFScalR
+	opFMulR
+	opFDivM
+	opFSqrtR
+	opCBranch
+	opCFRound
+	opIStore
+	opNop
+)
+
+// opcodes are assigned to instruction types by these frequencies (out of 256)
+var opcodeFrequencies = []int{
+	16, 7, 16, 7, 16, 4, 4, 1, 4, 1, 8, 2, 15, 5, 8, 2, 4,
+	4, 16, 5, 16, 5, 6, 32, 4, 6,
+	25, 1, 16, 0,
+}
+
+var opcodeTypes [256]int
+
+func init() {
+	op := 0
+	for typ, freq := range opcodeFrequencies {
+		for i := 0; i < freq; i++ {
+			opcodeTypes[op] = typ
+			op++
+		}
+	}
+}
+
+type vec struct {
+	lo, hi float64
+}
+
+// bytecode is a decoded program instruction, with register choices and immediates resolved
+type bytecode struct {
+	typ      int
+	dst, src int
+	imm      uint64
+	memMask  uint64
+	shift    uint
+	target   int
+	srcIsImm bool
+	srcZero  bool
+}
+
+type vm struct {
+	cache      *Cache
+	scratchpad []byte
+	program    [programBytes]byte
+	code       [programSize]bytecode
+
+	r          [8]uint64
+	f, e, a    [4]vec
+	mx, ma     uint32
+	readReg    [4]int
+	eMask      [2]uint64
+	datasetOff uint64
+	rounding   uint64
+}
+
+func newVM(c *Cache) *vm {
+	return &vm{cache: c, scratchpad: make([]byte, scratchpadL3)}
+}
+
+// hash calculates the RandomX hash of input
+func (m *vm) hash(input []byte) []byte {
+	seed := blake2bSum(64, input)
+	fillAes1Rx4(seed, m.scratchpad)
+	m.rounding = roundToNearest
+
+	for chain := 0; chain < programCount-1; chain++ {
+		m.run(seed)
+		seed = blake2bSum(64, m.registerFile())
+	}
+	m.run(seed)
+
+	// the group A registers are replaced by a fingerprint of the scratchpad for the final hash
+	var fingerprint [64]byte
+	hashAes1Rx4(m.scratchpad, fingerprint[:])
+	rf := m.registerFile()
+	copy(rf[192:], fingerprint[:])
+	return blake2bSum(32, rf)
+}
+
+func (m *vm) registerFile() []byte {
+	b := make([]byte, 256)
+	for i, r := range m.r {
+		binary.LittleEndian.PutUint64(b[8*i:], r)
+	}
+	for i, groups := range [][4]vec{m.f, m.e, m.a} {
+		for j, v := range groups {
+			off := 64 + 64*i + 16*j
+			binary.LittleEndian.PutUint64(b[off:], math.Float64bits(v.lo))
+			binary.LittleEndian.PutUint64(b[off+8:], math.Float64bits(v.hi))
+		}
+	}
+	return b
+}
+
+func (m *vm) entropy(i int) uint64 {
+	return binary.LittleEndian.Uint64(m.program[8*i:])
+}
+
+func smallPositiveFloat(entropy uint64) float64 {
+	exponent := entropy >> 59
+	mantissa := entropy & mantissaMask
+	exponent += exponentBias
+	exponent &= exponentMask
+	return math.Float64frombits(exponent<<52 | mantissa)
+}
+
+func floatMask(entropy uint64) uint64 {
+	const mask22bit = (uint64(1) << 22) - 1
+	exponent := uint64(constExponentBits) | (entropy>>60)<<4
+	return entropy&mask22bit | exponent<<52
+}
+
+func (m *vm) run(seed []byte) {
+	fillAes4Rx4(seed, m.program[:])
+
+	for i := range m.a {
+		m.a[i] = vec{smallPositiveFloat(m.entropy(2 * i)), smallPositiveFloat(m.entropy(2*i + 1))}
+	}
+	m.ma = uint32(m.entropy(8) & cacheLineAlignMask)
+	m.mx = uint32(m.entropy(10))
+	addressRegisters := m.entropy(12)
+	for i := range m.readReg {
+		m.readReg[i] = 2*i + int(addressRegisters&1)
+		addressRegisters >>= 1
+	}
+	m.datasetOff = (m.entropy(13) % (datasetExtraItems + 1)) * cacheLineSize
+	m.eMask[0] = floatMask(m.entropy(14))
+	m.eMask[1] = floatMask(m.entropy(15))
+
+	m.compile()
+	m.execute()
+}
+
+func (m *vm) compile() {
+	var registerUsage [8]int
+	for i := range registerUsage {
+		registerUsage[i] = -1
+	}
+
+	for i := 0; i < programSize; i++ {
+		instr := m.program[128+8*i:]
+		opcode, dst, src, mod := instr[0], int(instr[1]), int(instr[2]), instr[3]
+		imm32 := binary.LittleEndian.Uint32(instr[4:])
+		modMem := mod % 4
+		modShift := uint((mod >> 2) % 4)
+		modCond := uint(mod >> 4)
+
+		memMask := uint64(scratchpadL2Mask)
+		if modMem != 0 {
+			memMask = scratchpadL1Mask
+		}
+
+		bc := bytecode{typ: opcodeTypes[opcode], dst: dst % 8, src: src % 8}
+		switch bc.typ {
+		case opIAddRS:
+			bc.shift = modShift
+			if bc.dst == registerNeedsDisplace {
+				bc.imm = signExtend(imm32)
+			}
+			registerUsage[bc.dst] = i
+		case opIAddM, opISubM, opIMulM, opIMulhM, opISmulhM, opIXorM:
+			bc.imm = signExtend(imm32)
+			if bc.src != bc.dst {
+				bc.memMask = memMask
+			} else {
+				bc.srcZero = true
+				bc.memMask = scratchpadL3Mask
+			}
+			registerUsage[bc.dst] = i
+		case opISubR, opIMulR, opIXorR:
+			if bc.src == bc.dst {
+				bc.imm = signExtend(imm32)
+				bc.srcIsImm = true
+			}
+			registerUsage[bc.dst] = i
+		case opIRorR, opIRolR:
+			if bc.src == bc.dst {
+				bc.imm = uint64(imm32)
+				bc.srcIsImm = true
+			}
+			registerUsage[bc.dst] = i
+		case opIMulhR, opISmulhR, opINegR:
+			registerUsage[bc.dst] = i
+		case opIMulRcp:
+			divisor := uint64(imm32)
+			if isZeroOrPowerOf2(divisor) {
+				bc.typ = opNop
+			} else {
+				bc.typ = opIMulR
+				bc.imm = reciprocal(divisor)
+				bc.srcIsImm = true
+				registerUsage[bc.dst] = i
+			}
+		case opISwapR:
+			if bc.src != bc.dst {
+				registerUsage[bc.dst] = i
+				registerUsage[bc.src] = i
+			} else {
+				bc.typ = opNop
+			}
+		case opFSwapR:
+			// dst 0-3 is group F, 4-7 is group E
+		case opFAddR, opFSubR, opFMulR:
+			bc.dst %= 4
+			bc.src %= 4
+		case opFAddM, opFSubM, opFDivM:
+			bc.dst %= 4
+			bc.memMask = memMask
+			bc.imm = signExtend(imm32)
+		case opFScalR, opFSqrtR:
+			bc.dst %= 4
+		case opCBranch:
+			bc.target = registerUsage[bc.dst]
+			shift := modCond + conditionOffset
+			bc.imm = signExtend(imm32) | uint64(1)<<shift
+			bc.imm &^= uint64(1) << (shift - 1)
+			bc.memMask = conditionMask << shift
+			for j := range registerUsage {
+				registerUsage[j] = i
+			}
+		case opCFRound:
+			bc.imm = uint64(imm32 & 63)
+		case opIStore:
+			bc.imm = signExtend(imm32)
+			if modCond < storeL3Condition {
+				bc.memMask = memMask
+			} else {
+				bc.memMask = scratchpadL3Mask
+			}
+		}
+		m.code[i] = bc
+	}
+}
+
+func (m *vm) load64(addr uint64) uint64 {
+	return binary.LittleEndian.Uint64(m.scratchpad[addr:])
+}
+
+// loadVec converts two signed 32-bit integers to floats
+func (m *vm) loadVec(addr uint64) vec {
+	return vec{
+		float64(int32(binary.LittleEndian.Uint32(m.scratchpad[addr:]))),
+		float64(int32(binary.LittleEndian.Uint32(m.scratchpad[addr+4:]))),
+	}
+}
+
+func (m *vm) maskE(v vec) vec {
+	return vec{
+		math.Float64frombits(math.Float64bits(v.lo)&dynamicMantissaMask | m.eMask[0]),
+		math.Float64frombits(math.Float64bits(v.hi)&dynamicMantissaMask | m.eMask[1]),
+	}
+}
+
+func (m *vm) execute() {
+	m.r = [8]uint64{}
+	spAddr0, spAddr1 := m.mx, m.ma
+
+	for ic := 0; ic < programIterations; ic++ {
+		spMix := m.r[m.readReg[0]] ^ m.r[m.readReg[1]]
+		spAddr0 ^= uint32(spMix)
+		spAddr0 &= scratchpadL3Mask64
+		spAddr1 ^= uint32(spMix >> 32)
+		spAddr1 &= scratchpadL3Mask64
+
+		for i := range m.r {
+			m.r[i] ^= m.load64(uint64(spAddr0) + 8*uint64(i))
+		}
+		for i := range m.f {
+			m.f[i] = m.loadVec(uint64(spAddr1) + 8*uint64(i))
+		}
+		for i := range m.e {
+			m.e[i] = m.maskE(m.loadVec(uint64(spAddr1) + 8*uint64(4+i)))
+		}
+
+		m.executeCode()
+
+		m.mx ^= uint32(m.r[m.readReg[2]] ^ m.r[m.readReg[3]])
+		m.mx &= cacheLineAlignMask
+		var item [8]uint64
+		m.cache.datasetItem((m.datasetOff+uint64(m.ma))/cacheLineSize, &item)
+		for i := range m.r {
+			m.r[i] ^= item[i]
+		}
+		m.mx, m.ma = m.ma, m.mx
+
+		for i, r := range m.r {
+			binary.LittleEndian.PutUint64(m.scratchpad[uint64(spAddr1)+8*uint64(i):], r)
+		}
+		for i := range m.f {
+			m.f[i] = vec{
+				math.Float64frombits(math.Float64bits(m.f[i].lo) ^ math.Float64bits(m.e[i].lo)),
+				math.Float64frombits(math.Float64bits(m.f[i].hi) ^ math.Float64bits(m.e[i].hi)),
+			}
+			off := uint64(spAddr0) + 16*uint64(i)
+			binary.LittleEndian.PutUint64(m.scratchpad[off:], math.Float64bits(m.f[i].lo))
+			binary.LittleEndian.PutUint64(m.scratchpad[off+8:], math.Float64bits(m.f[i].hi))
+		}
+
+		spAddr0, spAddr1 = 0, 0
+	}
+}
+
+func (m *vm) executeCode() {
+	r := &m.r
+	mode := m.rounding
+	for pc := 0; pc < programSize; pc++ {
+		bc := &m.code[pc]
+
+		src := r[bc.src]
+		if bc.srcIsImm {
+			src = bc.imm
+		}
+		addr := func() uint64 {
+			base := r[bc.src]
+			if bc.srcZero {
+				base = 0
+			}
+			return (base + bc.imm) & bc.memMask
+		}
+
+		switch bc.typ {
+		case opIAddRS:
+			r[bc.dst] += r[bc.src]<<bc.shift + bc.imm
+		case opIAddM:
+			r[bc.dst] += m.load64(addr())
+		case opISubR:
+			r[bc.dst] -= src
+		case opISubM:
+			r[bc.dst] -= m.load64(addr())
+		case opIMulR:
+			r[bc.dst] *= src
+		case opIMulM:
+			r[bc.dst] *= m.load64(addr())
+		case opIMulhR:
+			r[bc.dst], _ = bits.Mul64(r[bc.dst], r[bc.src])
+		case opIMulhM:
+			r[bc.dst], _ = bits.Mul64(r[bc.dst], m.load64(addr()))
+		case opISmulhR:
+			r[bc.dst] = smulh(r[bc.dst], r[bc.src])
+		case opISmulhM:
+			r[bc.dst] = smulh(r[bc.dst], m.load64(addr()))
+		case opINegR:
+			r[bc.dst] = -r[bc.dst]
+		case opIXorR:
+			r[bc.dst] ^= src
+		case opIXorM:
+			r[bc.dst] ^= m.load64(addr())
+		case opIRorR:
+			r[bc.dst] = bits.RotateLeft64(r[bc.dst], -int(src&63))
+		case opIRolR:
+			r[bc.dst] = bits.RotateLeft64(r[bc.dst], int(src&63))
+		case opISwapR:
+			r[bc.dst], r[bc.src] = r[bc.src], r[bc.dst]
+		case opFSwapR:
+			v := &m.f[bc.dst%4]
+			if bc.dst >= 4 {
+				v = &m.e[bc.dst-4]
+			}
+			v.lo, v.hi = v.hi, v.lo
+		case opFAddR:
+			f, a := &m.f[bc.dst], m.a[bc.src]
+			f.lo, f.hi = fadd(f.lo, a.lo, mode), fadd(f.hi, a.hi, mode)
+		case opFAddM:
+			f, v := &m.f[bc.dst], m.loadVec(addr())
+			f.lo, f.hi = fadd(f.lo, v.lo, mode), fadd(f.hi, v.hi, mode)
+		case opFSubR:
+			f, a := &m.f[bc.dst], m.a[bc.src]
+			f.lo, f.hi = fsub(f.lo, a.lo, mode), fsub(f.hi, a.hi, mode)
+		case opFSubM:
+			f, v := &m.f[bc.dst], m.loadVec(addr())
+			f.lo, f.hi = fsub(f.lo, v.lo, mode), fsub(f.hi, v.hi, mode)
+		case opFScalR:
+			f := &m.f[bc.dst]
+			f.lo = math.Float64frombits(math.Float64bits(f.lo) ^ scaleMask)
+			f.hi = math.Float64frombits(math.Float64bits(f.hi) ^ scaleMask)
+		case opFMulR:
+			e, a := &m.e[bc.dst], m.a[bc.src]
+			e.lo, e.hi = fmul(e.lo, a.lo, mode), fmul(e.hi, a.hi, mode)
+		case opFDivM:
+			e, v := &m.e[bc.dst], m.maskE(m.loadVec(addr()))
+			e.lo, e.hi = fdiv(e.lo, v.lo, mode), fdiv(e.hi, v.hi, mode)
+		case opFSqrtR:
+			e := &m.e[bc.dst]
+			e.lo, e.hi = fsqrt(e.lo, mode), fsqrt(e.hi, mode)
+		case opCBranch:
+			r[bc.dst] += bc.imm
+			if r[bc.dst]&bc.memMask == 0 {
+				pc = bc.target
+			}
+		case opCFRound:
+			mode = bits.RotateLeft64(r[bc.src], -int(bc.imm)) % 4
+			m.rounding = mode
+		case opIStore:
+			binary.LittleEndian.PutUint64(m.scratchpad[(r[bc.dst]+bc.imm)&bc.memMask:], r[bc.src])
+		}
+	}
+}
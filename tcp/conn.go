@@ -0,0 +1,42 @@
+package tcp
+
+import (
+	"net"
+	"time"
+)
+
+// deadlineConn sets a deadline before every read and write, so dead sockets are noticed.
+// The worker has workerTimeout to log in, and idleTimeout between messages after that.
+type deadlineConn struct {
+	net.Conn
+	idleTimeout time.Duration
+	loggedIn    bool // only touched by the reading goroutine
+}
+
+func newDeadlineConn(conn net.Conn, idleTimeout time.Duration) *deadlineConn {
+	return &deadlineConn{
+		Conn:        conn,
+		idleTimeout: idleTimeout,
+	}
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	switch {
+	case !c.loggedIn:
+		c.SetReadDeadline(time.Now().Add(workerTimeout))
+	case c.idleTimeout > 0:
+		c.SetReadDeadline(time.Now().Add(c.idleTimeout))
+	default:
+		c.SetReadDeadline(time.Time{})
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.loggedIn = true
+	}
+	return n, err
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	c.SetWriteDeadline(time.Now().Add(jobSendTimeout))
+	return c.Conn.Write(b)
+}
@@ -1,30 +1,119 @@
 package tcp
 
 import (
+	"crypto/tls"
 	"net"
-	"strconv"
+	"sync"
+	"time"
 
 	"github.com/trey-jones/xmrwasp/config"
 	"github.com/trey-jones/xmrwasp/logger"
 )
 
-func StartServer() {
-	tcpPort := config.Get().StratumPort
-	// TODO expose bind address?
-	portStr := ":" + strconv.Itoa(tcpPort)
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+var (
+	// listeners are kept so that Shutdown can close them
+	listeners   []net.Listener
+	listenersMu sync.Mutex
+	closing     bool
+)
+
+// StartServer listens for stratum+tcp connections, or stratum+ssl for a tls listener.  If no
+// certificate is configured, a self-signed certificate is generated for stratum+ssl.
+func StartServer(l config.Listener) {
+	network, address := config.ListenAddress(l.Address)
 
-	logger.Get().Debug("Starting TCP listener on port: ", portStr)
-	listener, err := net.Listen("tcp", portStr)
+	var tlsConf *tls.Config
+	if l.Transport == "tls" {
+		var err error
+		tlsConf, err = tlsConfig()
+		if err != nil {
+			logger.Get().Fatal("Unable to configure TLS for stratum connections: ", err)
+			return
+		}
+	}
+
+	logger.Get().Debug("Starting ", l.Transport, " listener on: ", address)
+	listener, err := config.Listen(l.Address)
 	if err != nil {
-		logger.Get().Fatal("Unable to listen for tcp connections on port: ", listener.Addr(),
+		logger.Get().Fatal("Unable to listen for ", l.Transport, " connections on ", network, " ", address,
 			" Listen failed with error: ", err)
 		return
 	}
+	if tlsConf != nil {
+		listener = tls.NewListener(listener, tlsConf)
+	}
+	serve(listener, l)
+}
+
+// serve accepts connections until the listener is closed.  Temporary errors, like running out
+// of file descriptors, are retried with a growing delay, the way net/http does.  Other errors
+// stop the listener.
+func serve(listener net.Listener, l config.Listener) {
+	if !track(listener) {
+		listener.Close()
+		return
+	}
+	var delay time.Duration
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			logger.Get().Println("Unable to accept connection: ", err)
+			if isClosing() {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				delay = acceptDelay(delay)
+				logger.Get().Printf("Unable to accept connection: %v; retrying in %v\n", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			logger.Get().Println("Stopped accepting ", l.Transport, " connections: ", err)
+			return
 		}
-		go SpawnWorker(conn)
+		delay = 0
+		go SpawnWorker(conn, l)
+	}
+}
+
+// acceptDelay doubles the wait after a failed accept, from minAcceptDelay up to maxAcceptDelay
+func acceptDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return minAcceptDelay
+	}
+	if delay *= 2; delay > maxAcceptDelay {
+		return maxAcceptDelay
+	}
+	return delay
+}
+
+// track remembers the listener, unless the server is already shutting down
+func track(listener net.Listener) bool {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	if closing {
+		return false
+	}
+	listeners = append(listeners, listener)
+	return true
+}
+
+func isClosing() bool {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	return closing
+}
+
+// Shutdown stops accepting new connections.  Workers that are already connected are left to the proxy.
+func Shutdown() {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	closing = true
+	for _, l := range listeners {
+		l.Close()
 	}
+	listeners = nil
 }
@@ -0,0 +1,131 @@
+package tcp
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/trey-jones/stratum"
+	"github.com/trey-jones/xmrwasp/config"
+	"github.com/trey-jones/xmrwasp/proxy"
+)
+
+type mockPool struct{}
+
+func (m *mockPool) Login(p map[string]interface{}, resp *proxy.LoginReply) error {
+	resp.ID = "0"
+	resp.Job = &proxy.Job{
+		Blob:   "0606f8f788d1058707a9bdfea5390bdce41ccab6a3c7e923d3ba32827a0da9771398d9962a5fc80000000063b1df2fb16d38222fe97968b72f0d540277be4f910823e4d66e30b0483c87da04",
+		ID:     "1",
+		Target: "b88d0600",
+	}
+	resp.Status = "OK"
+	return nil
+}
+
+func (m *mockPool) Keepalived(p map[string]interface{}, resp *proxy.StatusReply) error {
+	resp.Status = "KEEPALIVED"
+	return nil
+}
+
+// startMockPool serves logins on a local port, for the proxies that the workers are added to
+func startMockPool() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	s := stratum.NewServer()
+	s.RegisterName("mining", &mockPool{})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.ServeCodec(stratum.NewDefaultServerCodec(conn))
+		}
+	}()
+	return listener.Addr().String(), nil
+}
+
+func TestMain(m *testing.M) {
+	addr, err := startMockPool()
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("XMRWASP_URL", addr)
+	os.Setenv("XMRWASP_LOGIN", "testwallet")
+	os.Setenv("XMRWASP_PASSWORD", "x")
+	defer os.Clearenv()
+
+	os.Exit(m.Run())
+}
+
+func TestTLSListener(t *testing.T) {
+	tlsConf, err := tlsConfig()
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go serve(tls.NewListener(listener, tlsConf), config.Listener{Transport: "tls"})
+	defer listener.Close()
+
+	// the certificate is self-signed, so the miner can only pin it
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	require.NoError(t, err)
+	require.NoError(t, conn.Handshake())
+	require.Equal(t, tlsConf.Certificates[0].Certificate[0], conn.ConnectionState().PeerCertificates[0].Raw)
+
+	c := stratum.NewClient(conn)
+	defer c.Close()
+	reply := proxy.LoginReply{}
+	require.NoError(t, c.Call("login", map[string]interface{}{"login": "x", "pass": "x", "agent": "test"}, &reply))
+	require.Equal(t, "OK", reply.Status)
+	require.NotNil(t, reply.Job)
+	require.NotEmpty(t, reply.Job.Blob)
+}
+
+// failingListener fails to accept with each of errs in turn
+type failingListener struct {
+	net.Listener
+	errs []error
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	err := l.errs[0]
+	l.errs = l.errs[1:]
+	return nil, err
+}
+
+func (l *failingListener) Close() error {
+	return nil
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func TestServeErrors(t *testing.T) {
+	require.Equal(t, minAcceptDelay, acceptDelay(0))
+	require.Equal(t, 2*minAcceptDelay, acceptDelay(minAcceptDelay))
+	require.Equal(t, maxAcceptDelay, acceptDelay(maxAcceptDelay))
+
+	// temporary errors are retried, anything else stops the listener
+	l := &failingListener{errs: []error{temporaryError{}, temporaryError{}, errors.New("listener is dead")}}
+	done := make(chan struct{})
+	go func() {
+		serve(l, config.Listener{Transport: "tcp"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve kept going after a permanent error")
+	}
+	require.Empty(t, l.errs)
+}
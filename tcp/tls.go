@@ -0,0 +1,82 @@
+package tcp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/trey-jones/xmrwasp/config"
+	"github.com/trey-jones/xmrwasp/logger"
+)
+
+const selfSignedValidity = 10 * 365 * 24 * time.Hour
+
+var (
+	// every tls listener shares the config, so they all have the same self-signed certificate
+	sharedTLSConfig *tls.Config
+	sharedTLSErr    error
+	sharedTLSOnce   sync.Once
+)
+
+func tlsConfig() (*tls.Config, error) {
+	sharedTLSOnce.Do(func() {
+		sharedTLSConfig, sharedTLSErr = newTLSConfig()
+	})
+	return sharedTLSConfig, sharedTLSErr
+}
+
+func newTLSConfig() (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	certFile, keyFile := config.Get().CertFile, config.Get().KeyFile
+	if certFile != "" && keyFile != "" {
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+	} else {
+		cert, err = selfSignedCertificate()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// selfSignedCertificate generates a throwaway certificate.  Miners can't verify it,
+// but they can pin the fingerprint, which is logged.
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"xmrwasp"}, CommonName: "xmrwasp"},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	fingerprint := sha256.Sum256(der)
+	logger.Get().Println("Generated self-signed TLS certificate with SHA-256 fingerprint: ",
+		hex.EncodeToString(fingerprint[:]))
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
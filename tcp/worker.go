@@ -3,22 +3,31 @@ package tcp
 import (
 	"context"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/trey-jones/stratum"
+	"github.com/trey-jones/xmrwasp/config"
+	"github.com/trey-jones/xmrwasp/metrics"
 	"github.com/trey-jones/xmrwasp/proxy"
 )
 
 const (
-	workerTimeout  = 1 * time.Minute
+	// new connections have this long to send their login
+	workerTimeout = 1 * time.Minute
+	// writes to the worker fail after this long
 	jobSendTimeout = 30 * time.Second
 )
 
 // worker does the work (of mining, well more like accounting)
 type Worker struct {
-	conn net.Conn
-	id   uint64
-	p    *proxy.Proxy
+	conn     net.Conn
+	listener config.Listener
+
+	// the director can move the worker to another proxy while it is connected
+	mu sync.RWMutex
+	id uint64
+	p  *proxy.Proxy
 
 	// codec will be used directly for sending jobs
 	// this is not ideal, and it would be nice to do this differently
@@ -27,23 +36,27 @@ type Worker struct {
 	jobs chan *proxy.Job
 }
 
-// SpawnWorker spawns a new TCP worker and adds it to a proxy
-func SpawnWorker(conn net.Conn) {
+// SpawnWorker spawns a new TCP worker for a connection to the listener, and adds it to a proxy
+func SpawnWorker(conn net.Conn, l config.Listener) {
 	w := &Worker{
-		conn: conn,
-		jobs: make(chan *proxy.Job),
+		conn:     newDeadlineConn(conn, time.Duration(config.Get().IdleTimeout)*time.Second),
+		listener: l,
+		jobs:     make(chan *proxy.Job),
 	}
 	ctx := context.WithValue(context.Background(), "worker", w)
 	codec := stratum.NewDefaultServerCodecContext(ctx, w.Conn())
 	w.codec = codec.(*stratum.DefaultServerCodec)
 
-	p := proxy.GetDirector().NextProxy()
+	p := proxy.GetDirector().NextProxy(l)
 	p.Add(w)
+	metrics.WorkerConnections.With("tcp").Inc()
+	metrics.Workers.With("tcp").Inc()
 
 	// blocks until disconnect
 	w.Proxy().SS.ServeCodec(codec)
 
-	w.p.Remove(w)
+	w.Proxy().Remove(w)
+	metrics.Workers.With("tcp").Dec()
 }
 
 func (w *Worker) Conn() net.Conn {
@@ -56,21 +69,41 @@ func (w *Worker) SetConn(c net.Conn) {
 
 // Worker interface
 func (w *Worker) ID() uint64 {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
 	return w.id
 }
 
 func (w *Worker) SetID(i uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 	w.id = i
 }
 
 func (w *Worker) SetProxy(p *proxy.Proxy) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 	w.p = p
 }
 
 func (w *Worker) Proxy() *proxy.Proxy {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
 	return w.p
 }
 
+func (w *Worker) RemoteAddr() string {
+	return w.Conn().RemoteAddr().String()
+}
+
+func (w *Worker) Transport() string {
+	return w.listener.Transport
+}
+
+func (w *Worker) Listener() config.Listener {
+	return w.listener
+}
+
 func (w *Worker) Disconnect() {
 	w.Conn().Close()
 }
@@ -0,0 +1,82 @@
+package ws
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/trey-jones/xmrwasp/config"
+	"github.com/trey-jones/xmrwasp/logger"
+	"github.com/trey-jones/xmrwasp/metrics"
+)
+
+// checkOrigin is the Upgrader.CheckOrigin for every websocket listener.  The allowed origins
+// are read on every handshake, so they change when the config is reloaded.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// not a browser, and browsers are the reason for checking
+		return true
+	}
+	if originAllowed(origin, config.Get().Origins) {
+		return true
+	}
+
+	metrics.OriginsRejected.Inc()
+	logger.Get().Printf("Rejected websocket connection from %v with origin %q\n", remoteAddr(r), origin)
+	return false
+}
+
+// originAllowed matches an Origin header against the allowed origins.  An empty list allows
+// everything.  "example.com" allows that host on any scheme and port, "*.example.com" allows
+// its subdomains, and "https://example.com:8443" also has to match the scheme and port.
+func originAllowed(origin string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+
+	for _, pattern := range allowed {
+		scheme := ""
+		if parts := strings.SplitN(pattern, "://", 2); len(parts) == 2 {
+			scheme, pattern = parts[0], parts[1]
+		}
+		if scheme != "" && !strings.EqualFold(scheme, u.Scheme) {
+			continue
+		}
+
+		host := u.Hostname()
+		if _, _, err := net.SplitHostPort(pattern); err == nil {
+			host = u.Host
+			if u.Port() == "" {
+				host = net.JoinHostPort(u.Hostname(), defaultPort(u.Scheme))
+			}
+		}
+		if hostMatches(strings.ToLower(host), strings.ToLower(pattern)) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostMatches compares a host to a pattern that may start with a wildcard for subdomains
+func hostMatches(host, pattern string) bool {
+	if pattern == "*" {
+		return true
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:]) && len(host) > len(pattern)-1
+	}
+	return host == pattern
+}
+
+func defaultPort(scheme string) string {
+	if strings.EqualFold(scheme, "https") {
+		return "443"
+	}
+	return "80"
+}
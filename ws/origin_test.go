@@ -0,0 +1,36 @@
+package ws
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	allowed := []string{"example.com", "*.miners.example.org", "https://secure.example.net:8443"}
+	tests := []struct {
+		origin string
+		ok     bool
+	}{
+		{"https://example.com", true},
+		{"http://EXAMPLE.com:8080", true},
+		{"https://www.example.com", false},
+		{"https://evil-example.com", false},
+		{"https://a.miners.example.org", true},
+		{"https://a.b.miners.example.org", true},
+		{"https://miners.example.org", false},
+		{"https://evilminers.example.org", false},
+		{"https://secure.example.net:8443", true},
+		{"http://secure.example.net:8443", false},
+		{"https://secure.example.net", false},
+		{"null", false},
+		{"not a url", false},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.ok, originAllowed(test.origin, allowed), test.origin)
+	}
+
+	require.True(t, originAllowed("https://anywhere.com", nil))
+	require.True(t, originAllowed("https://anywhere.com", []string{"*"}))
+	require.True(t, originAllowed("https://example.com", []string{"https://example.com:443"}))
+}
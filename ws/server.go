@@ -1,34 +1,72 @@
 package ws
 
 import (
+	"context"
 	"net/http"
-	"strconv"
+	"sync"
 
 	"github.com/eyesore/ws"
 	"github.com/trey-jones/xmrwasp/config"
 	"github.com/trey-jones/xmrwasp/logger"
 )
 
-func StartServer() {
-	h := ws.NewHandler(NewWorker)
-	h.AllowAnyOrigin()
+var (
+	// servers are kept so that Shutdown can stop them
+	servers   []*http.Server
+	serversMu sync.Mutex
+)
+
+// StartServer serves websocket connections on the listener, with TLS for a wss listener
+func StartServer(l config.Listener) {
+	h := ws.NewHandler(NewFactory(l))
+	h.Upgrader.CheckOrigin = checkOrigin
+	h.PongTimeout = workerTimeout
+	h.WriteTimeout = jobSendTimeout
 
-	http.Handle("/", h)
-	websocketPort := config.Get().WebsocketPort
-	portStr := ":" + strconv.Itoa(websocketPort)
-	if config.Get().SecureWebsocket {
+	mux := http.NewServeMux()
+	mux.Handle("/", h)
+	srv := &http.Server{Handler: mux}
+	serversMu.Lock()
+	servers = append(servers, srv)
+	serversMu.Unlock()
+
+	network, address := config.ListenAddress(l.Address)
+	logger.Get().Debug("Starting webserver on: ", address)
+	if len(config.Get().Origins) == 0 {
+		logger.Get().Println("Websocket connections on ", address, " are accepted from any website.  Set origins to limit them.")
+	}
+	listener, err := config.Listen(l.Address)
+	if err != nil {
+		logger.Get().Fatal("Unable to listen for websocket connections on ", network, " ", address,
+			" Listen failed with error: ", err)
+		return
+	}
+
+	if l.Transport == "wss" {
 		logger.Get().Debug("Trying to start secure webserver to handle websocket connections.")
-		cert := config.Get().CertFile
-		key := config.Get().KeyFile
-		err := http.ListenAndServeTLS(portStr, cert, key, nil)
-		if err != nil {
+		err = srv.ServeTLS(listener, config.Get().CertFile, config.Get().KeyFile)
+		if err != nil && err != http.ErrServerClosed {
 			logger.Get().Fatal("Failed to start TLS server: ", err)
 		}
 		return
 	}
-	logger.Get().Debug("Starting webserver on port: ", websocketPort)
-	err := http.ListenAndServe(portStr, nil)
-	if err != nil {
+	err = srv.Serve(listener)
+	if err != nil && err != http.ErrServerClosed {
 		logger.Get().Fatal("Failed to start server: ", err)
 	}
 }
+
+// Shutdown stops accepting new connections.  Websocket connections are taken over from the
+// http server, so they are left to the proxy.
+func Shutdown(ctx context.Context) error {
+	serversMu.Lock()
+	srvs := servers
+	serversMu.Unlock()
+	var err error
+	for _, srv := range srvs {
+		if shutdownErr := srv.Shutdown(ctx); shutdownErr != nil {
+			err = shutdownErr
+		}
+	}
+	return err
+}
@@ -2,24 +2,37 @@ package ws
 
 import (
 	"context"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/eyesore/ws"
 	"github.com/trey-jones/stratum"
+	"github.com/trey-jones/xmrwasp/config"
+	"github.com/trey-jones/xmrwasp/metrics"
 	"github.com/trey-jones/xmrwasp/proxy"
 )
 
 const (
-	workerTimeout  = 1 * time.Minute
+	// a connection that doesn't answer a ping in this long is closed
+	workerTimeout = 1 * time.Minute
+	// writes to the worker fail after this long
 	jobSendTimeout = 30 * time.Second
 )
 
 // Worker does the work (of mining, well more like accounting) and implements the ws.Server interface
 type Worker struct {
 	wsConn *ws.Conn
-	id     uint64
-	p      *proxy.Proxy
+
+	// the director can move the worker to another proxy while it is connected
+	mu sync.RWMutex
+	id uint64
+	p  *proxy.Proxy
+
+	remoteAddr string
+	listener   config.Listener
 
 	// codec will be used directly for sending jobs
 	// this is not ideal, and it would be nice to do this differently
@@ -28,13 +41,16 @@ type Worker struct {
 	jobs chan *proxy.Job
 }
 
-// NewWorker is a ws.Factory
-func NewWorker() (ws.Connector, error) {
-	w := &Worker{
-		jobs: make(chan *proxy.Job),
-	}
+// NewFactory makes a ws.Factory for workers connecting to the listener
+func NewFactory(l config.Listener) ws.Factory {
+	return func() (ws.Connector, error) {
+		w := &Worker{
+			listener: l,
+			jobs:     make(chan *proxy.Job),
+		}
 
-	return w, nil
+		return w, nil
+	}
 }
 
 // Conn implements ews.Connector
@@ -47,8 +63,29 @@ func (w *Worker) SetConn(c *ws.Conn) {
 	w.wsConn = c
 }
 
+// remoteAddr is the address of the miner.  Connections on a Unix socket come from a reverse
+// proxy on the same machine, so its headers are trusted for the real address.  Only what the
+// reverse proxy set is used: X-Real-IP, or else the last X-Forwarded-For entry, since the
+// miner can send X-Forwarded-For entries of its own that come before it.
+func remoteAddr(r *http.Request) string {
+	if _, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return r.RemoteAddr
+	}
+	if real := strings.TrimSpace(r.Header.Get("X-Real-IP")); real != "" {
+		return real
+	}
+	if forwarded := r.Header["X-Forwarded-For"]; len(forwarded) > 0 {
+		entries := strings.Split(forwarded[len(forwarded)-1], ",")
+		if last := strings.TrimSpace(entries[len(entries)-1]); last != "" {
+			return last
+		}
+	}
+	return r.RemoteAddr
+}
+
 // OnConnect implements ews.Connector
 func (w *Worker) OnConnect(r *http.Request) error {
+	w.remoteAddr = remoteAddr(r)
 	// if protocols := r.Header.Get("sec-websocket-protocol"); protocols != "" {
 	//     protocolList := strings.Split(protocols, ",")
 	//     w.Conn().ResponseHeader.Add("sec-websocket-protocol", "json")
@@ -62,8 +99,10 @@ func (w *Worker) OnOpen() error {
 	codec := stratum.NewCoinhiveServerCodecContext(ctx, w.Conn())
 	w.codec = codec.(*stratum.CoinhiveServerCodec)
 
-	p := proxy.GetDirector().NextProxy()
+	p := proxy.GetDirector().NextProxy(w.listener)
 	p.Add(w)
+	metrics.WorkerConnections.With("ws").Inc()
+	metrics.Workers.With("ws").Inc()
 	go w.Proxy().SS.ServeCodec(codec)
 
 	return nil
@@ -72,28 +111,55 @@ func (w *Worker) OnOpen() error {
 // OnClose implements ews.Connector
 func (w *Worker) OnClose(wasClean bool, code int, reason error) error {
 	// logger.Get().Debugln("OnClose is called for worker")
-	w.p.Remove(w)
+	w.Proxy().Remove(w)
+	metrics.Workers.With("ws").Dec()
 
 	return nil
 }
 
 // Worker interface
 func (w *Worker) ID() uint64 {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
 	return w.id
 }
 
 func (w *Worker) SetID(i uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 	w.id = i
 }
 
 func (w *Worker) SetProxy(p *proxy.Proxy) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 	w.p = p
 }
 
 func (w *Worker) Proxy() *proxy.Proxy {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
 	return w.p
 }
 
+func (w *Worker) RemoteAddr() string {
+	return w.remoteAddr
+}
+
+func (w *Worker) Transport() string {
+	return w.listener.Transport
+}
+
+func (w *Worker) Listener() config.Listener {
+	return w.listener
+}
+
+// Reject implements proxy.Rejecter with a Coinhive error message
+func (w *Worker) Reject(reason string) {
+	w.codec.Notify("error", map[string]string{"error": reason})
+	w.Disconnect()
+}
+
 func (w *Worker) Disconnect() {
 	// logger.Get().Debugln("Disconnect is called for worker.")
 	w.Conn().Close()
@@ -0,0 +1,28 @@
+package ws
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteAddr(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "192.0.2.1:4000"
+	r.Header.Set("X-Real-IP", "198.51.100.7")
+	require.Equal(t, "192.0.2.1:4000", remoteAddr(r))
+
+	// behind a reverse proxy on a Unix socket
+	r.RemoteAddr = "@"
+	require.Equal(t, "198.51.100.7", remoteAddr(r))
+
+	// the miner's own entries come first, and the reverse proxy appends the real address
+	r.Header.Del("X-Real-IP")
+	r.Header.Set("X-Forwarded-For", "203.0.113.9, 10.0.0.1")
+	r.Header.Add("X-Forwarded-For", "203.0.113.10,198.51.100.7")
+	require.Equal(t, "198.51.100.7", remoteAddr(r))
+
+	r.Header.Del("X-Forwarded-For")
+	require.Equal(t, "@", remoteAddr(r))
+}